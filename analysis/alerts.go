@@ -0,0 +1,269 @@
+package analysis
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/redhatinsights/miniop/history"
+	"github.com/spf13/viper"
+)
+
+// Alert is an active alert in Alertmanager
+type Alert struct {
+	Labels   map[string]string `json:"labels"`
+	StartsAt time.Time         `json:"startsAt"`
+}
+
+// Alerts returns the active alerts that aren't silenced or inhibited and
+// match all matchers, from the Alertmanager at ALERTMANAGER_URL
+func Alerts(matchers map[string]string) ([]Alert, error) {
+	query := url.Values{}
+	query.Set("active", "true")
+	query.Set("silenced", "false")
+	query.Set("inhibited", "false")
+	for name, value := range matchers {
+		query.Add("filter", fmt.Sprintf("%s=%q", name, value))
+	}
+
+	var alerts []Alert
+	if err := getJSON(viper.GetString("ALERTMANAGER_URL"), "/api/v2/alerts", query, &alerts); err != nil {
+		return nil, err
+	}
+	return alerts, nil
+}
+
+// DefaultPodLabels are the labels that name the pod an alert is about
+var DefaultPodLabels = []string{"kubernetes_pod_name", "pod"}
+
+// Attribution tells what an alert is about
+type Attribution int
+
+const (
+	// CanaryAlert is about the canary pod
+	CanaryAlert Attribution = iota
+	// StableAlert is about another pod
+	StableAlert
+	// ServiceAlert isn't about any pod
+	ServiceAlert
+)
+
+// Attribute returns what alert is about, the first of podLabels the alert
+// has names its pod
+func Attribute(alert Alert, canaryPod string, podLabels []string) Attribution {
+	for _, label := range podLabels {
+		pod, ok := alert.Labels[label]
+		if !ok || pod == "" {
+			continue
+		}
+		if pod == canaryPod {
+			return CanaryAlert
+		}
+		return StableAlert
+	}
+	return ServiceAlert
+}
+
+// AlertAction is what an alert with all of Labels does to a canary: "fail"
+// it, "extend" its incubation by Extend past the deadline it had when the
+// alert was first seen, or only "record" it.  An alert, told apart by its
+// labels like Alertmanager's fingerprint, extends the incubation only once.
+type AlertAction struct {
+	Labels map[string]string `json:"labels"`
+	Action string            `json:"action"`
+	Extend string            `json:"extend,omitempty"`
+
+	extend time.Duration
+}
+
+// matches returns true if alert has all labels of the action
+func (a AlertAction) matches(alert Alert) bool {
+	for name, value := range a.Labels {
+		if alert.Labels[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// failAction applies to alerts without an action
+var failAction = AlertAction{Action: "fail"}
+
+// alerts fails canaries with more than Max alerts, by default any, matching
+// Matchers and attributed to the canary.  Matchers default to the alerts
+// about the canary pod.
+type alerts struct {
+	matchers  map[string]*template.Template
+	podLabels []string
+	ignore    map[string]bool
+	actions   []AlertAction
+	spec      Spec
+}
+
+func newAlerts(spec Spec) (*alerts, error) {
+	matchers := spec.Matchers
+	if len(matchers) == 0 {
+		matchers = map[string]string{"kubernetes_pod_name": "{{.Pod}}"}
+	}
+	switch spec.ServiceAlerts {
+	case "", "fail", "ignore":
+	default:
+		return nil, fmt.Errorf("serviceAlerts must be fail or ignore, not %q", spec.ServiceAlerts)
+	}
+	a := &alerts{
+		matchers:  make(map[string]*template.Template),
+		podLabels: spec.PodLabels,
+		ignore:    make(map[string]bool),
+		spec:      spec,
+	}
+	if len(a.podLabels) == 0 {
+		a.podLabels = DefaultPodLabels
+	}
+	for _, name := range spec.Ignore {
+		a.ignore[name] = true
+	}
+	for _, action := range spec.Actions {
+		switch action.Action {
+		case "fail", "record":
+		case "extend":
+			extend, err := time.ParseDuration(action.Extend)
+			if err != nil || extend <= 0 {
+				return nil, fmt.Errorf("invalid extend %q", action.Extend)
+			}
+			action.extend = extend
+		default:
+			return nil, fmt.Errorf("action must be fail, extend or record, not %q", action.Action)
+		}
+		a.actions = append(a.actions, action)
+	}
+	for name, value := range matchers {
+		t, err := template.New(name).Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid matcher %s: %v", name, err)
+		}
+		a.matchers[name] = t
+	}
+	return a, nil
+}
+
+func (a *alerts) polled() {}
+
+func (a *alerts) Start(c *Canary) error {
+	return nil
+}
+
+func (a *alerts) Evaluate(c *Canary) (Result, error) {
+	return a.Verdict(c)
+}
+
+func (a *alerts) Verdict(c *Canary) (Result, error) {
+	matchers := make(map[string]string)
+	for name, t := range a.matchers {
+		value, err := render(t, c)
+		if err != nil {
+			return Result{}, err
+		}
+		matchers[name] = value
+	}
+
+	firing, err := Alerts(matchers)
+	if err != nil {
+		return Result{}, err
+	}
+	counted := a.attributed(firing, c.Pod.GetName())
+	failing, decisions := a.decide(counted, c)
+	if max := a.spec.max(0); float64(len(failing)) > max {
+		return Result{Verdict: Fail, Reason: fmt.Sprintf("alerts firing: %s", alertNames(failing)), Decisions: decisions}, nil
+	}
+	for _, decision := range decisions {
+		if decision.Until != nil && decision.Until.After(c.Deadline) {
+			return Result{
+				Verdict:   Pending,
+				Reason:    fmt.Sprintf("incubation extended until %s by %s", decision.Until.Format(time.RFC3339), decision.Alert),
+				Decisions: decisions,
+			}, nil
+		}
+	}
+	if skipped := len(firing) - len(counted); skipped > 0 {
+		return Result{Verdict: Pass, Reason: fmt.Sprintf("%d alerts firing, %d not about the canary", len(counted), skipped), Decisions: decisions}, nil
+	}
+	return Result{Verdict: Pass, Reason: fmt.Sprintf("%d alerts firing", len(counted)), Decisions: decisions}, nil
+}
+
+// decide applies the actions to the counted alerts, it returns the alerts
+// that fail the canary and a decision for every alert
+func (a *alerts) decide(counted []Alert, c *Canary) ([]Alert, []history.Decision) {
+	var failing []Alert
+	var decisions []history.Decision
+	for _, alert := range counted {
+		action := failAction
+		for _, candidate := range a.actions {
+			if candidate.matches(alert) {
+				action = candidate
+				break
+			}
+		}
+
+		// times are normalized so that decisions compare equal once recorded
+		started := alert.StartsAt.UTC().Truncate(time.Second)
+		decision := history.Decision{Alert: alert.Labels["alertname"], Labels: alert.Labels, Action: action.Action, Time: started}
+		switch action.Action {
+		case "fail":
+			failing = append(failing, alert)
+		case "extend":
+			if earlier, ok := extended(c.Decisions, alert.Labels); ok {
+				decision.From, decision.Until = earlier.From, earlier.Until
+				break
+			}
+			from := c.Deadline.UTC().Truncate(time.Second)
+			until := from.Add(action.extend)
+			decision.From, decision.Until = &from, &until
+		}
+		decisions = append(decisions, decision)
+	}
+	return failing, decisions
+}
+
+// extended returns the earlier decision that extended the incubation for
+// the alert with labels
+func extended(decisions []history.Decision, labels map[string]string) (history.Decision, bool) {
+	for _, decision := range decisions {
+		if decision.Until != nil && reflect.DeepEqual(decision.Labels, labels) {
+			return decision, true
+		}
+	}
+	return history.Decision{}, false
+}
+
+// attributed returns the alerts that count against the canary
+func (a *alerts) attributed(firing []Alert, canaryPod string) []Alert {
+	var counted []Alert
+	for _, alert := range firing {
+		if a.ignore[alert.Labels["alertname"]] {
+			continue
+		}
+		switch Attribute(alert, canaryPod, a.podLabels) {
+		case StableAlert:
+			continue
+		case ServiceAlert:
+			if a.spec.ServiceAlerts == "ignore" {
+				continue
+			}
+		}
+		counted = append(counted, alert)
+	}
+	return counted
+}
+
+func alertNames(alerts []Alert) string {
+	names := make([]string, 0, len(alerts))
+	for _, alert := range alerts {
+		names = append(names, alert.Labels["alertname"])
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,522 @@
+// Package analysis decides whether a canary is healthy.  Each deploymentconfig
+// declares the analyzers its canaries are checked with in the canary-analysis
+// annotation, a JSON list of Specs.  A canary fails as soon as one analyzer
+// fails and passes once every analyzer passed after the canary finished
+// incubating.
+package analysis
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "github.com/openshift/api/apps/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redhatinsights/miniop/history"
+	l "github.com/redhatinsights/miniop/logger"
+	"github.com/spf13/viper"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+func init() {
+	l.InitLogger()
+	viper.SetDefault("ANALYSIS_INTERVAL", "1m")
+	viper.SetDefault("ANALYSIS_MAX_TIMEOUT", "2m")
+	viper.SetDefault("ANALYSIS_MAX_RETRIES", 5)
+}
+
+const (
+	// Annotation declares the analyzers of a deploymentconfig
+	Annotation = "canary-analysis"
+	// VerdictsAnnotation records the verdict of every analyzer, on the
+	// canary pod while it runs and on the deploymentconfig once it is decided
+	VerdictsAnnotation = "canary-verdicts"
+)
+
+var verdictCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "canary_analysis_verdicts_total",
+	Help: "A count of the verdicts of decided canaries per deploymentconfig, analyzer and verdict",
+}, []string{"deploymentconfig", "analyzer", "verdict"})
+
+// DefaultSpecs are used without canary-analysis: a canary fails if its
+// container restarts
+var DefaultSpecs = []Spec{{Analyzer: "restarts"}}
+
+// Verdict is the outcome of an analysis
+type Verdict string
+
+const (
+	// Pending means the analyzer has no objection yet but hasn't decided
+	Pending Verdict = "pending"
+	// Pass means the canary is healthy
+	Pass Verdict = "pass"
+	// Fail means the canary is unhealthy
+	Fail Verdict = "fail"
+)
+
+// decisionLimit is the number of decisions kept per analyzer
+const decisionLimit = 10
+
+// Result is a verdict and why it was reached
+type Result struct {
+	Verdict Verdict `json:"verdict"`
+	Reason  string  `json:"reason,omitempty"`
+	// Decisions are what the alerts seen so far did to the canary
+	Decisions []history.Decision `json:"decisions,omitempty"`
+	// Attempts counts the failed calls of an analyzer that is retried at
+	// RetryAt
+	Attempts int        `json:"attempts,omitempty"`
+	RetryAt  *time.Time `json:"retryAt,omitempty"`
+}
+
+// retryBackoff is waited before the first retry of a call, doubled for
+// every further retry
+var retryBackoff = time.Second
+
+// retryable is an error of an analyzer call that is worth retrying up to
+// retries times
+type retryable struct {
+	err     error
+	retries int
+}
+
+func (r *retryable) Error() string {
+	return r.err.Error()
+}
+
+// Canary is what analyzers look at
+type Canary struct {
+	Pod              *apiv1.Pod
+	DeploymentConfig *v1.DeploymentConfig
+	// Container is the name of the canary container
+	Container string
+	Image     string
+	// Deadline is when the canary finishes incubating
+	Deadline time.Time
+	// Baseline lists the stable pods of the deploymentconfig
+	Baseline func() ([]apiv1.Pod, error)
+	// Decisions are the ones the analyzer made about earlier alerts, Analyze
+	// sets them for every analyzer
+	Decisions []history.Decision
+}
+
+// Analyzer checks one aspect of a canary.  Analyzers don't keep state
+// between calls, anything they need to remember about a canary has to be
+// derived from it.
+type Analyzer interface {
+	// Start is called once when a canary is first analyzed
+	Start(c *Canary) error
+	// Evaluate is called while the canary incubates, a Fail ends it early.
+	// Errors are logged and otherwise ignored.
+	Evaluate(c *Canary) (Result, error)
+	// Verdict decides once the canary finished incubating.  A Pending
+	// verdict is asked for again later, errors are retried.
+	Verdict(c *Canary) (Result, error)
+}
+
+// Spec declares an analyzer and its thresholds.  Only the fields the
+// analyzer uses are read.
+type Spec struct {
+	// Analyzer is the type of analyzer, see New
+	Analyzer string `json:"analyzer"`
+	// Name tells several analyzers of the same type apart, it defaults to
+	// Analyzer
+	Name string `json:"name,omitempty"`
+	// Max and Min bound the measured value
+	Max *float64 `json:"max,omitempty"`
+	Min *float64 `json:"min,omitempty"`
+	// Query is the PromQL query of the promql analyzer.  NoData is what a
+	// promql query without results or a comparison without enough data
+	// counts as: "fail", the default, "wait" to ask again or "pass"
+	Query  string `json:"query,omitempty"`
+	NoData string `json:"noData,omitempty"`
+	// Metrics are compared by the compare analyzer between the canary and
+	// Sample stable pods, a metric is worse if the test's p-value is below
+	// Alpha
+	Metrics []Metric `json:"metrics,omitempty"`
+	Sample  int      `json:"sample,omitempty"`
+	Alpha   float64  `json:"alpha,omitempty"`
+	// Matchers select the alerts of the alerts analyzer
+	Matchers map[string]string `json:"matchers,omitempty"`
+	// PodLabels are the labels naming the pod an alert is about, by default
+	// DefaultPodLabels.  Alerts about other pods than the canary are never
+	// counted, ServiceAlerts decides whether alerts without any of the
+	// labels are: "fail", the default, or "ignore".  Alerts named in Ignore
+	// aren't counted either.
+	PodLabels     []string `json:"podLabels,omitempty"`
+	ServiceAlerts string   `json:"serviceAlerts,omitempty"`
+	Ignore        []string `json:"ignore,omitempty"`
+	// Actions decide what the alerts counted by the alerts analyzer do, the
+	// first action whose labels an alert has applies.  Alerts without an
+	// action fail the canary.
+	Actions []AlertAction `json:"actions,omitempty"`
+	// Command names an executable in ANALYSIS_EXEC_DIR, Args are passed to
+	// it
+	Command string   `json:"command,omitempty"`
+	Args    []string `json:"args,omitempty"`
+	// Endpoint names a URL in ANALYSIS_ENDPOINTS
+	Endpoint string `json:"endpoint,omitempty"`
+	// Inconclusive is what an inconclusive answer of the endpoint counts
+	// as: "wait" to ask again, the default, "pass" or "fail"
+	Inconclusive string `json:"inconclusive,omitempty"`
+	// Retries is how often a failed call to the endpoint is retried, it
+	// defaults to 2 and is limited to ANALYSIS_MAX_RETRIES
+	Retries *int `json:"retries,omitempty"`
+	// Timeout limits external analyzers, it defaults to a minute and is
+	// limited to ANALYSIS_MAX_TIMEOUT
+	Timeout string `json:"timeout,omitempty"`
+}
+
+func (s Spec) name() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return s.Analyzer
+}
+
+func (s Spec) timeout() time.Duration {
+	timeout := time.Minute
+	if t, err := time.ParseDuration(s.Timeout); err == nil && t > 0 {
+		timeout = t
+	}
+	if max := viper.GetDuration("ANALYSIS_MAX_TIMEOUT"); max > 0 && timeout > max {
+		return max
+	}
+	return timeout
+}
+
+func (s Spec) retries() int {
+	retries := 2
+	if s.Retries != nil && *s.Retries >= 0 {
+		retries = *s.Retries
+	}
+	if max := viper.GetInt("ANALYSIS_MAX_RETRIES"); retries > max {
+		return max
+	}
+	return retries
+}
+
+// max returns the configured maximum or def
+func (s Spec) max(def float64) float64 {
+	if s.Max != nil {
+		return *s.Max
+	}
+	return def
+}
+
+// bounds fails value if it is outside of Min and Max
+func (s Spec) bounds(what string, value float64) Result {
+	if s.Max != nil && value > *s.Max {
+		return Result{Verdict: Fail, Reason: fmt.Sprintf("%s %g above %g", what, value, *s.Max)}
+	}
+	if s.Min != nil && value < *s.Min {
+		return Result{Verdict: Fail, Reason: fmt.Sprintf("%s %g below %g", what, value, *s.Min)}
+	}
+	return Result{Verdict: Pass, Reason: fmt.Sprintf("%s %g", what, value)}
+}
+
+// validNoData returns an error if NoData is none of the known values
+func (s Spec) validNoData() error {
+	switch s.NoData {
+	case "", "fail", "wait", "pass":
+		return nil
+	}
+	return fmt.Errorf("noData must be fail, wait or pass")
+}
+
+// missing returns what NoData says an analyzer without data to decide on
+// counts as
+func (s Spec) missing(reason string) Result {
+	switch s.NoData {
+	case "pass":
+		return Result{Verdict: Pass, Reason: reason}
+	case "wait":
+		return Result{Verdict: Pending, Reason: reason}
+	}
+	return Result{Verdict: Fail, Reason: reason}
+}
+
+// New returns the analyzer for spec
+func New(spec Spec) (Analyzer, error) {
+	switch spec.Analyzer {
+	case "restarts":
+		return restarts{spec}, nil
+	case "conditions":
+		return conditions{spec}, nil
+	case "alerts":
+		return newAlerts(spec)
+	case "promql":
+		return newPromQL(spec)
+	case "compare":
+		return newCompare(spec)
+	case "exec":
+		return newExec(spec)
+	case "http":
+		return newHTTP(spec)
+	}
+	return nil, fmt.Errorf("unknown analyzer %q", spec.Analyzer)
+}
+
+// Named is an analyzer with the name it is recorded under
+type Named struct {
+	Name string
+	Analyzer
+}
+
+// ForDeploymentConfig returns the analyzers declared by dc
+func ForDeploymentConfig(dc *v1.DeploymentConfig) ([]Named, error) {
+	specs := DefaultSpecs
+	if annotation, ok := dc.Annotations[Annotation]; ok {
+		specs = nil
+		if err := json.Unmarshal([]byte(annotation), &specs); err != nil {
+			return nil, fmt.Errorf("invalid %s annotation: %v", Annotation, err)
+		}
+	}
+
+	analyzers := make([]Named, 0, len(specs))
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		if seen[spec.name()] {
+			return nil, fmt.Errorf("analyzer %s is declared twice, set distinct names", spec.name())
+		}
+		seen[spec.name()] = true
+
+		analyzer, err := New(spec)
+		if err != nil {
+			return nil, fmt.Errorf("analyzer %s: %v", spec.name(), err)
+		}
+		analyzers = append(analyzers, Named{Name: spec.name(), Analyzer: analyzer})
+	}
+	return analyzers, nil
+}
+
+// Record holds the verdicts of the analyzers for a canary pod
+type Record struct {
+	Pod      string            `json:"pod"`
+	Verdicts map[string]Result `json:"verdicts"`
+}
+
+// GetRecord returns the verdicts recorded in annotations, an unreadable
+// record is treated as empty
+func GetRecord(annotations map[string]string) Record {
+	var record Record
+	json.Unmarshal([]byte(annotations[VerdictsAnnotation]), &record)
+	return record
+}
+
+// Set stores the record in annotations
+func (r Record) Set(annotations map[string]string) {
+	value, _ := json.Marshal(r)
+	annotations[VerdictsAnnotation] = string(value)
+}
+
+// Count adds the verdicts of a decided canary to the verdicts metric
+func (r Record) Count(dc *v1.DeploymentConfig) {
+	for name, result := range r.Verdicts {
+		verdictCounter.With(prometheus.Labels{"deploymentconfig": dc.GetName(), "analyzer": name, "verdict": string(result.Verdict)}).Inc()
+	}
+}
+
+// Equal returns true if both records hold the same verdicts
+func (r Record) Equal(other Record) bool {
+	return r.Pod == other.Pod && reflect.DeepEqual(r.Verdicts, other.Verdicts)
+}
+
+// Deadline returns deadline, or the end of the latest incubation extended by
+// an alert if that is later
+func (r Record) Deadline(deadline time.Time) time.Time {
+	for _, result := range r.Verdicts {
+		for _, decision := range result.Decisions {
+			if decision.Until != nil && decision.Until.After(deadline) {
+				deadline = *decision.Until
+			}
+		}
+	}
+	return deadline
+}
+
+// Decisions returns the decisions of all analyzers
+func (r Record) Decisions() []history.Decision {
+	names := make([]string, 0, len(r.Verdicts))
+	for name := range r.Verdicts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var decisions []history.Decision
+	for _, name := range names {
+		decisions = append(decisions, r.Verdicts[name].Decisions...)
+	}
+	return decisions
+}
+
+// Combined is the verdict of the whole analysis: failed if any analyzer
+// failed, passed if all passed and pending otherwise
+func (r Record) Combined() Result {
+	names := make([]string, 0, len(r.Verdicts))
+	for name := range r.Verdicts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	combined := Result{Verdict: Pass}
+	pending := []string{}
+	for _, name := range names {
+		switch result := r.Verdicts[name]; result.Verdict {
+		case Fail:
+			return Result{Verdict: Fail, Reason: fmt.Sprintf("%s: %s", name, result.Reason)}
+		case Pending:
+			combined.Verdict = Pending
+			pending = append(pending, name)
+		}
+	}
+	if combined.Verdict == Pending {
+		combined.Reason = fmt.Sprintf("waiting for %s", strings.Join(pending, ", "))
+	}
+	return combined
+}
+
+// NextRetry returns how long until the earliest retry of an analyzer is due
+func (r Record) NextRetry(now time.Time) (time.Duration, bool) {
+	var next *time.Time
+	for _, result := range r.Verdicts {
+		if result.RetryAt != nil && (next == nil || result.RetryAt.Before(*next)) {
+			next = result.RetryAt
+		}
+	}
+	if next == nil {
+		return 0, false
+	}
+	return next.Sub(now), true
+}
+
+// FailedAnalyzer returns the name of the first failed analyzer
+func (r Record) FailedAnalyzer() string {
+	names := make([]string, 0, len(r.Verdicts))
+	for name, result := range r.Verdicts {
+		if result.Verdict == Fail {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		return ""
+	}
+	return names[0]
+}
+
+// polled analyzers look at something outside of the canary pod, so their
+// canaries have to be checked periodically instead of on pod changes
+type polled interface {
+	polled()
+}
+
+// NextCheck returns when the canary has to be checked again while it
+// incubates: every ANALYSIS_INTERVAL if any analyzer is polled, otherwise at
+// the deadline
+func NextCheck(analyzers []Named, c *Canary, now time.Time) time.Duration {
+	wait := c.Deadline.Sub(now)
+	for _, analyzer := range analyzers {
+		if _, ok := analyzer.Analyzer.(polled); ok {
+			if interval := viper.GetDuration("ANALYSIS_INTERVAL"); interval < wait {
+				return interval
+			}
+			break
+		}
+	}
+	return wait
+}
+
+// Analyze runs the analyzers for canary and returns the updated record.
+// Before the deadline analyzers are evaluated, afterwards they give their
+// verdict.  Verdicts that already passed for the canary aren't asked for
+// again.  Failed calls worth retrying are recorded as pending with the time
+// of the retry, the analyzer isn't asked again before then.
+func Analyze(analyzers []Named, c *Canary, previous Record, now time.Time) (Record, error) {
+	record := Record{Pod: c.Pod.GetName(), Verdicts: make(map[string]Result)}
+	fresh := previous.Pod != record.Pod
+	ripe := now.After(c.Deadline)
+
+	for _, analyzer := range analyzers {
+		if fresh {
+			if err := analyzer.Start(c); err != nil {
+				return previous, fmt.Errorf("failed to start analyzer %s: %v", analyzer.Name, err)
+			}
+		} else if last, ok := previous.Verdicts[analyzer.Name]; ok && last.Verdict == Pass && ripe {
+			record.Verdicts[analyzer.Name] = last
+			continue
+		} else if ok && last.RetryAt != nil && now.Before(*last.RetryAt) {
+			record.Verdicts[analyzer.Name] = last
+			continue
+		}
+
+		canary := *c
+		canary.Decisions = nil
+		if !fresh {
+			canary.Decisions = previous.Verdicts[analyzer.Name].Decisions
+		}
+		var result Result
+		var err error
+		if ripe {
+			result, err = analyzer.Verdict(&canary)
+		} else {
+			result, err = analyzer.Evaluate(&canary)
+		}
+		if r, ok := err.(*retryable); ok {
+			attempts := 1
+			if !fresh {
+				attempts = previous.Verdicts[analyzer.Name].Attempts + 1
+			}
+			if attempts <= r.retries {
+				retryAt := now.Add(retryBackoff << uint(attempts-1))
+				result, err = Result{Verdict: Pending, Reason: fmt.Sprintf("retrying: %v", r.err), Attempts: attempts, RetryAt: &retryAt}, nil
+			}
+		}
+		if ripe {
+			if err != nil {
+				return previous, fmt.Errorf("analyzer %s failed: %v", analyzer.Name, err)
+			}
+		} else if err != nil {
+			l.Log.Info(fmt.Sprintf("analyzer %s failed: %v", analyzer.Name, err))
+			result = Result{Verdict: Pending, Reason: err.Error()}
+		} else if result.Verdict == Pass {
+			// only a verdict can pass a canary
+			result.Verdict = Pending
+		}
+		if !fresh {
+			// decisions about alerts that stopped firing still hold
+			result.Decisions = mergeDecisions(previous.Verdicts[analyzer.Name].Decisions, result.Decisions)
+		}
+		record.Verdicts[analyzer.Name] = result
+	}
+	return record, nil
+}
+
+// mergeDecisions adds the decisions about alerts not seen before to
+// previous, up to decisionLimit
+func mergeDecisions(previous, current []history.Decision) []history.Decision {
+	merged := previous
+	seen := make(map[string]bool)
+	for _, decision := range previous {
+		seen[decisionKey(decision)] = true
+	}
+	for _, decision := range current {
+		if len(merged) >= decisionLimit {
+			break
+		}
+		if key := decisionKey(decision); !seen[key] {
+			seen[key] = true
+			merged = append(merged, decision)
+		}
+	}
+	return merged
+}
+
+func decisionKey(decision history.Decision) string {
+	labels, _ := json.Marshal(decision.Labels)
+	return fmt.Sprintf("%s %s %s %s", decision.Alert, decision.Action, decision.Time.UTC().Format(time.RFC3339), labels)
+}
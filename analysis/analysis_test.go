@@ -0,0 +1,453 @@
+package analysis
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/openshift/api/apps/v1"
+	"github.com/spf13/viper"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func canary(restarts int32, deadline time.Time) *Canary {
+	return &Canary{
+		Pod: &apiv1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "testing-canary", Namespace: "test"},
+			Status: apiv1.PodStatus{ContainerStatuses: []apiv1.ContainerStatus{
+				{Name: "foo", RestartCount: restarts},
+			}},
+		},
+		DeploymentConfig: &v1.DeploymentConfig{ObjectMeta: metav1.ObjectMeta{Name: "testing"}},
+		Container:        "foo",
+		Image:            "barv2",
+		Deadline:         deadline,
+	}
+}
+
+func analyzers(t *testing.T, annotation string) []Named {
+	t.Helper()
+	dc := &v1.DeploymentConfig{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{}}}
+	if annotation != "" {
+		dc.Annotations[Annotation] = annotation
+	}
+	named, err := ForDeploymentConfig(dc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return named
+}
+
+func TestForDeploymentConfig(t *testing.T) {
+	if named := analyzers(t, ""); len(named) != 1 || named[0].Name != "restarts" {
+		t.Errorf("expected the restarts analyzer by default, got %v", named)
+	}
+	if named := analyzers(t, `[{"analyzer": "alerts"}, {"analyzer": "restarts", "name": "few-restarts", "max": 2}]`); len(named) != 2 || named[1].Name != "few-restarts" {
+		t.Errorf("unexpected analyzers %v", named)
+	}
+
+	for _, invalid := range []string{
+		`[{"analyzer": "magic"}]`,
+		`[{"analyzer": "restarts"}, {"analyzer": "restarts"}]`,
+		`[{"analyzer": "promql", "query": "up"}]`,
+		`[{"analyzer": "promql", "query": "up", "max": 1, "noData": "ignore"}]`,
+		`[{"analyzer": "exec", "command": "../bin/sh"}]`,
+		`not json`,
+	} {
+		dc := &v1.DeploymentConfig{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{Annotation: invalid}}}
+		if _, err := ForDeploymentConfig(dc); err == nil {
+			t.Errorf("expected %s to be rejected", invalid)
+		}
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	now := time.Now()
+	restarts := analyzers(t, `[{"analyzer": "restarts", "max": 1}]`)
+
+	record, err := Analyze(restarts, canary(0, now.Add(time.Minute)), Record{}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if combined := record.Combined(); combined.Verdict != Pending {
+		t.Errorf("an incubating canary was decided: %v", combined)
+	}
+
+	record, _ = Analyze(restarts, canary(2, now.Add(time.Minute)), record, now)
+	if combined := record.Combined(); combined.Verdict != Fail || combined.Reason != "restarts: 2 restarts" {
+		t.Errorf("expected an early failure, got %v", combined)
+	}
+
+	record, _ = Analyze(restarts, canary(1, now.Add(-time.Minute)), Record{}, now)
+	if combined := record.Combined(); combined.Verdict != Pass {
+		t.Errorf("expected the ripe canary to pass, got %v", combined)
+	}
+
+	// a verdict that passed isn't asked for again
+	record, _ = Analyze(restarts, canary(5, now.Add(-time.Minute)), record, now)
+	if combined := record.Combined(); combined.Verdict != Pass {
+		t.Errorf("a passed verdict was reconsidered: %v", combined)
+	}
+}
+
+func TestConditions(t *testing.T) {
+	c := canary(0, time.Now())
+	c.Pod.Status.ContainerStatuses[0].State.Waiting = &apiv1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}
+	if result, _ := (conditions{}).Evaluate(c); result.Verdict != Fail {
+		t.Errorf("crash looping canary wasn't failed: %v", result)
+	}
+
+	c = canary(0, time.Now())
+	c.Pod.Status.Conditions = []apiv1.PodCondition{{Type: apiv1.PodReady, Status: apiv1.ConditionTrue}}
+	if result, _ := (conditions{}).Verdict(c); result.Verdict != Pass {
+		t.Errorf("ready canary didn't pass: %v", result)
+	}
+}
+
+func TestAlerts(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/alerts" || r.URL.Query().Get("filter") != `kubernetes_pod_name="testing-canary"` {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `[{"labels": {"alertname": "HighErrorRate", "kubernetes_pod_name": "testing-canary"}}]`)
+	}))
+	defer srv.Close()
+	viper.Set("ALERTMANAGER_URL", srv.URL)
+	defer viper.Set("ALERTMANAGER_URL", "")
+
+	named := analyzers(t, `[{"analyzer": "alerts"}]`)
+	result, err := named[0].Verdict(canary(0, time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Verdict != Fail || result.Reason != "alerts firing: HighErrorRate" {
+		t.Errorf("expected the firing alert to fail the canary, got %v", result)
+	}
+}
+
+func TestAlertAttribution(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"labels": {"alertname": "HighLatency", "kubernetes_pod_name": "testing-1-a"}},
+			{"labels": {"alertname": "Watchdog"}},
+			{"labels": {"alertname": "HighErrorRate", "service": "testing"}},
+			{"labels": {"alertname": "OOMKilled", "pod": "testing-canary"}}]`)
+	}))
+	defer srv.Close()
+	viper.Set("ALERTMANAGER_URL", srv.URL)
+	defer viper.Set("ALERTMANAGER_URL", "")
+
+	tests := []struct {
+		annotation string
+		verdict    Verdict
+		reason     string
+	}{
+		{`[{"analyzer": "alerts", "matchers": {"service": "testing"}}]`, Fail, "alerts firing: HighErrorRate, OOMKilled, Watchdog"},
+		{`[{"analyzer": "alerts", "matchers": {"service": "testing"}, "ignore": ["Watchdog"], "serviceAlerts": "ignore"}]`, Fail, "alerts firing: OOMKilled"},
+		{`[{"analyzer": "alerts", "matchers": {"service": "testing"}, "ignore": ["Watchdog"], "max": 2}]`, Pass, "2 alerts firing, 2 not about the canary"},
+		{`[{"analyzer": "alerts", "matchers": {"service": "testing"}, "podLabels": ["kubernetes_pod_name"], "serviceAlerts": "ignore"}]`, Pass, "0 alerts firing, 4 not about the canary"},
+	}
+	for _, test := range tests {
+		result, err := analyzers(t, test.annotation)[0].Verdict(canary(0, time.Now()))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.annotation, err)
+		} else if result.Verdict != test.verdict || result.Reason != test.reason {
+			t.Errorf("%s: expected %s (%s), got %v", test.annotation, test.verdict, test.reason, result)
+		}
+	}
+
+	if _, err := New(Spec{Analyzer: "alerts", ServiceAlerts: "maybe"}); err == nil {
+		t.Error("expected an invalid serviceAlerts to be rejected")
+	}
+}
+
+func TestAlertActions(t *testing.T) {
+	started := time.Now().Add(-time.Minute).UTC().Truncate(time.Second)
+	firing := []string{
+		fmt.Sprintf(`{"labels": {"alertname": "SlowRequests", "severity": "warning", "pod": "testing-canary"}, "startsAt": %q}`, started.Format(time.RFC3339)),
+		`{"labels": {"alertname": "Deprecated", "severity": "info", "pod": "testing-canary"}}`,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "[%s]", strings.Join(firing, ","))
+	}))
+	defer srv.Close()
+	viper.Set("ALERTMANAGER_URL", srv.URL)
+	defer viper.Set("ALERTMANAGER_URL", "")
+
+	named := analyzers(t, `[{"analyzer": "alerts", "actions": [
+		{"labels": {"severity": "critical"}, "action": "fail"},
+		{"labels": {"severity": "warning"}, "action": "extend", "extend": "10m"},
+		{"labels": {"severity": "info"}, "action": "record"}]}]`)
+	c := canary(0, time.Now().Add(-time.Second))
+	c.Pod.CreationTimestamp = metav1.NewTime(time.Now().Add(-time.Hour))
+
+	record, err := Analyze(named, c, Record{}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := record.Combined(); result.Verdict != Pending {
+		t.Errorf("expected the warning to extend the incubation, got %v", result)
+	}
+	deadline := c.Deadline.UTC().Truncate(time.Second)
+	if until := record.Deadline(c.Deadline); !until.Equal(deadline.Add(10 * time.Minute)) {
+		t.Errorf("expected the incubation to end 10m after the deadline, got %s", until)
+	}
+	decisions := record.Decisions()
+	if len(decisions) != 2 || decisions[0].Action != "extend" || decisions[1].Action != "record" {
+		t.Fatalf("unexpected decisions %+v", decisions)
+	}
+	if from := decisions[0].From; from == nil || !from.Equal(deadline) {
+		t.Errorf("expected the deadline before the extension to be recorded, got %v", from)
+	}
+
+	// the warning is still firing on the next check
+	c.Deadline = record.Deadline(c.Deadline)
+	again, err := Analyze(named, c, record, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if until := again.Deadline(c.Deadline); !until.Equal(c.Deadline) {
+		t.Errorf("expected the warning to extend the incubation only once, got %s", until)
+	}
+
+	// the warning resolved and a critical alert fires
+	firing = []string{`{"labels": {"alertname": "HighErrorRate", "severity": "critical", "pod": "testing-canary"}}`}
+	next, err := Analyze(named, c, again, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := next.Combined(); result.Verdict != Fail || result.Reason != "alerts: alerts firing: HighErrorRate" {
+		t.Errorf("expected the critical alert to fail the canary, got %v", result)
+	}
+	if decisions := next.Decisions(); len(decisions) != 3 || decisions[0].Alert != "SlowRequests" || decisions[2].Alert != "HighErrorRate" {
+		t.Errorf("expected earlier decisions to be kept, got %+v", decisions)
+	}
+
+	for _, invalid := range []string{
+		`[{"analyzer": "alerts", "actions": [{"labels": {"severity": "warning"}, "action": "extend"}]}]`,
+		`[{"analyzer": "alerts", "actions": [{"labels": {"severity": "warning"}, "action": "page"}]}]`,
+	} {
+		dc := &v1.DeploymentConfig{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{Annotation: invalid}}}
+		if _, err := ForDeploymentConfig(dc); err == nil {
+			t.Errorf("%s: expected an error", invalid)
+		}
+	}
+}
+
+func TestPromQL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("query") != `error_ratio{pod="testing-canary"}` {
+			fmt.Fprint(w, `{"status": "success", "data": {"resultType": "vector", "result": []}}`)
+			return
+		}
+		fmt.Fprint(w, `{"status": "success", "data": {"resultType": "vector", "result": [{"metric": {}, "value": [1, "0.2"]}]}}`)
+	}))
+	defer srv.Close()
+	viper.Set("PROMETHEUS_URL", srv.URL)
+	defer viper.Set("PROMETHEUS_URL", "")
+
+	tests := []struct {
+		annotation string
+		verdict    Verdict
+	}{
+		{`[{"analyzer": "promql", "query": "error_ratio{pod=\"{{.Pod}}\"}", "max": 0.1}]`, Fail},
+		{`[{"analyzer": "promql", "query": "error_ratio{pod=\"{{.Pod}}\"}", "max": 0.5}]`, Pass},
+		{`[{"analyzer": "promql", "query": "error_ratio{pod=\"{{.Pod}}\"}", "min": 0.5}]`, Fail},
+		{`[{"analyzer": "promql", "query": "missing", "max": 0.1}]`, Fail},
+		{`[{"analyzer": "promql", "query": "missing", "max": 0.1, "noData": "wait"}]`, Pending},
+		{`[{"analyzer": "promql", "query": "missing", "max": 0.1, "noData": "pass"}]`, Pass},
+	}
+	for _, test := range tests {
+		result, err := analyzers(t, test.annotation)[0].Verdict(canary(0, time.Now()))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.annotation, err)
+		} else if result.Verdict != test.verdict {
+			t.Errorf("%s: expected %s, got %v", test.annotation, test.verdict, result)
+		}
+	}
+}
+
+func TestExec(t *testing.T) {
+	dir, err := ioutil.TempDir("", "analyzers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := "#!/bin/sh\necho checking $CANARY_POD\n[ \"$1\" = good ] || { echo \"$CANARY_IMAGE is bad\"; exit 1; }\n"
+	ioutil.WriteFile(filepath.Join(dir, "e2e"), []byte(script), 0755)
+	viper.Set("ANALYSIS_EXEC_DIR", dir)
+	defer viper.Set("ANALYSIS_EXEC_DIR", "/etc/miniop/analyzers")
+
+	result, err := analyzers(t, `[{"analyzer": "exec", "command": "e2e", "args": ["good"]}]`)[0].Verdict(canary(0, time.Now()))
+	if err != nil || result.Verdict != Pass {
+		t.Errorf("expected a pass, got %v, %v", result, err)
+	}
+	result, err = analyzers(t, `[{"analyzer": "exec", "command": "e2e"}]`)[0].Verdict(canary(0, time.Now()))
+	if err != nil || result.Verdict != Fail || result.Reason != "barv2 is bad" {
+		t.Errorf("expected a failure, got %v, %v", result, err)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	calls := 0
+	var last callout
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&last)
+		switch {
+		case !last.Final:
+			fmt.Fprint(w, `{"verdict": "inconclusive", "message": "suite running"}`)
+		default:
+			fmt.Fprint(w, `{"verdict": "fail", "message": "checkout broken"}`)
+		}
+	}))
+	defer srv.Close()
+	viper.Set("ANALYSIS_ENDPOINTS", "e2e=http://localhost:1, kpi="+srv.URL)
+	defer viper.Set("ANALYSIS_ENDPOINTS", "")
+
+	now := time.Now()
+	c := canary(0, now.Add(time.Hour))
+	c.Pod.Status.PodIP = "10.0.0.7"
+	named := analyzers(t, `[{"analyzer": "http", "endpoint": "kpi"}]`)
+	kpi := named[0]
+
+	record, err := Analyze(named, c, Record{}, now)
+	retry := record.Verdicts["http"]
+	if err != nil || retry.Verdict != Pending || retry.Attempts != 1 || retry.RetryAt == nil {
+		t.Fatalf("expected the unavailable endpoint to be retried, got %v, %v", retry, err)
+	}
+	if wait, ok := record.NextRetry(now); !ok || wait != retryBackoff {
+		t.Errorf("expected a retry in %s, got %s", retryBackoff, wait)
+	}
+	if record, _ = Analyze(named, c, record, now); calls != 1 {
+		t.Error("the endpoint was called again before the retry was due")
+	}
+
+	record, err = Analyze(named, c, record, *retry.RetryAt)
+	result := record.Verdicts["http"]
+	if err != nil || result.Verdict != Pending || result.Reason != "inconclusive: suite running" || result.RetryAt != nil {
+		t.Errorf("expected an inconclusive answer to wait, got %v, %v", result, err)
+	}
+	if last.PodIP != "10.0.0.7" || last.Pod != "testing-canary" || last.Image != "barv2" {
+		t.Errorf("canary details were not posted: %+v", last)
+	}
+
+	result, err = kpi.Verdict(c)
+	if err != nil || result.Verdict != Fail || result.Reason != "checkout broken" {
+		t.Errorf("expected the endpoint's verdict, got %v, %v", result, err)
+	}
+
+	strict := analyzers(t, `[{"analyzer": "http", "endpoint": "kpi", "inconclusive": "fail"}]`)[0]
+	if result, _ := strict.Evaluate(c); result.Verdict != Fail {
+		t.Errorf("expected an inconclusive answer to fail, got %v", result)
+	}
+
+	unreachable := analyzers(t, `[{"analyzer": "http", "endpoint": "e2e", "retries": 0, "timeout": "1s"}]`)[0]
+	if _, err := unreachable.Verdict(c); err == nil {
+		t.Error("expected an unreachable endpoint to be an error")
+	}
+	if _, err := analyzers(t, `[{"analyzer": "http", "endpoint": "other"}]`)[0].Verdict(c); err == nil {
+		t.Error("expected an unconfigured endpoint to be an error")
+	}
+}
+
+func TestSpecLimits(t *testing.T) {
+	retries := 100
+	spec := Spec{Retries: &retries, Timeout: "1h"}
+	if spec.retries() != 5 || spec.timeout() != 2*time.Minute {
+		t.Errorf("expected retries and timeout to be limited, got %d and %s", spec.retries(), spec.timeout())
+	}
+	if (Spec{}).retries() != 2 || (Spec{}).timeout() != time.Minute {
+		t.Errorf("unexpected defaults %d and %s", (Spec{}).retries(), (Spec{}).timeout())
+	}
+}
+
+func TestMannWhitney(t *testing.T) {
+	worse := []float64{10, 11, 12, 13, 14}
+	stable := []float64{1, 2, 3, 4, 5}
+	if p := MannWhitney(worse, stable); p > 0.01 {
+		t.Errorf("expected a significant difference, got p=%g", p)
+	}
+	if p := MannWhitney(stable, worse); p < 0.99 {
+		t.Errorf("expected a better canary not to be worse, got p=%g", p)
+	}
+	if p := MannWhitney([]float64{1, 2, 3, 4}, []float64{1, 2, 3, 4}); p < 0.3 {
+		t.Errorf("expected identical samples not to differ, got p=%g", p)
+	}
+	if p := MannWhitney([]float64{1, 1, 1}, []float64{1, 1, 1}); p != 1 {
+		t.Errorf("expected constant samples not to differ, got p=%g", p)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	series := map[string]string{
+		"testing-canary": `[[1, "0.5"], [2, "0.6"], [3, "0.55"], [4, "0.7"], [5, "0.65"]]`,
+		"testing-1-a":    `[[1, "0.1"], [2, "0.12"], [3, "0.11"], [4, "0.09"], [5, "0.1"]]`,
+		"testing-1-b":    `[[1, "0.1"], [2, "0.13"], [3, "0.1"], [4, "0.12"], [5, "0.11"]]`,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query().Get("query")
+		pod := query[strings.Index(query, `pod="`)+5 : strings.LastIndex(query, `"`)]
+		values := series[pod]
+		if strings.HasPrefix(query, "memory") {
+			// the same for everyone
+			values = `[[1, "100"], [2, "100"], [3, "100"]]`
+		} else if strings.HasPrefix(query, "missing") {
+			values = `[]`
+		}
+		fmt.Fprintf(w, `{"status": "success", "data": {"resultType": "matrix", "result": [{"metric": {}, "values": %s}]}}`, values)
+	}))
+	defer srv.Close()
+	viper.Set("PROMETHEUS_URL", srv.URL)
+	defer viper.Set("PROMETHEUS_URL", "")
+
+	c := canary(0, time.Now())
+	c.Baseline = func() ([]apiv1.Pod, error) {
+		return []apiv1.Pod{
+			{ObjectMeta: metav1.ObjectMeta{Name: "testing-1-b"}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "testing-1-a"}},
+		}, nil
+	}
+
+	tests := []struct {
+		annotation string
+		verdict    Verdict
+	}{
+		{`[{"analyzer": "compare", "metrics": [{"name": "errors", "query": "errors{pod=\"{{.Pod}}\"}"}]}]`, Fail},
+		{`[{"analyzer": "compare", "metrics": [{"name": "throughput", "query": "errors{pod=\"{{.Pod}}\"}", "better": "higher"}]}]`, Pass},
+		{`[{"analyzer": "compare", "min": 50, "metrics": [{"name": "errors", "query": "errors{pod=\"{{.Pod}}\"}"}, {"name": "memory", "query": "memory{pod=\"{{.Pod}}\"}"}]}]`, Pass},
+		{`[{"analyzer": "compare", "metrics": [{"name": "missing", "query": "missing{pod=\"{{.Pod}}\"}"}]}]`, Fail},
+		{`[{"analyzer": "compare", "noData": "wait", "metrics": [{"name": "missing", "query": "missing{pod=\"{{.Pod}}\"}"}]}]`, Pending},
+		{`[{"analyzer": "compare", "noData": "pass", "metrics": [{"name": "missing", "query": "missing{pod=\"{{.Pod}}\"}"}]}]`, Pass},
+	}
+	for _, test := range tests {
+		result, err := analyzers(t, test.annotation)[0].Verdict(c)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.annotation, err)
+		} else if result.Verdict != test.verdict {
+			t.Errorf("%s: expected %s, got %v", test.annotation, test.verdict, result)
+		}
+	}
+
+	c.Baseline = func() ([]apiv1.Pod, error) { return nil, nil }
+	for annotation, verdict := range map[string]Verdict{
+		`[{"analyzer": "compare", "metrics": [{"name": "cpu"}]}]`:                   Fail,
+		`[{"analyzer": "compare", "noData": "pass", "metrics": [{"name": "cpu"}]}]`: Pass,
+	} {
+		if result, err := analyzers(t, annotation)[0].Verdict(c); err != nil || result.Verdict != verdict {
+			t.Errorf("%s without stable pods: expected %s, got %v, %v", annotation, verdict, result, err)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package analysis
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/spf13/viper"
+)
+
+// presets are the queries of metrics that don't set their own.  latency and
+// error-ratio expect the http_request_duration_seconds histogram and the
+// http_requests_total counter with a code label.
+var presets = map[string]string{
+	"cpu":     `sum(rate(container_cpu_usage_seconds_total{namespace="{{.Namespace}}",pod="{{.Pod}}",container="{{.Container}}"}[2m]))`,
+	"memory":  `sum(container_memory_working_set_bytes{namespace="{{.Namespace}}",pod="{{.Pod}}",container="{{.Container}}"})`,
+	"latency": `histogram_quantile(0.99, sum by (le) (rate(http_request_duration_seconds_bucket{namespace="{{.Namespace}}",pod="{{.Pod}}"}[2m])))`,
+	"error-ratio": `sum(rate(http_requests_total{namespace="{{.Namespace}}",pod="{{.Pod}}",code=~"5.."}[2m]))` +
+		` / sum(rate(http_requests_total{namespace="{{.Namespace}}",pod="{{.Pod}}"}[2m]))`,
+}
+
+// minSamples is the number of values each side needs for a metric to be
+// compared
+const minSamples = 3
+
+var scoreGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "canary_comparison_score",
+	Help: "The score of the last comparison between a canary and its stable pods, 100 if no metric was worse",
+}, []string{"deploymentconfig", "analyzer"})
+
+// Metric is compared by the compare analyzer.  Query is rendered once for
+// the canary and once for every stable pod, with {{.Pod}} set to the pod.
+type Metric struct {
+	Name  string `json:"name"`
+	Query string `json:"query,omitempty"`
+	// Better is "lower", the default, or "higher"
+	Better string `json:"better,omitempty"`
+	// Step is the resolution the metric is sampled at, 1m by default
+	Step string `json:"step,omitempty"`
+
+	query *template.Template
+}
+
+// Series is one series of a range query result
+type Series struct {
+	Metric map[string]string
+	Values []float64
+}
+
+// QueryRange runs a range query against the Prometheus at PROMETHEUS_URL
+func QueryRange(query string, start, end time.Time, step time.Duration) ([]Series, error) {
+	params := url.Values{}
+	params.Set("query", query)
+	params.Set("start", strconv.FormatInt(start.Unix(), 10))
+	params.Set("end", strconv.FormatInt(end.Unix(), 10))
+	params.Set("step", strconv.FormatFloat(step.Seconds(), 'f', -1, 64))
+
+	var resp queryResponse
+	if err := getJSON(viper.GetString("PROMETHEUS_URL"), "/api/v1/query_range", params, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Status != "success" {
+		return nil, fmt.Errorf("query failed: %s", resp.Error)
+	}
+	if resp.Data.ResultType != "matrix" {
+		return nil, fmt.Errorf("unsupported result type %q", resp.Data.ResultType)
+	}
+
+	var matrix []struct {
+		Metric map[string]string `json:"metric"`
+		Values [][]interface{}   `json:"values"`
+	}
+	if err := json.Unmarshal(resp.Data.Result, &matrix); err != nil {
+		return nil, err
+	}
+	series := make([]Series, 0, len(matrix))
+	for _, m := range matrix {
+		s := Series{Metric: m.Metric}
+		for _, pair := range m.Values {
+			v, err := sampleValue(pair)
+			if err != nil {
+				return nil, err
+			}
+			// NaN from empty ratios can't be ranked
+			if v == v {
+				s.Values = append(s.Values, v)
+			}
+		}
+		series = append(series, s)
+	}
+	return series, nil
+}
+
+// compare tests whether the canary is significantly worse than a sample of
+// the stable pods for every metric once the canary finished incubating.  The
+// score is the percentage of compared metrics that weren't worse, the canary
+// fails if it is below Min, by default if any metric was worse.  Without
+// stable pods or without enough values for any metric the canary fails
+// unless NoData says otherwise.
+type compare struct {
+	spec Spec
+}
+
+func newCompare(spec Spec) (*compare, error) {
+	if len(spec.Metrics) == 0 {
+		return nil, fmt.Errorf("metrics are required")
+	}
+	if spec.Alpha < 0 || spec.Alpha >= 1 {
+		return nil, fmt.Errorf("alpha has to be between 0 and 1")
+	}
+	if err := spec.validNoData(); err != nil {
+		return nil, err
+	}
+	for idx := range spec.Metrics {
+		metric := &spec.Metrics[idx]
+		query := metric.Query
+		if query == "" {
+			query = presets[metric.Name]
+		}
+		t, err := template.New(metric.Name).Parse(query)
+		if err != nil || query == "" {
+			return nil, fmt.Errorf("metric %s has no valid query: %v", metric.Name, err)
+		}
+		metric.query = t
+		if metric.Better != "" && metric.Better != "lower" && metric.Better != "higher" {
+			return nil, fmt.Errorf("metric %s: better has to be lower or higher", metric.Name)
+		}
+	}
+	return &compare{spec: spec}, nil
+}
+
+func (c *compare) Start(canary *Canary) error {
+	return nil
+}
+
+func (c *compare) Evaluate(canary *Canary) (Result, error) {
+	return Result{Verdict: Pending}, nil
+}
+
+func (c *compare) Verdict(canary *Canary) (Result, error) {
+	if canary.Baseline == nil {
+		return Result{}, fmt.Errorf("no stable pods to compare with")
+	}
+	pods, err := canary.Baseline()
+	if err != nil {
+		return Result{}, err
+	}
+	names := make([]string, 0, len(pods))
+	for _, pod := range pods {
+		names = append(names, pod.GetName())
+	}
+	sort.Strings(names)
+	sample := c.spec.Sample
+	if sample <= 0 {
+		sample = 3
+	}
+	if len(names) > sample {
+		names = names[:sample]
+	}
+	if len(names) == 0 {
+		return c.spec.missing("no stable pods to compare with"), nil
+	}
+
+	alpha := c.spec.Alpha
+	if alpha == 0 {
+		alpha = 0.05
+	}
+	start := canary.Pod.GetCreationTimestamp().Time
+	end := time.Now()
+
+	worse := []string{}
+	compared := 0
+	for _, metric := range c.spec.Metrics {
+		step, err := time.ParseDuration(metric.Step)
+		if err != nil || step <= 0 {
+			step = time.Minute
+		}
+
+		x, err := c.values(metric, data(canary), start, end, step)
+		if err != nil {
+			return Result{}, err
+		}
+		var y []float64
+		for _, name := range names {
+			d := data(canary)
+			d.Pod = name
+			values, err := c.values(metric, d, start, end, step)
+			if err != nil {
+				return Result{}, err
+			}
+			y = append(y, values...)
+		}
+		if len(x) < minSamples || len(y) < minSamples {
+			continue
+		}
+		compared++
+
+		if metric.Better == "higher" {
+			x, y = y, x
+		}
+		if p := MannWhitney(x, y); p < alpha {
+			worse = append(worse, fmt.Sprintf("%s (p=%.3g)", metric.Name, p))
+		}
+	}
+
+	if compared == 0 {
+		return c.spec.missing("not enough data to compare"), nil
+	}
+	score := 100 * float64(compared-len(worse)) / float64(compared)
+	scoreGauge.With(prometheus.Labels{"deploymentconfig": canary.DeploymentConfig.GetName(), "analyzer": c.spec.name()}).Set(score)
+
+	reason := fmt.Sprintf("score %.0f", score)
+	if len(worse) > 0 {
+		reason = fmt.Sprintf("%s, worse than stable: %s", reason, strings.Join(worse, ", "))
+	}
+	min := 100.0
+	if c.spec.Min != nil {
+		min = *c.spec.Min
+	}
+	if score < min {
+		return Result{Verdict: Fail, Reason: reason}, nil
+	}
+	return Result{Verdict: Pass, Reason: reason}, nil
+}
+
+// values returns all values of the metric's query for one pod
+func (c *compare) values(metric Metric, d templateData, start, end time.Time, step time.Duration) ([]float64, error) {
+	var query strings.Builder
+	if err := metric.query.Execute(&query, d); err != nil {
+		return nil, err
+	}
+	series, err := QueryRange(query.String(), start, end, step)
+	if err != nil {
+		return nil, fmt.Errorf("metric %s: %v", metric.Name, err)
+	}
+	var values []float64
+	for _, s := range series {
+		values = append(values, s.Values...)
+	}
+	return values, nil
+}
@@ -0,0 +1,71 @@
+package analysis
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+func init() {
+	viper.SetDefault("ANALYSIS_EXEC_DIR", "/etc/miniop/analyzers")
+}
+
+// execAnalyzer runs an executable from ANALYSIS_EXEC_DIR once the canary
+// finished incubating.  Deploymentconfigs can only name executables that
+// were installed there, not run arbitrary commands.  Exiting 0 passes the
+// canary, any other exit code fails it with the last line of output as the
+// reason.
+type execAnalyzer struct {
+	spec Spec
+}
+
+func newExec(spec Spec) (*execAnalyzer, error) {
+	if spec.Command == "" || strings.ContainsAny(spec.Command, `/\`) || strings.HasPrefix(spec.Command, ".") {
+		return nil, fmt.Errorf("invalid command %q", spec.Command)
+	}
+	return &execAnalyzer{spec: spec}, nil
+}
+
+func (e *execAnalyzer) Start(c *Canary) error {
+	return nil
+}
+
+func (e *execAnalyzer) Evaluate(c *Canary) (Result, error) {
+	return Result{Verdict: Pending}, nil
+}
+
+func (e *execAnalyzer) Verdict(c *Canary) (Result, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), e.spec.timeout())
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, filepath.Join(viper.GetString("ANALYSIS_EXEC_DIR"), e.spec.Command), e.spec.Args...)
+	d := data(c)
+	cmd.Env = append(os.Environ(),
+		"CANARY_POD="+d.Pod,
+		"CANARY_DEPLOYMENTCONFIG="+d.DeploymentConfig,
+		"CANARY_NAMESPACE="+d.Namespace,
+		"CANARY_CONTAINER="+d.Container,
+		"CANARY_IMAGE="+d.Image,
+	)
+	output, err := cmd.CombinedOutput()
+	reason := lastLine(string(output))
+
+	if ctx.Err() != nil {
+		return Result{}, fmt.Errorf("%s timed out after %s", e.spec.Command, e.spec.timeout())
+	} else if _, exited := err.(*exec.ExitError); exited {
+		return Result{Verdict: Fail, Reason: reason}, nil
+	} else if err != nil {
+		return Result{}, err
+	}
+	return Result{Verdict: Pass, Reason: reason}, nil
+}
+
+func lastLine(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
@@ -0,0 +1,70 @@
+package analysis
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"text/template"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func init() {
+	viper.SetDefault("ALERTMANAGER_URL", "")
+	viper.SetDefault("PROMETHEUS_URL", "")
+}
+
+var httpClient = &http.Client{Timeout: time.Minute}
+
+// templateData is available in queries and matchers as {{.Pod}} etc.
+type templateData struct {
+	Pod              string
+	DeploymentConfig string
+	Namespace        string
+	Container        string
+	Image            string
+}
+
+func data(c *Canary) templateData {
+	return templateData{
+		Pod:              c.Pod.GetName(),
+		DeploymentConfig: c.DeploymentConfig.GetName(),
+		Namespace:        c.Pod.GetNamespace(),
+		Container:        c.Container,
+		Image:            c.Image,
+	}
+}
+
+func render(t *template.Template, c *Canary) (string, error) {
+	var out bytes.Buffer
+	if err := t.Execute(&out, data(c)); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// getJSON decodes the response to a GET of base joined with path and query
+func getJSON(base, path string, query url.Values, into interface{}) error {
+	if base == "" {
+		return fmt.Errorf("no URL configured for %s", path)
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return err
+	}
+	u.Path = u.Path + path
+	u.RawQuery = query.Encode()
+
+	resp, err := httpClient.Get(u.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", u.Path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(into)
+}
@@ -0,0 +1,170 @@
+package analysis
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func init() {
+	viper.SetDefault("ANALYSIS_ENDPOINTS", "")
+}
+
+// endpoint returns the URL of the named endpoint in ANALYSIS_ENDPOINTS, a
+// comma separated list of name=url
+func endpoint(name string) (string, bool) {
+	for _, entry := range strings.Split(viper.GetString("ANALYSIS_ENDPOINTS"), ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(parts) == 2 && parts[0] == name {
+			return parts[1], true
+		}
+	}
+	return "", false
+}
+
+// httpAnalyzer posts the canary to an endpoint from ANALYSIS_ENDPOINTS while
+// it incubates and once it finished incubating, and gates the canary on the
+// answer.  Like executables, deploymentconfigs can only name endpoints that
+// were configured.
+type httpAnalyzer struct {
+	spec Spec
+}
+
+// callout is posted to the endpoint.  Final is set once the canary finished
+// incubating, the answer is the verdict then.
+type callout struct {
+	DeploymentConfig string    `json:"deploymentconfig"`
+	Namespace        string    `json:"namespace"`
+	Pod              string    `json:"pod"`
+	PodIP            string    `json:"podIP"`
+	Image            string    `json:"image"`
+	Started          time.Time `json:"started"`
+	Deadline         time.Time `json:"deadline"`
+	Final            bool      `json:"final"`
+}
+
+// answer is the response of the endpoint
+type answer struct {
+	// Verdict is pass, fail or inconclusive
+	Verdict string `json:"verdict"`
+	Message string `json:"message"`
+	// Reason is accepted in place of Message
+	Reason string `json:"reason"`
+}
+
+func newHTTP(spec Spec) (*httpAnalyzer, error) {
+	if spec.Endpoint == "" {
+		return nil, fmt.Errorf("endpoint is required")
+	}
+	switch spec.Inconclusive {
+	case "", "wait", "pass", "fail":
+	default:
+		return nil, fmt.Errorf("inconclusive must be wait, pass or fail")
+	}
+	return &httpAnalyzer{spec: spec}, nil
+}
+
+func (h *httpAnalyzer) polled() {}
+
+func (h *httpAnalyzer) Start(c *Canary) error {
+	return nil
+}
+
+func (h *httpAnalyzer) Evaluate(c *Canary) (Result, error) {
+	return h.call(c, false)
+}
+
+func (h *httpAnalyzer) Verdict(c *Canary) (Result, error) {
+	return h.call(c, true)
+}
+
+// call posts the canary, failed calls worth retrying are retried by Analyze
+func (h *httpAnalyzer) call(c *Canary, final bool) (Result, error) {
+	target, ok := endpoint(h.spec.Endpoint)
+	if !ok {
+		return Result{}, fmt.Errorf("endpoint %s is not configured", h.spec.Endpoint)
+	}
+
+	started := c.Pod.GetCreationTimestamp().Time
+	if c.Pod.Status.StartTime != nil {
+		started = c.Pod.Status.StartTime.Time
+	}
+	d := data(c)
+	body, err := json.Marshal(callout{
+		DeploymentConfig: d.DeploymentConfig,
+		Namespace:        d.Namespace,
+		Pod:              d.Pod,
+		PodIP:            c.Pod.Status.PodIP,
+		Image:            d.Image,
+		Started:          started,
+		Deadline:         c.Deadline,
+		Final:            final,
+	})
+	if err != nil {
+		return Result{}, err
+	}
+
+	var a answer
+	if retry, err := h.post(target, body, &a); retry {
+		return Result{}, &retryable{err: err, retries: h.spec.retries()}
+	} else if err != nil {
+		return Result{}, err
+	}
+	return h.result(a)
+}
+
+// post sends one call and returns whether a failure is worth retrying
+func (h *httpAnalyzer) post(target string, body []byte, into *answer) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.spec.timeout())
+	defer cancel()
+	req, err := http.NewRequest("POST", target, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		return true, fmt.Errorf("endpoint %s answered %s", h.spec.Endpoint, resp.Status)
+	} else if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("endpoint %s answered %s", h.spec.Endpoint, resp.Status)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(into); err != nil {
+		return false, fmt.Errorf("invalid response from %s: %v", h.spec.Endpoint, err)
+	}
+	return false, nil
+}
+
+func (h *httpAnalyzer) result(a answer) (Result, error) {
+	message := a.Message
+	if message == "" {
+		message = a.Reason
+	}
+
+	switch a.Verdict {
+	case "pass":
+		return Result{Verdict: Pass, Reason: message}, nil
+	case "fail":
+		return Result{Verdict: Fail, Reason: message}, nil
+	case "inconclusive", "pending":
+		reason := strings.TrimSuffix(fmt.Sprintf("inconclusive: %s", message), ": ")
+		switch h.spec.Inconclusive {
+		case "pass":
+			return Result{Verdict: Pass, Reason: reason}, nil
+		case "fail":
+			return Result{Verdict: Fail, Reason: reason}, nil
+		}
+		return Result{Verdict: Pending, Reason: reason}, nil
+	}
+	return Result{}, fmt.Errorf("endpoint %s returned unknown verdict %q", h.spec.Endpoint, a.Verdict)
+}
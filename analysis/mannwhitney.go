@@ -0,0 +1,58 @@
+package analysis
+
+import (
+	"math"
+	"sort"
+)
+
+// MannWhitney returns the p-value of the one-sided Mann-Whitney U test that
+// values in x tend to be greater than values in y.  It uses the normal
+// approximation with tie and continuity correction, which is reasonable from
+// a handful of values per sample on.
+func MannWhitney(x, y []float64) float64 {
+	n1, n2 := float64(len(x)), float64(len(y))
+	if n1 == 0 || n2 == 0 {
+		return 1
+	}
+
+	type value struct {
+		v      float64
+		sample int
+	}
+	values := make([]value, 0, len(x)+len(y))
+	for _, v := range x {
+		values = append(values, value{v, 0})
+	}
+	for _, v := range y {
+		values = append(values, value{v, 1})
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].v < values[j].v })
+
+	// ties get the average of their ranks
+	var rankSum, ties float64
+	for i := 0; i < len(values); {
+		j := i
+		for j < len(values) && values[j].v == values[i].v {
+			j++
+		}
+		rank := float64(i+j+1) / 2
+		for k := i; k < j; k++ {
+			if values[k].sample == 0 {
+				rankSum += rank
+			}
+		}
+		t := float64(j - i)
+		ties += t*t*t - t
+		i = j
+	}
+
+	n := n1 + n2
+	u := rankSum - n1*(n1+1)/2
+	mean := n1 * n2 / 2
+	sigma := math.Sqrt(n1 * n2 / 12 * ((n + 1) - ties/(n*(n-1))))
+	if sigma == 0 {
+		return 1
+	}
+	z := (u - mean - 0.5) / sigma
+	return 0.5 * math.Erfc(z/math.Sqrt2)
+}
@@ -0,0 +1,78 @@
+package analysis
+
+import (
+	"fmt"
+
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// restarts fails canaries whose container restarted more than Max times,
+// by default at all
+type restarts struct {
+	spec Spec
+}
+
+func (r restarts) Start(c *Canary) error {
+	return nil
+}
+
+func (r restarts) Evaluate(c *Canary) (Result, error) {
+	return r.Verdict(c)
+}
+
+func (r restarts) Verdict(c *Canary) (Result, error) {
+	for _, status := range c.Pod.Status.ContainerStatuses {
+		if status.Name != c.Container {
+			continue
+		}
+		if max := r.spec.max(0); float64(status.RestartCount) > max {
+			return Result{Verdict: Fail, Reason: fmt.Sprintf("%d restarts", status.RestartCount)}, nil
+		}
+		return Result{Verdict: Pass, Reason: fmt.Sprintf("%d restarts", status.RestartCount)}, nil
+	}
+	return Result{Verdict: Pending, Reason: "container has not started"}, nil
+}
+
+// waitingFailures are container states that won't resolve on their own
+var waitingFailures = map[string]bool{
+	"CrashLoopBackOff":           true,
+	"ImagePullBackOff":           true,
+	"ErrImagePull":               true,
+	"CreateContainerConfigError": true,
+	"InvalidImageName":           true,
+}
+
+// conditions fails canaries that aren't ready once they finished incubating,
+// or whose container is stuck waiting
+type conditions struct {
+	spec Spec
+}
+
+func (p conditions) Start(c *Canary) error {
+	return nil
+}
+
+func (p conditions) Evaluate(c *Canary) (Result, error) {
+	for _, status := range c.Pod.Status.ContainerStatuses {
+		if status.Name == c.Container && status.State.Waiting != nil && waitingFailures[status.State.Waiting.Reason] {
+			return Result{Verdict: Fail, Reason: fmt.Sprintf("container is waiting: %s", status.State.Waiting.Reason)}, nil
+		}
+	}
+	return Result{Verdict: Pending}, nil
+}
+
+func (p conditions) Verdict(c *Canary) (Result, error) {
+	if result, err := p.Evaluate(c); err != nil || result.Verdict == Fail {
+		return result, err
+	}
+	for _, condition := range c.Pod.Status.Conditions {
+		if condition.Type != apiv1.PodReady {
+			continue
+		}
+		if condition.Status == apiv1.ConditionTrue {
+			return Result{Verdict: Pass, Reason: "pod is ready"}, nil
+		}
+		return Result{Verdict: Fail, Reason: fmt.Sprintf("pod is not ready: %s", condition.Reason)}, nil
+	}
+	return Result{Verdict: Fail, Reason: "pod has no ready condition"}, nil
+}
@@ -0,0 +1,131 @@
+package analysis
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Sample is one series of a query result
+type Sample struct {
+	Metric map[string]string
+	Value  float64
+}
+
+type queryResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+	Data   struct {
+		ResultType string          `json:"resultType"`
+		Result     json.RawMessage `json:"result"`
+	} `json:"data"`
+}
+
+// Query runs an instant query against the Prometheus at PROMETHEUS_URL.
+// Scalar results are returned as a single sample without labels.
+func Query(query string, at time.Time) ([]Sample, error) {
+	params := url.Values{}
+	params.Set("query", query)
+	params.Set("time", strconv.FormatInt(at.Unix(), 10))
+
+	var resp queryResponse
+	if err := getJSON(viper.GetString("PROMETHEUS_URL"), "/api/v1/query", params, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Status != "success" {
+		return nil, fmt.Errorf("query failed: %s", resp.Error)
+	}
+
+	switch resp.Data.ResultType {
+	case "scalar":
+		var value []interface{}
+		if err := json.Unmarshal(resp.Data.Result, &value); err != nil {
+			return nil, err
+		}
+		v, err := sampleValue(value)
+		if err != nil {
+			return nil, err
+		}
+		return []Sample{{Value: v}}, nil
+	case "vector":
+		var vector []struct {
+			Metric map[string]string `json:"metric"`
+			Value  []interface{}     `json:"value"`
+		}
+		if err := json.Unmarshal(resp.Data.Result, &vector); err != nil {
+			return nil, err
+		}
+		samples := make([]Sample, 0, len(vector))
+		for _, series := range vector {
+			v, err := sampleValue(series.Value)
+			if err != nil {
+				return nil, err
+			}
+			samples = append(samples, Sample{Metric: series.Metric, Value: v})
+		}
+		return samples, nil
+	}
+	return nil, fmt.Errorf("unsupported result type %q", resp.Data.ResultType)
+}
+
+// sampleValue parses a [timestamp, "value"] pair
+func sampleValue(pair []interface{}) (float64, error) {
+	if len(pair) != 2 {
+		return 0, fmt.Errorf("invalid sample %v", pair)
+	}
+	s, ok := pair[1].(string)
+	if !ok {
+		return 0, fmt.Errorf("invalid sample value %v", pair[1])
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// promql fails canaries for which Query returns a value outside of Min and
+// Max once they finished incubating.  A query without results fails unless
+// NoData says otherwise.
+type promql struct {
+	query *template.Template
+	spec  Spec
+}
+
+func newPromQL(spec Spec) (*promql, error) {
+	if spec.Max == nil && spec.Min == nil {
+		return nil, fmt.Errorf("max or min is required")
+	}
+	if err := spec.validNoData(); err != nil {
+		return nil, err
+	}
+	query, err := template.New("query").Parse(spec.Query)
+	if err != nil || spec.Query == "" {
+		return nil, fmt.Errorf("invalid query: %v", err)
+	}
+	return &promql{query: query, spec: spec}, nil
+}
+
+func (p *promql) Start(c *Canary) error {
+	return nil
+}
+
+func (p *promql) Evaluate(c *Canary) (Result, error) {
+	return Result{Verdict: Pending}, nil
+}
+
+func (p *promql) Verdict(c *Canary) (Result, error) {
+	query, err := render(p.query, c)
+	if err != nil {
+		return Result{}, err
+	}
+	samples, err := Query(query, time.Now())
+	if err != nil {
+		return Result{}, err
+	}
+	if len(samples) == 0 {
+		return p.spec.missing("no data"), nil
+	}
+	return p.spec.bounds("value", samples[0].Value), nil
+}
@@ -0,0 +1,87 @@
+// Package approval lets deploymentconfigs require a manual approval before
+// a canary is promoted.
+package approval
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	v1 "github.com/openshift/api/apps/v1"
+	appsv1 "github.com/openshift/client-go/apps/clientset/versioned/typed/apps/v1"
+	"github.com/redhatinsights/miniop/auth"
+	"github.com/redhatinsights/miniop/client"
+	l "github.com/redhatinsights/miniop/logger"
+	"go.uber.org/zap"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func init() {
+	l.InitLogger()
+}
+
+const (
+	// PhaseAwaiting is stored in the canary-phase annotation while a canary
+	// that finished incubating waits for its approval
+	PhaseAwaiting = "awaiting-approval"
+
+	// ApprovedBy records who approved the canary that is awaiting approval
+	ApprovedBy = "canary-approved-by"
+
+	// AwaitingSince records when the canary started waiting for approval
+	AwaitingSince = "canary-awaiting-since"
+)
+
+// Required returns true if canaries of dc have to be approved before they
+// are promoted
+func Required(dc *v1.DeploymentConfig) bool {
+	return dc.Annotations["canary-approval"] == "required"
+}
+
+var errNotAwaiting = errors.New("no canary is awaiting approval")
+
+// NewHandler returns a handler approving the canary of the deploymentconfig
+// named in the URL on behalf of the authenticated user, see auth.Middleware.
+func NewHandler(apps appsv1.AppsV1Interface) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := chi.URLParam(r, auth.DeploymentConfigParam)
+		user := auth.User(r)
+		if user == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		dcs := apps.DeploymentConfigs(client.Namespace)
+		dc, err := dcs.Get(name, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			http.Error(w, fmt.Sprintf("deploymentconfig %s not found", name), http.StatusNotFound)
+			return
+		} else if err != nil {
+			l.Log.Error("failed to fetch deploymentconfig", zap.Error(err), zap.String("deploymentconfig", name))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		_, err = client.UpdateDeploymentConfig(dcs, dc, func(dc *v1.DeploymentConfig) error {
+			if dc.Annotations["canary-phase"] != PhaseAwaiting {
+				return errNotAwaiting
+			}
+			dc.Annotations[ApprovedBy] = user
+			return nil
+		})
+		if err == errNotAwaiting {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			l.Log.Error("failed to approve canary", zap.Error(err), zap.String("deploymentconfig", name))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		l.Log.Info(fmt.Sprintf("canary for %s approved by %s", name, user),
+			zap.String("deploymentconfig", name), zap.String("user", user))
+		w.WriteHeader(http.StatusOK)
+	}
+}
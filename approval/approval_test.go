@@ -0,0 +1,71 @@
+package approval
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi"
+	v1 "github.com/openshift/api/apps/v1"
+	"github.com/redhatinsights/miniop/auth"
+	"github.com/redhatinsights/miniop/client/fake"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func deploymentConfig(phase string) *v1.DeploymentConfig {
+	return &v1.DeploymentConfig{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "testing",
+			Annotations: map[string]string{
+				"canary-approval": "required",
+				"canary-phase":    phase,
+			},
+		},
+	}
+}
+
+func approve(apps *fake.Apps, name, user string) int {
+	r := chi.NewRouter()
+	r.Post("/approve/{deploymentconfig}", NewHandler(apps))
+
+	req := httptest.NewRequest("POST", "/approve/"+name, nil)
+	if user != "" {
+		req = auth.WithUser(req, user)
+	}
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestApprove(t *testing.T) {
+	apps := fake.NewApps(deploymentConfig(PhaseAwaiting))
+
+	if code := approve(apps, "testing", "alice"); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if approver := apps.Stored("testing").Annotations[ApprovedBy]; approver != "alice" {
+		t.Errorf("approver was not recorded, got %q", approver)
+	}
+}
+
+func TestApproveNotAwaiting(t *testing.T) {
+	apps := fake.NewApps(deploymentConfig(""))
+
+	if code := approve(apps, "testing", "alice"); code != http.StatusConflict {
+		t.Errorf("expected 409, got %d", code)
+	}
+	if _, ok := apps.Stored("testing").Annotations[ApprovedBy]; ok {
+		t.Error("a canary that isn't awaiting approval was approved")
+	}
+}
+
+func TestApproveUnknown(t *testing.T) {
+	apps := fake.NewApps(deploymentConfig(PhaseAwaiting))
+
+	if code := approve(apps, "other", "alice"); code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", code)
+	}
+	if code := approve(apps, "testing", ""); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a user, got %d", code)
+	}
+}
@@ -0,0 +1,123 @@
+// Package auth protects miniop's HTTP API with the cluster's own
+// authentication and authorization.  Callers send a bearer token, which is
+// checked with a TokenReview, and need the permission the endpoint asks for,
+// checked with a SubjectAccessReview.
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/redhatinsights/miniop/client"
+	l "github.com/redhatinsights/miniop/logger"
+	"go.uber.org/zap"
+	authnv1 "k8s.io/api/authentication/v1"
+	authzv1 "k8s.io/api/authorization/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+func init() {
+	l.InitLogger()
+}
+
+type contextKey struct{}
+
+// DeploymentConfigParam is the URL parameter naming the deploymentconfig a
+// request acts on
+const DeploymentConfigParam = "deploymentconfig"
+
+// Middleware rejects requests whose user isn't allowed to verb the
+// deploymentconfig named by DeploymentConfigParam.  The user is passed on to
+// the handler, see User.
+func Middleware(kube kubernetes.Interface, verb string) func(http.Handler) http.Handler {
+	return RequireAccess(kube, func(r *http.Request) authzv1.ResourceAttributes {
+		return authzv1.ResourceAttributes{
+			Namespace: client.Namespace,
+			Verb:      verb,
+			Group:     "apps.openshift.io",
+			Resource:  "deploymentconfigs",
+			Name:      chi.URLParam(r, DeploymentConfigParam),
+		}
+	})
+}
+
+// RequireAccess rejects requests whose user doesn't have access to the
+// resource described by attributes.  The user is passed on to the handler,
+// see User.
+func RequireAccess(kube kubernetes.Interface, attributes func(r *http.Request) authzv1.ResourceAttributes) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if token == "" || token == r.Header.Get("Authorization") {
+				http.Error(w, "bearer token required", http.StatusUnauthorized)
+				return
+			}
+
+			user, err := authenticate(kube, token)
+			if err != nil {
+				l.Log.Info("request could not be authenticated", zap.Error(err))
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			if err := authorize(kube, user, attributes(r)); err != nil {
+				l.Log.Info("request was not authorized", zap.Error(err), zap.String("user", user.Username))
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, WithUser(r, user.Username))
+		})
+	}
+}
+
+// WithUser returns a copy of r made on behalf of user
+func WithUser(r *http.Request, user string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), contextKey{}, user))
+}
+
+// User returns the authenticated user of a request that passed Middleware
+func User(r *http.Request) string {
+	user, _ := r.Context().Value(contextKey{}).(string)
+	return user
+}
+
+func authenticate(kube kubernetes.Interface, token string) (authnv1.UserInfo, error) {
+	review, err := kube.AuthenticationV1().TokenReviews().Create(&authnv1.TokenReview{
+		Spec: authnv1.TokenReviewSpec{Token: token},
+	})
+	if err != nil {
+		return authnv1.UserInfo{}, fmt.Errorf("token review failed: %v", err)
+	}
+	if !review.Status.Authenticated {
+		return authnv1.UserInfo{}, fmt.Errorf("token was not accepted: %s", review.Status.Error)
+	}
+	return review.Status.User, nil
+}
+
+func authorize(kube kubernetes.Interface, user authnv1.UserInfo, attrs authzv1.ResourceAttributes) error {
+	extra := make(map[string]authzv1.ExtraValue, len(user.Extra))
+	for k, v := range user.Extra {
+		extra[k] = authzv1.ExtraValue(v)
+	}
+
+	review, err := kube.AuthorizationV1().SubjectAccessReviews().Create(&authzv1.SubjectAccessReview{
+		Spec: authzv1.SubjectAccessReviewSpec{
+			User:               user.Username,
+			UID:                user.UID,
+			Groups:             user.Groups,
+			Extra:              extra,
+			ResourceAttributes: &attrs,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("subject access review failed: %v", err)
+	}
+	if !review.Status.Allowed {
+		return fmt.Errorf("%s may not %s %s %s: %s", user.Username, attrs.Verb, attrs.Resource, attrs.Name, review.Status.Reason)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi"
+	authnv1 "k8s.io/api/authentication/v1"
+	authzv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// cluster accepts the token "good" for alice, who may only update the
+// deploymentconfig "mine"
+func cluster() *kubefake.Clientset {
+	kube := kubefake.NewSimpleClientset()
+	kube.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authnv1.TokenReview)
+		if review.Spec.Token == "good" {
+			review.Status.Authenticated = true
+			review.Status.User = authnv1.UserInfo{Username: "alice"}
+		}
+		return true, review, nil
+	})
+	kube.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authzv1.SubjectAccessReview)
+		attrs := review.Spec.ResourceAttributes
+		review.Status.Allowed = review.Spec.User == "alice" && attrs.Verb == "update" && attrs.Name == "mine"
+		return true, review, nil
+	})
+	return kube
+}
+
+func serve(token, dc string) (*httptest.ResponseRecorder, string) {
+	var user string
+	r := chi.NewRouter()
+	r.With(Middleware(cluster(), "update")).Post("/approve/{deploymentconfig}", func(w http.ResponseWriter, r *http.Request) {
+		user = User(r)
+	})
+
+	req := httptest.NewRequest("POST", "/approve/"+dc, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec, user
+}
+
+func TestMiddleware(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+		dc    string
+		code  int
+		user  string
+	}{
+		{"no token", "", "mine", http.StatusUnauthorized, ""},
+		{"bad token", "bad", "mine", http.StatusUnauthorized, ""},
+		{"not allowed", "good", "theirs", http.StatusForbidden, ""},
+		{"allowed", "good", "mine", http.StatusOK, "alice"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec, user := serve(test.token, test.dc)
+			if rec.Code != test.code {
+				t.Errorf("expected %d, got %d", test.code, rec.Code)
+			}
+			if user != test.user {
+				t.Errorf("expected user %q, got %q", test.user, user)
+			}
+		})
+	}
+}
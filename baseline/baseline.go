@@ -0,0 +1,249 @@
+// Package baseline checks the health of the stable pods of a deploymentconfig.
+// A canary compared with a baseline that is alerting or not ready tells
+// nothing, so canaries are only started and promoted while the baseline is
+// healthy, and their clock is paused while it isn't.
+package baseline
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	v1 "github.com/openshift/api/apps/v1"
+	appsv1 "github.com/openshift/client-go/apps/clientset/versioned/typed/apps/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redhatinsights/miniop/analysis"
+	"github.com/redhatinsights/miniop/client"
+	ctl "github.com/redhatinsights/miniop/controller"
+	l "github.com/redhatinsights/miniop/logger"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+func init() {
+	l.InitLogger()
+	viper.SetDefault("BASELINE_MATCHERS", `{"deploymentconfig": "{{.DeploymentConfig}}"}`)
+}
+
+const (
+	// CheckAnnotation turns the check off for a deploymentconfig when set to
+	// "false"
+	CheckAnnotation = "canary-baseline-check"
+	// MatchersAnnotation overrides BASELINE_MATCHERS for a deploymentconfig
+	MatchersAnnotation = "canary-baseline-matchers"
+	// UnhealthyAnnotation tells why the canary of a deploymentconfig is held
+	// back
+	UnhealthyAnnotation = "canary-baseline-unhealthy"
+
+	// PausedAnnotation is the time the canary clock was paused for so far
+	PausedAnnotation = "canary-paused"
+	// PausedSinceAnnotation is when the canary clock was paused
+	PausedSinceAnnotation = "canary-paused-since"
+	// PausedReasonAnnotation tells why the canary clock is paused
+	PausedReasonAnnotation = "canary-paused-reason"
+)
+
+var unhealthyGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "canary_baseline_unhealthy",
+	Help: "Whether the stable pods of a deploymentconfig are unhealthy",
+}, []string{"deploymentconfig"})
+
+// Pods returns the running stable pods of dc from the stable pod cache
+func Pods(stablePods corelisters.PodLister, dc *v1.DeploymentConfig) ([]apiv1.Pod, error) {
+	selector, err := labels.Parse(fmt.Sprintf("deploymentconfig=%s,canary!=true", dc.GetName()))
+	if err != nil {
+		return nil, err
+	}
+	list, err := stablePods.Pods(client.Namespace).List(selector)
+	if err != nil {
+		return nil, err
+	}
+	pods := make([]apiv1.Pod, 0, len(list))
+	for _, pod := range list {
+		if pod.Status.Phase == apiv1.PodRunning && pod.DeletionTimestamp == nil {
+			pods = append(pods, *pod)
+		}
+	}
+	return pods, nil
+}
+
+// Unhealthy returns why the baseline of dc is unhealthy, or an empty string.
+// The baseline is unhealthy while one of its pods isn't ready or an alert
+// matching the baseline matchers fires in ALERTMANAGER_URL.  Alerts about the
+// canary pod itself are left to its analysis.
+func Unhealthy(stablePods corelisters.PodLister, dc *v1.DeploymentConfig, canaryPod string) (string, error) {
+	if dc.Annotations[CheckAnnotation] == "false" {
+		return "", nil
+	}
+
+	pods, err := Pods(stablePods, dc)
+	if err != nil {
+		return "", fmt.Errorf("failed to list stable pods: %v", err)
+	}
+	var unready []string
+	for _, pod := range pods {
+		if !ready(&pod) {
+			unready = append(unready, pod.GetName())
+		}
+	}
+	if len(unready) > 0 {
+		sort.Strings(unready)
+		return fmt.Sprintf("stable pods not ready: %s", strings.Join(unready, ", ")), nil
+	}
+
+	if viper.GetString("ALERTMANAGER_URL") == "" {
+		return "", nil
+	}
+	matchers, err := alertMatchers(dc)
+	if err != nil {
+		return "", err
+	}
+	alerts, err := analysis.Alerts(matchers)
+	if err != nil {
+		return "", fmt.Errorf("failed to query alerts: %v", err)
+	}
+	var names []string
+	for _, alert := range alerts {
+		if canaryPod != "" && analysis.Attribute(alert, canaryPod, analysis.DefaultPodLabels) == analysis.CanaryAlert {
+			continue
+		}
+		names = append(names, alert.Labels["alertname"])
+	}
+	if len(names) > 0 {
+		sort.Strings(names)
+		return fmt.Sprintf("alerts firing: %s", strings.Join(names, ", ")), nil
+	}
+	return "", nil
+}
+
+func ready(pod *apiv1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == apiv1.PodReady {
+			return condition.Status == apiv1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// alertMatchers renders the baseline matchers of dc
+func alertMatchers(dc *v1.DeploymentConfig) (map[string]string, error) {
+	annotation, ok := dc.Annotations[MatchersAnnotation]
+	if !ok {
+		annotation = viper.GetString("BASELINE_MATCHERS")
+	}
+	var templates map[string]string
+	if err := json.Unmarshal([]byte(annotation), &templates); err != nil {
+		return nil, fmt.Errorf("invalid baseline matchers: %v", err)
+	}
+
+	data := struct {
+		DeploymentConfig, Namespace string
+	}{dc.GetName(), client.Namespace}
+	matchers := make(map[string]string, len(templates))
+	for name, value := range templates {
+		t, err := template.New(name).Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid baseline matcher %s: %v", name, err)
+		}
+		var rendered bytes.Buffer
+		if err := t.Execute(&rendered, data); err != nil {
+			return nil, err
+		}
+		matchers[name] = rendered.String()
+	}
+	return matchers, nil
+}
+
+// Gate returns nil and the current deploymentconfig if the baseline of dc is
+// healthy.  Otherwise it records why in the canary-baseline-unhealthy
+// annotation and returns a RequeueAfter of ANALYSIS_INTERVAL.
+func Gate(dcs appsv1.DeploymentConfigInterface, stablePods corelisters.PodLister, dc *v1.DeploymentConfig) (*v1.DeploymentConfig, error) {
+	reason, err := Unhealthy(stablePods, dc, "")
+	if err != nil {
+		return nil, err
+	}
+	Observe(dc, reason)
+
+	if reason == "" {
+		if _, ok := dc.Annotations[UnhealthyAnnotation]; !ok {
+			return dc, nil
+		}
+		return client.UpdateDeploymentConfig(dcs, dc, func(dc *v1.DeploymentConfig) error {
+			delete(dc.Annotations, UnhealthyAnnotation)
+			return nil
+		})
+	}
+
+	if dc.Annotations[UnhealthyAnnotation] != reason {
+		l.Log.Info(fmt.Sprintf("canary for %s held back, the baseline is unhealthy", dc.GetName()),
+			zap.String("deploymentconfig", dc.GetName()), zap.String("reason", reason))
+		_, err := client.UpdateDeploymentConfig(dcs, dc, func(dc *v1.DeploymentConfig) error {
+			dc.Annotations[UnhealthyAnnotation] = reason
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to record unhealthy baseline: %v", err)
+		}
+	}
+	return nil, ctl.RequeueAfter(viper.GetDuration("ANALYSIS_INTERVAL"))
+}
+
+// Observe exports whether the baseline of dc is unhealthy
+func Observe(dc *v1.DeploymentConfig, reason string) {
+	unhealthy := 0.0
+	if reason != "" {
+		unhealthy = 1
+	}
+	unhealthyGauge.With(prometheus.Labels{"deploymentconfig": dc.GetName()}).Set(unhealthy)
+}
+
+// Paused returns how long the clock of the canary with annotations has been
+// paused at now, including a pause that hasn't ended yet
+func Paused(annotations map[string]string, now time.Time) time.Duration {
+	paused, err := time.ParseDuration(annotations[PausedAnnotation])
+	if err != nil {
+		paused = 0
+	}
+	if since, err := time.Parse(time.RFC3339, annotations[PausedSinceAnnotation]); err == nil && now.After(since) {
+		paused += now.Sub(since)
+	}
+	return paused
+}
+
+// Pause stops the clock of the canary with annotations at now, it returns
+// false if nothing changed.  The annotations only hold whole seconds, so the
+// pause starts at the next one and is never counted longer than it lasted.
+func Pause(annotations map[string]string, reason string, now time.Time) bool {
+	if _, ok := annotations[PausedSinceAnnotation]; ok && annotations[PausedReasonAnnotation] == reason {
+		return false
+	}
+	if _, ok := annotations[PausedSinceAnnotation]; !ok {
+		since := now.Truncate(time.Second)
+		if since.Before(now) {
+			since = since.Add(time.Second)
+		}
+		annotations[PausedSinceAnnotation] = since.UTC().Format(time.RFC3339)
+	}
+	annotations[PausedReasonAnnotation] = reason
+	return true
+}
+
+// Resume starts the clock of the canary with annotations again at now, it
+// returns false if it wasn't paused
+func Resume(annotations map[string]string, now time.Time) bool {
+	if _, ok := annotations[PausedSinceAnnotation]; !ok {
+		return false
+	}
+	annotations[PausedAnnotation] = Paused(annotations, now).Truncate(time.Second).String()
+	delete(annotations, PausedSinceAnnotation)
+	delete(annotations, PausedReasonAnnotation)
+	return true
+}
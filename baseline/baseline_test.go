@@ -0,0 +1,113 @@
+package baseline
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	v1 "github.com/openshift/api/apps/v1"
+	"github.com/redhatinsights/miniop/client"
+	"github.com/spf13/viper"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func init() {
+	client.Namespace = "test"
+}
+
+var dc = &v1.DeploymentConfig{ObjectMeta: metav1.ObjectMeta{Name: "testing"}}
+
+func stablePod(name string, ready apiv1.ConditionStatus) *apiv1.Pod {
+	return &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "test",
+			Labels:    map[string]string{"deploymentconfig": "testing"},
+		},
+		Status: apiv1.PodStatus{
+			Phase:      apiv1.PodRunning,
+			Conditions: []apiv1.PodCondition{{Type: apiv1.PodReady, Status: ready}},
+		},
+	}
+}
+
+// stablePods returns a lister of pods
+func stablePods(pods ...*apiv1.Pod) corelisters.PodLister {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, pod := range pods {
+		indexer.Add(pod)
+	}
+	return corelisters.NewPodLister(indexer)
+}
+
+func TestUnreadyPodsUnhealthy(t *testing.T) {
+	lister := stablePods(stablePod("testing-1-a", apiv1.ConditionTrue), stablePod("testing-1-b", apiv1.ConditionFalse))
+
+	reason, err := Unhealthy(lister, dc, "testing-canary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason != "stable pods not ready: testing-1-b" {
+		t.Errorf("unexpected reason %q", reason)
+	}
+
+	unchecked := dc.DeepCopy()
+	unchecked.Annotations = map[string]string{CheckAnnotation: "false"}
+	if reason, _ := Unhealthy(lister, unchecked, "testing-canary"); reason != "" {
+		t.Errorf("check was not turned off: %q", reason)
+	}
+}
+
+func TestFiringAlertsUnhealthy(t *testing.T) {
+	var filters []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filters = r.URL.Query()["filter"]
+		w.Write([]byte(`[{"labels": {"alertname": "CanaryDown", "kubernetes_pod_name": "testing-canary"}},
+			{"labels": {"alertname": "HighLatency", "kubernetes_pod_name": "testing-1-a"}}]`))
+	}))
+	defer srv.Close()
+	viper.Set("ALERTMANAGER_URL", srv.URL)
+	defer viper.Set("ALERTMANAGER_URL", "")
+
+	reason, err := Unhealthy(stablePods(), dc, "testing-canary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason != "alerts firing: HighLatency" {
+		t.Errorf("unexpected reason %q", reason)
+	}
+	if len(filters) != 1 || filters[0] != `deploymentconfig="testing"` {
+		t.Errorf("unexpected filters %v", filters)
+	}
+}
+
+func TestPauseAndResume(t *testing.T) {
+	start := time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)
+	annotations := map[string]string{}
+
+	if !Pause(annotations, "alerts firing: HighLatency", start) {
+		t.Fatal("clock was not paused")
+	}
+	if Pause(annotations, "alerts firing: HighLatency", start.Add(time.Minute)) {
+		t.Error("pausing again should not change anything")
+	}
+	if paused := Paused(annotations, start.Add(2*time.Minute)); paused != 2*time.Minute {
+		t.Errorf("expected an ongoing pause of 2m, got %s", paused)
+	}
+	if !Resume(annotations, start.Add(3*time.Minute)) {
+		t.Fatal("clock was not resumed")
+	}
+	if Resume(annotations, start.Add(4*time.Minute)) {
+		t.Error("resuming again should not change anything")
+	}
+
+	Pause(annotations, "stable pods not ready: testing-1-b", start.Add(10*time.Minute))
+	Resume(annotations, start.Add(11*time.Minute))
+	if paused := Paused(annotations, start.Add(time.Hour)); paused != 4*time.Minute {
+		t.Errorf("expected the pauses to add up to 4m, got %s", paused)
+	}
+}
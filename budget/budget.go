@@ -0,0 +1,292 @@
+// Package budget holds back canaries of services that spent their error
+// budget.  The budget comes from a service level objective set on the
+// deploymentconfig: PromQL queries for the good and total events, the
+// objective and the window it is measured over.
+package budget
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"text/template"
+	"time"
+
+	v1 "github.com/openshift/api/apps/v1"
+	appsv1 "github.com/openshift/client-go/apps/clientset/versioned/typed/apps/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redhatinsights/miniop/analysis"
+	"github.com/redhatinsights/miniop/client"
+	ctl "github.com/redhatinsights/miniop/controller"
+	l "github.com/redhatinsights/miniop/logger"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+func init() {
+	l.InitLogger()
+	viper.SetDefault("BUDGET_INTERVAL", "5m")
+}
+
+const (
+	// Annotation holds the SLO of the deploymentconfig as JSON
+	Annotation = "canary-slo"
+	// FixAnnotation names an image that fixes the service, its canary is
+	// started even when the budget is spent
+	FixAnnotation = "canary-fix"
+	// BlockedAnnotation tells why canaries are held back
+	BlockedAnnotation = "canary-budget-blocked"
+)
+
+var (
+	remainingGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "canary_error_budget_remaining_ratio",
+		Help: "The share of the error budget left in the SLO window per deploymentconfig, negative once overspent",
+	}, []string{"deploymentconfig"})
+
+	burnRateGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "canary_error_budget_burn_rate",
+		Help: "How fast the error budget is spent in the burn rate window per deploymentconfig, 1 spends it exactly over the SLO window",
+	}, []string{"deploymentconfig"})
+
+	blockedGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "canary_error_budget_blocked",
+		Help: "Whether canaries are held back by the error budget per deploymentconfig",
+	}, []string{"deploymentconfig"})
+)
+
+// promDuration matches Prometheus durations like 30d or 1h30m
+var promDuration = regexp.MustCompile(`^([0-9]+(ms|[smhdwy]))+$`)
+
+// SLO is the service level objective of a deploymentconfig
+type SLO struct {
+	// Good and Total count the good and all events.  They can refer to
+	// {{.Window}}, {{.DeploymentConfig}} and {{.Namespace}}, e.g.
+	// sum(increase(http_requests_total{code!~"5.."}[{{.Window}}]))
+	Good  string `json:"good"`
+	Total string `json:"total"`
+	// Objective is the share of good events promised, e.g. 0.999
+	Objective float64 `json:"objective"`
+	// Window is the Prometheus duration the objective is measured over, 30d
+	// by default
+	Window string `json:"window,omitempty"`
+	// BurnWindow is the Prometheus duration the burn rate is measured over,
+	// 1h by default
+	BurnWindow string `json:"burnWindow,omitempty"`
+	// MinRemaining is the share of the budget that has to be left to start
+	// a canary, 0 by default
+	MinRemaining float64 `json:"minRemaining,omitempty"`
+	// MaxBurnRate holds back canaries while the budget burns faster, any
+	// burn rate is allowed if 0
+	MaxBurnRate float64 `json:"maxBurnRate,omitempty"`
+
+	good, total *template.Template
+}
+
+// Status is the state of the error budget
+type Status struct {
+	// Remaining is the share of the budget left, 1 if no errors happened
+	// and negative once the budget is overspent
+	Remaining float64
+	// BurnRate is the rate the budget was spent at in the burn window
+	// relative to spending it evenly over the window
+	BurnRate float64
+}
+
+// ForDeploymentConfig returns the SLO of dc or nil if it doesn't have one
+func ForDeploymentConfig(dc *v1.DeploymentConfig) (*SLO, error) {
+	annotation, ok := dc.Annotations[Annotation]
+	if !ok {
+		return nil, nil
+	}
+	slo := &SLO{Window: "30d", BurnWindow: "1h"}
+	if err := json.Unmarshal([]byte(annotation), slo); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", Annotation, err)
+	}
+	if slo.Objective <= 0 || slo.Objective >= 1 {
+		return nil, fmt.Errorf("objective must be between 0 and 1")
+	}
+	for _, window := range []string{slo.Window, slo.BurnWindow} {
+		if !promDuration.MatchString(window) {
+			return nil, fmt.Errorf("invalid window %q", window)
+		}
+	}
+	var err error
+	if slo.good, err = parseQuery("good", slo.Good); err != nil {
+		return nil, err
+	}
+	if slo.total, err = parseQuery("total", slo.Total); err != nil {
+		return nil, err
+	}
+	return slo, nil
+}
+
+func parseQuery(name, query string) (*template.Template, error) {
+	if query == "" {
+		return nil, fmt.Errorf("%s query is required", name)
+	}
+	t, err := template.New(name).Parse(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s query: %v", name, err)
+	}
+	return t, nil
+}
+
+// Evaluate queries the Prometheus at PROMETHEUS_URL for the budget of dc
+func (s *SLO) Evaluate(dc *v1.DeploymentConfig, now time.Time) (Status, error) {
+	spent, err := s.errorRatio(dc, s.Window, now)
+	if err != nil {
+		return Status{}, err
+	}
+	burning, err := s.errorRatio(dc, s.BurnWindow, now)
+	if err != nil {
+		return Status{}, err
+	}
+	allowed := 1 - s.Objective
+	return Status{Remaining: 1 - spent/allowed, BurnRate: burning / allowed}, nil
+}
+
+// errorRatio returns the share of bad events within window, 0 without events
+func (s *SLO) errorRatio(dc *v1.DeploymentConfig, window string, now time.Time) (float64, error) {
+	data := struct {
+		DeploymentConfig, Namespace, Window string
+	}{dc.GetName(), client.Namespace, window}
+
+	var values [2]float64
+	for i, t := range []*template.Template{s.good, s.total} {
+		var query bytes.Buffer
+		if err := t.Execute(&query, data); err != nil {
+			return 0, err
+		}
+		samples, err := analysis.Query(query.String(), now)
+		if err != nil {
+			return 0, fmt.Errorf("%s query failed: %v", t.Name(), err)
+		}
+		if len(samples) > 0 {
+			values[i] = samples[0].Value
+		}
+	}
+	good, total := values[0], values[1]
+	if total <= 0 {
+		return 0, nil
+	}
+	return 1 - good/total, nil
+}
+
+// Blocks returns why status holds back canaries, or an empty string
+func (s *SLO) Blocks(status Status) string {
+	if status.Remaining < s.MinRemaining {
+		return fmt.Sprintf("%.1f%% of the error budget left, %.1f%% required", status.Remaining*100, s.MinRemaining*100)
+	}
+	if s.MaxBurnRate > 0 && status.BurnRate > s.MaxBurnRate {
+		return fmt.Sprintf("error budget burning at %.1fx, at most %.1fx allowed", status.BurnRate, s.MaxBurnRate)
+	}
+	return ""
+}
+
+// Gate returns nil and the current deploymentconfig if the error budget of
+// dc allows starting its canary.  Otherwise it records why in the
+// canary-budget-blocked annotation and returns a RequeueAfter of
+// BUDGET_INTERVAL.  Canaries of the image named by canary-fix are always
+// allowed.  The budget is exported as metrics either way.
+func Gate(dcs appsv1.DeploymentConfigInterface, dc *v1.DeploymentConfig, now time.Time) (*v1.DeploymentConfig, error) {
+	name := dc.GetName()
+	slo, err := ForDeploymentConfig(dc)
+	if err != nil {
+		l.Log.Error("deployment has an invalid SLO", zap.Error(err), zap.String("deploymentconfig", name))
+		return setBlocked(dcs, dc, fmt.Sprintf("invalid SLO: %v", err))
+	}
+	if slo == nil {
+		Forget(name)
+		return clearBlocked(dcs, dc)
+	}
+
+	status, err := slo.Evaluate(dc, now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to evaluate the error budget: %v", err)
+	}
+
+	reason := export(dc, slo, status)
+	if reason == "" {
+		return clearBlocked(dcs, dc)
+	}
+	if isFix(dc) {
+		l.Log.Info("starting the canary of a fix despite the error budget", zap.String("deploymentconfig", name),
+			zap.String("canary", dc.Annotations[FixAnnotation]), zap.String("reason", reason))
+		return clearBlocked(dcs, dc)
+	}
+	return setBlocked(dcs, dc, reason)
+}
+
+// Refresh exports the current error budget of dc without holding anything
+// back, so that the metrics stay current while no canary is started
+func Refresh(dc *v1.DeploymentConfig, now time.Time) error {
+	slo, err := ForDeploymentConfig(dc)
+	if err != nil || slo == nil {
+		return err
+	}
+	status, err := slo.Evaluate(dc, now)
+	if err != nil {
+		return fmt.Errorf("failed to evaluate the error budget: %v", err)
+	}
+	export(dc, slo, status)
+	return nil
+}
+
+// export sets the metrics of the budget of dc and returns why it holds back
+// canaries, or an empty string
+func export(dc *v1.DeploymentConfig, slo *SLO, status Status) string {
+	labels := prometheus.Labels{"deploymentconfig": dc.GetName()}
+	remainingGauge.With(labels).Set(status.Remaining)
+	burnRateGauge.With(labels).Set(status.BurnRate)
+
+	reason := slo.Blocks(status)
+	if reason != "" && !isFix(dc) {
+		blockedGauge.With(labels).Set(1)
+	} else {
+		blockedGauge.With(labels).Set(0)
+	}
+	return reason
+}
+
+// isFix returns true if the canary of dc is the fix named by canary-fix
+func isFix(dc *v1.DeploymentConfig) bool {
+	fix := dc.Annotations[FixAnnotation]
+	return fix != "" && fix == dc.Annotations["canary-image"]
+}
+
+// Forget stops exporting the error budget of the deploymentconfig called
+// name, e.g. once it was deleted
+func Forget(name string) {
+	labels := prometheus.Labels{"deploymentconfig": name}
+	remainingGauge.Delete(labels)
+	burnRateGauge.Delete(labels)
+	blockedGauge.Delete(labels)
+}
+
+func setBlocked(dcs appsv1.DeploymentConfigInterface, dc *v1.DeploymentConfig, reason string) (*v1.DeploymentConfig, error) {
+	blockedGauge.With(prometheus.Labels{"deploymentconfig": dc.GetName()}).Set(1)
+	if dc.Annotations[BlockedAnnotation] != reason {
+		l.Log.Info(fmt.Sprintf("canary for %s held back by the error budget", dc.GetName()),
+			zap.String("deploymentconfig", dc.GetName()), zap.String("reason", reason))
+		_, err := client.UpdateDeploymentConfig(dcs, dc, func(dc *v1.DeploymentConfig) error {
+			dc.Annotations[BlockedAnnotation] = reason
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to record blocked canary: %v", err)
+		}
+	}
+	return nil, ctl.RequeueAfter(viper.GetDuration("BUDGET_INTERVAL"))
+}
+
+func clearBlocked(dcs appsv1.DeploymentConfigInterface, dc *v1.DeploymentConfig) (*v1.DeploymentConfig, error) {
+	if _, ok := dc.Annotations[BlockedAnnotation]; !ok {
+		return dc, nil
+	}
+	return client.UpdateDeploymentConfig(dcs, dc, func(dc *v1.DeploymentConfig) error {
+		delete(dc.Annotations, BlockedAnnotation)
+		return nil
+	})
+}
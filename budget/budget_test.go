@@ -0,0 +1,150 @@
+package budget
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/openshift/api/apps/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redhatinsights/miniop/client/fake"
+	ctl "github.com/redhatinsights/miniop/controller"
+	"github.com/spf13/viper"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const slo = `{"good": "good[{{.Window}}]", "total": "total[{{.Window}}]", "objective": 0.99, "maxBurnRate": 10}`
+
+// prometheusServer answers good[window] and total[window] from counts
+func prometheusServer(t *testing.T, counts map[string]string) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value, ok := counts[r.URL.Query().Get("query")]
+		if !ok {
+			t.Errorf("unexpected query %q", r.URL.Query().Get("query"))
+		}
+		fmt.Fprintf(w, `{"status": "success", "data": {"resultType": "vector", "result": [{"metric": {}, "value": [0, %q]}]}}`, value)
+	}))
+	viper.Set("PROMETHEUS_URL", srv.URL)
+	return srv
+}
+
+func deploymentConfig(annotations map[string]string) *v1.DeploymentConfig {
+	return &v1.DeploymentConfig{ObjectMeta: metav1.ObjectMeta{Name: "testing", Annotations: annotations}}
+}
+
+func TestEvaluate(t *testing.T) {
+	srv := prometheusServer(t, map[string]string{
+		"good[30d]": "9950", "total[30d]": "10000",
+		"good[1h]": "80", "total[1h]": "100",
+	})
+	defer srv.Close()
+
+	s, err := ForDeploymentConfig(deploymentConfig(map[string]string{Annotation: slo}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := s.Evaluate(deploymentConfig(nil), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := status.Remaining - 0.5; diff > 1e-9 || diff < -1e-9 {
+		t.Errorf("expected half of the budget left, got %g", status.Remaining)
+	}
+	if diff := status.BurnRate - 20; diff > 1e-9 || diff < -1e-9 {
+		t.Errorf("expected a burn rate of 20, got %g", status.BurnRate)
+	}
+	if reason := s.Blocks(status); !strings.Contains(reason, "burning") {
+		t.Errorf("expected the burn rate to block, got %q", reason)
+	}
+}
+
+func TestInvalidSLO(t *testing.T) {
+	for _, annotation := range []string{
+		`{"good": "good", "total": "total", "objective": 99.9}`,
+		`{"good": "good", "objective": 0.999}`,
+		`{"good": "good", "total": "total", "objective": 0.999, "window": "30 days"}`,
+		`not json`,
+	} {
+		if _, err := ForDeploymentConfig(deploymentConfig(map[string]string{Annotation: annotation})); err == nil {
+			t.Errorf("%s: expected an error", annotation)
+		}
+	}
+}
+
+func TestGate(t *testing.T) {
+	srv := prometheusServer(t, map[string]string{
+		"good[30d]": "9800", "total[30d]": "10000",
+		"good[1h]": "0", "total[1h]": "0",
+	})
+	defer srv.Close()
+
+	dc := deploymentConfig(map[string]string{Annotation: slo, "canary-image": "myapp:v2"})
+	apps := fake.NewApps(dc)
+	dcs := apps.DeploymentConfigs("test")
+
+	if _, err := Gate(dcs, apps.Stored("testing"), time.Now()); err != ctl.RequeueAfter(viper.GetDuration("BUDGET_INTERVAL")) {
+		t.Fatalf("expected an overspent budget to hold back the canary, got %v", err)
+	}
+	if reason := apps.Stored("testing").Annotations[BlockedAnnotation]; !strings.HasPrefix(reason, "-100.0% of the error budget left") {
+		t.Errorf("unexpected reason %q", reason)
+	}
+
+	apps.Modify("testing", func(dc *v1.DeploymentConfig) {
+		dc.Annotations[FixAnnotation] = "myapp:v2"
+	})
+	updated, err := Gate(dcs, apps.Stored("testing"), time.Now())
+	if err != nil {
+		t.Fatalf("expected the fix to be allowed, got %v", err)
+	}
+	if _, ok := updated.Annotations[BlockedAnnotation]; ok {
+		t.Error("blocked annotation was not cleared")
+	}
+
+	apps.Modify("testing", func(dc *v1.DeploymentConfig) {
+		delete(dc.Annotations, Annotation)
+	})
+	if _, err := Gate(dcs, apps.Stored("testing"), time.Now()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	labels := prometheus.Labels{"deploymentconfig": "testing"}
+	for name, gauge := range map[string]*prometheus.GaugeVec{"remaining": remainingGauge, "burn rate": burnRateGauge, "blocked": blockedGauge} {
+		if gauge.Delete(labels) {
+			t.Errorf("the %s of a removed SLO is still exported", name)
+		}
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	counts := map[string]string{
+		"good[30d]": "10000", "total[30d]": "10000",
+		"good[1h]": "100", "total[1h]": "100",
+	}
+	srv := prometheusServer(t, counts)
+	defer srv.Close()
+	defer Forget("testing")
+
+	dc := deploymentConfig(map[string]string{Annotation: slo})
+	labels := prometheus.Labels{"deploymentconfig": "testing"}
+	if err := Refresh(dc, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if remaining := testutil.ToFloat64(remainingGauge.With(labels)); remaining != 1 {
+		t.Errorf("expected the whole budget left, got %g", remaining)
+	}
+
+	// spending the budget shows without starting a canary
+	counts["good[30d]"], counts["good[1h]"] = "9800", "0"
+	if err := Refresh(dc, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if remaining := testutil.ToFloat64(remainingGauge.With(labels)); remaining >= 0 {
+		t.Errorf("expected an overspent budget, got %g", remaining)
+	}
+	if blocked := testutil.ToFloat64(blockedGauge.With(labels)); blocked != 1 {
+		t.Errorf("expected the budget to hold back canaries, got %g", blocked)
+	}
+}
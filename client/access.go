@@ -0,0 +1,38 @@
+package client
+
+import (
+	l "github.com/redhatinsights/miniop/logger"
+	"go.uber.org/zap"
+	authzv1 "k8s.io/api/authorization/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// CanWatch returns true if miniop may list and watch resource of group in
+// namespace, an empty namespace stands for a cluster scoped resource.  With
+// a name only the object called name is asked for, like informers selecting
+// it by name do.  A failed review counts as not allowed.
+func CanWatch(kube kubernetes.Interface, group, resource, namespace, name string) bool {
+	for _, verb := range []string{"list", "watch"} {
+		review, err := kube.AuthorizationV1().SelfSubjectAccessReviews().Create(&authzv1.SelfSubjectAccessReview{
+			Spec: authzv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authzv1.ResourceAttributes{
+					Namespace: namespace,
+					Verb:      verb,
+					Group:     group,
+					Resource:  resource,
+					Name:      name,
+				},
+			},
+		})
+		if err != nil {
+			l.Log.Error("self subject access review failed", zap.Error(err), zap.String("resource", resource))
+			return false
+		}
+		if !review.Status.Allowed {
+			l.Log.Info("access to "+resource+" is missing, features relying on it are off",
+				zap.String("resource", resource), zap.String("verb", verb))
+			return false
+		}
+	}
+	return true
+}
@@ -2,19 +2,39 @@ package client
 
 import (
 	"io/ioutil"
+	"time"
 
+	appsclient "github.com/openshift/client-go/apps/clientset/versioned"
+	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 )
 
 var Config *rest.Config
 var Clientset *kubernetes.Clientset
+var AppsClientset *appsclient.Clientset
+var ImageClient rest.Interface
 var Namespace string
 
-func init() {
-	Config = getConfig()
-	Clientset = getClientset()
-	Namespace = getNamespace()
+var pingClient discovery.DiscoveryInterface
+
+// InitClient loads the in-cluster configuration.  It is called explicitly so
+// that packages depending on client can be tested outside of a cluster.
+func InitClient() {
+	if Config == nil {
+		Config = getConfig()
+		Clientset = getClientset()
+		AppsClientset = appsclient.NewForConfigOrDie(Config)
+		ImageClient = newImageClient(Config)
+		Namespace = getNamespace()
+		pingClient = getPingClient()
+	}
+}
+
+// Ping returns an error if the kubernetes API can't be reached
+func Ping() error {
+	_, err := pingClient.ServerVersion()
+	return err
 }
 
 func getConfig() *rest.Config {
@@ -33,6 +53,12 @@ func getClientset() *kubernetes.Clientset {
 	return Clientset
 }
 
+func getPingClient() discovery.DiscoveryInterface {
+	config := rest.CopyConfig(Config)
+	config.Timeout = 5 * time.Second
+	return discovery.NewDiscoveryClientForConfigOrDie(config)
+}
+
 func getNamespace() string {
 	content, err := ioutil.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
 	if err != nil {
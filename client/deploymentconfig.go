@@ -0,0 +1,43 @@
+package client
+
+import (
+	v1 "github.com/openshift/api/apps/v1"
+	appsv1 "github.com/openshift/client-go/apps/clientset/versioned/typed/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+// UpdateDeploymentConfig applies mutate to a copy of dc and saves it.  If the
+// update conflicts with a concurrent change the deploymentconfig is read
+// again and mutate is reapplied to the fresh copy, so mutate must only make
+// the changes it needs and must not rely on state from an earlier attempt.
+func UpdateDeploymentConfig(dcs appsv1.DeploymentConfigInterface, dc *v1.DeploymentConfig, mutate func(*v1.DeploymentConfig) error) (*v1.DeploymentConfig, error) {
+	var updated *v1.DeploymentConfig
+	current := dc
+	err := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		if current == nil {
+			fresh, err := dcs.Get(dc.GetName(), metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			current = fresh
+		}
+
+		next := current.DeepCopy()
+		current = nil
+		if next.Annotations == nil {
+			next.Annotations = make(map[string]string)
+		}
+		if err := mutate(next); err != nil {
+			return err
+		}
+
+		var err error
+		updated, err = dcs.Update(next)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
@@ -0,0 +1,151 @@
+// Package fake provides in-memory deploymentconfig and imagestream clients
+// for tests.  The fake clientsets generated in the pinned openshift client-go
+// don't build against the client-go version in go.mod, and unlike them these
+// enforce resource versions so tests can exercise update conflicts.
+package fake
+
+import (
+	"strconv"
+	"sync"
+
+	v1 "github.com/openshift/api/apps/v1"
+	appsv1 "github.com/openshift/client-go/apps/clientset/versioned/typed/apps/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Apps implements the subset of appsv1.AppsV1Interface used by miniop
+type Apps struct {
+	appsv1.AppsV1Interface
+
+	// UpdateError is returned by every update when set
+	UpdateError error
+
+	// InstantiateError is returned by every instantiate when set
+	InstantiateError error
+
+	// BeforeUpdate is called once with the stored deploymentconfig before the
+	// next update is applied, simulating a concurrent change
+	BeforeUpdate func(dc *v1.DeploymentConfig)
+
+	mu      sync.Mutex
+	dcs     map[string]*v1.DeploymentConfig
+	updates int
+}
+
+// NewApps returns an Apps client that stores the given deploymentconfigs
+func NewApps(dcs ...*v1.DeploymentConfig) *Apps {
+	a := &Apps{dcs: make(map[string]*v1.DeploymentConfig)}
+	for _, dc := range dcs {
+		dc = dc.DeepCopy()
+		if dc.ResourceVersion == "" {
+			dc.ResourceVersion = "1"
+		}
+		a.dcs[dc.Name] = dc
+	}
+	return a
+}
+
+// DeploymentConfigs returns a client for the stored deploymentconfigs,
+// namespaces are ignored
+func (a *Apps) DeploymentConfigs(namespace string) appsv1.DeploymentConfigInterface {
+	return &deploymentConfigs{apps: a}
+}
+
+// Stored returns a copy of the named deploymentconfig or nil
+func (a *Apps) Stored(name string) *v1.DeploymentConfig {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	dc, ok := a.dcs[name]
+	if !ok {
+		return nil
+	}
+	return dc.DeepCopy()
+}
+
+// Modify changes the named deploymentconfig as another client would,
+// invalidating any copies held by the code under test
+func (a *Apps) Modify(name string, modify func(*v1.DeploymentConfig)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	dc := a.dcs[name]
+	modify(dc)
+	bump(dc)
+}
+
+// Updates returns the number of successful updates
+func (a *Apps) Updates() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.updates
+}
+
+func bump(dc *v1.DeploymentConfig) {
+	rv, _ := strconv.Atoi(dc.ResourceVersion)
+	dc.ResourceVersion = strconv.Itoa(rv + 1)
+}
+
+type deploymentConfigs struct {
+	appsv1.DeploymentConfigInterface
+	apps *Apps
+}
+
+func (d *deploymentConfigs) Get(name string, options metav1.GetOptions) (*v1.DeploymentConfig, error) {
+	d.apps.mu.Lock()
+	defer d.apps.mu.Unlock()
+	dc, ok := d.apps.dcs[name]
+	if !ok {
+		return nil, errors.NewNotFound(v1.Resource("deploymentconfigs"), name)
+	}
+	return dc.DeepCopy(), nil
+}
+
+func (d *deploymentConfigs) List(opts metav1.ListOptions) (*v1.DeploymentConfigList, error) {
+	d.apps.mu.Lock()
+	defer d.apps.mu.Unlock()
+	list := &v1.DeploymentConfigList{}
+	for _, dc := range d.apps.dcs {
+		list.Items = append(list.Items, *dc.DeepCopy())
+	}
+	return list, nil
+}
+
+func (d *deploymentConfigs) Update(dc *v1.DeploymentConfig) (*v1.DeploymentConfig, error) {
+	d.apps.mu.Lock()
+	defer d.apps.mu.Unlock()
+	if d.apps.UpdateError != nil {
+		return nil, d.apps.UpdateError
+	}
+	stored, ok := d.apps.dcs[dc.Name]
+	if !ok {
+		return nil, errors.NewNotFound(v1.Resource("deploymentconfigs"), dc.Name)
+	}
+	if before := d.apps.BeforeUpdate; before != nil {
+		d.apps.BeforeUpdate = nil
+		before(stored)
+		bump(stored)
+	}
+	if stored.ResourceVersion != dc.ResourceVersion {
+		return nil, errors.NewConflict(v1.Resource("deploymentconfigs"), dc.Name, errors.NewBadRequest("the object has been modified"))
+	}
+	updated := dc.DeepCopy()
+	bump(updated)
+	d.apps.dcs[dc.Name] = updated
+	d.apps.updates++
+	return updated.DeepCopy(), nil
+}
+
+func (d *deploymentConfigs) Instantiate(name string, req *v1.DeploymentRequest) (*v1.DeploymentConfig, error) {
+	d.apps.mu.Lock()
+	defer d.apps.mu.Unlock()
+	if d.apps.InstantiateError != nil {
+		return nil, d.apps.InstantiateError
+	}
+	dc, ok := d.apps.dcs[name]
+	if !ok {
+		return nil, errors.NewNotFound(v1.Resource("deploymentconfigs"), name)
+	}
+	dc.Status.LatestVersion++
+	bump(dc)
+	return dc.DeepCopy(), nil
+}
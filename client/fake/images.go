@@ -0,0 +1,79 @@
+package fake
+
+import (
+	"strconv"
+	"sync"
+
+	imagev1 "github.com/openshift/api/image/v1"
+	"github.com/redhatinsights/miniop/client"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Images implements client.ImagesInterface in memory
+type Images struct {
+	mu      sync.Mutex
+	streams map[string]*imagev1.ImageStream
+}
+
+// NewImages returns an Images client that stores the given imagestreams
+func NewImages(streams ...*imagev1.ImageStream) *Images {
+	i := &Images{streams: make(map[string]*imagev1.ImageStream)}
+	for _, is := range streams {
+		is = is.DeepCopy()
+		if is.ResourceVersion == "" {
+			is.ResourceVersion = "1"
+		}
+		i.streams[is.Namespace+"/"+is.Name] = is
+	}
+	return i
+}
+
+// ImageStreams returns a client for the stored imagestreams of namespace
+func (i *Images) ImageStreams(namespace string) client.ImageStreamInterface {
+	return &imageStreams{images: i, namespace: namespace}
+}
+
+// Stored returns a copy of the imagestream or nil
+func (i *Images) Stored(namespace, name string) *imagev1.ImageStream {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	is, ok := i.streams[namespace+"/"+name]
+	if !ok {
+		return nil
+	}
+	return is.DeepCopy()
+}
+
+type imageStreams struct {
+	images    *Images
+	namespace string
+}
+
+func (s *imageStreams) Get(name string, options metav1.GetOptions) (*imagev1.ImageStream, error) {
+	if is := s.images.Stored(s.namespace, name); is != nil {
+		return is, nil
+	}
+	return nil, errors.NewNotFound(imagev1.Resource("imagestreams"), name)
+}
+
+func (s *imageStreams) Update(is *imagev1.ImageStream) (*imagev1.ImageStream, error) {
+	s.images.mu.Lock()
+	defer s.images.mu.Unlock()
+
+	key := s.namespace + "/" + is.GetName()
+	stored, ok := s.images.streams[key]
+	if !ok {
+		return nil, errors.NewNotFound(imagev1.Resource("imagestreams"), is.GetName())
+	}
+	if is.ResourceVersion != stored.ResourceVersion {
+		return nil, errors.NewConflict(imagev1.Resource("imagestreams"), is.GetName(), errors.NewBadRequest("the object has been modified"))
+	}
+
+	updated := is.DeepCopy()
+	updated.Namespace = s.namespace
+	rv, _ := strconv.Atoi(stored.ResourceVersion)
+	updated.ResourceVersion = strconv.Itoa(rv + 1)
+	s.images.streams[key] = updated
+	return updated.DeepCopy(), nil
+}
@@ -0,0 +1,128 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+
+	imagev1 "github.com/openshift/api/image/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/client-go/rest"
+)
+
+// newImageClient returns a REST client for the image.openshift.io API.  The
+// image clientset in the pinned openshift client-go refers to types missing
+// from the openshift api version in go.mod, so imagestreams are read with a
+// plain REST client.
+func newImageClient(config *rest.Config) rest.Interface {
+	scheme := runtime.NewScheme()
+	if err := imagev1.AddToScheme(scheme); err != nil {
+		panic(err.Error())
+	}
+	metav1.AddToGroupVersion(scheme, imagev1.SchemeGroupVersion)
+
+	config = rest.CopyConfig(config)
+	config.GroupVersion = &imagev1.SchemeGroupVersion
+	config.APIPath = "/apis"
+	config.NegotiatedSerializer = serializer.NewCodecFactory(scheme).WithoutConversion()
+	if config.UserAgent == "" {
+		config.UserAgent = rest.DefaultKubernetesUserAgent()
+	}
+
+	client, err := rest.RESTClientFor(config)
+	if err != nil {
+		panic(err.Error())
+	}
+	return client
+}
+
+// ImagesInterface gives access to imagestreams, like the generated typed
+// clients do for other resources
+type ImagesInterface interface {
+	ImageStreams(namespace string) ImageStreamInterface
+}
+
+// ImageStreamInterface reads and updates the imagestreams of a namespace
+type ImageStreamInterface interface {
+	Get(name string, options metav1.GetOptions) (*imagev1.ImageStream, error)
+	Update(is *imagev1.ImageStream) (*imagev1.ImageStream, error)
+}
+
+// NewImages returns an ImagesInterface using a client from newImageClient
+func NewImages(images rest.Interface) ImagesInterface {
+	return restImages{images}
+}
+
+type restImages struct {
+	client rest.Interface
+}
+
+func (i restImages) ImageStreams(namespace string) ImageStreamInterface {
+	return restImageStreams{client: i.client, namespace: namespace}
+}
+
+type restImageStreams struct {
+	client    rest.Interface
+	namespace string
+}
+
+func (s restImageStreams) Get(name string, options metav1.GetOptions) (*imagev1.ImageStream, error) {
+	result := &imagev1.ImageStream{}
+	err := s.client.Get().
+		Namespace(s.namespace).
+		Resource("imagestreams").
+		Name(name).
+		VersionedParams(&options, metav1.ParameterCodec).
+		Do().
+		Into(result)
+	return result, err
+}
+
+func (s restImageStreams) Update(is *imagev1.ImageStream) (*imagev1.ImageStream, error) {
+	result := &imagev1.ImageStream{}
+	err := s.client.Put().
+		Namespace(s.namespace).
+		Resource("imagestreams").
+		Name(is.GetName()).
+		Body(is).
+		Do().
+		Into(result)
+	return result, err
+}
+
+// ResolveTag returns the digest pullspec the tag of the imagestream
+// currently points to
+func ResolveTag(is *imagev1.ImageStream, tag string) (string, bool) {
+	for _, history := range is.Status.Tags {
+		if history.Tag != tag || len(history.Items) == 0 {
+			continue
+		}
+		// the newest event comes first
+		event := history.Items[0]
+		if strings.Contains(event.DockerImageReference, "@") || event.Image == "" {
+			return event.DockerImageReference, event.DockerImageReference != ""
+		}
+		return fmt.Sprintf("%s@%s", repository(event.DockerImageReference), event.Image), true
+	}
+	return "", false
+}
+
+// repository strips the tag from a pullspec
+func repository(pullSpec string) string {
+	slash := strings.LastIndex(pullSpec, "/")
+	if colon := strings.LastIndex(pullSpec, ":"); colon > slash {
+		return pullSpec[:colon]
+	}
+	return pullSpec
+}
+
+// SplitRepository splits host/repository:tag into the repository and the
+// optional tag
+func SplitRepository(pullSpec string) (string, string) {
+	repo := repository(pullSpec)
+	if repo == pullSpec {
+		return repo, ""
+	}
+	return repo, pullSpec[len(repo)+1:]
+}
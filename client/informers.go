@@ -0,0 +1,194 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	appsv1 "github.com/openshift/api/apps/v1"
+	imagev1 "github.com/openshift/api/image/v1"
+	appsclient "github.com/openshift/client-go/apps/clientset/versioned"
+	appsinformers "github.com/openshift/client-go/apps/informers/externalversions"
+	appsinformersv1 "github.com/openshift/client-go/apps/informers/externalversions/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+// CanaryForIndex indexes canary pods by the deploymentconfig they were
+// created for
+const CanaryForIndex = "canary-for"
+
+// CanaryFromIndex indexes deploymentconfigs by the imagestream their
+// canary-from annotation refers to
+const CanaryFromIndex = "canary-from"
+
+// CanaryRepositoryIndex indexes deploymentconfigs by the registry repository
+// their canary-repository annotation refers to
+const CanaryRepositoryIndex = "canary-repository"
+
+// Informers are shared by the controllers so that workers read from caches
+// instead of the API
+type Informers struct {
+	// DeploymentConfigs only contains deploymentconfigs labelled canary=true
+	// and is indexed by CanaryFromIndex and CanaryRepositoryIndex
+	DeploymentConfigs appsinformersv1.DeploymentConfigInformer
+	// CanaryPods only contains pods labelled canary=true and is indexed by
+	// CanaryForIndex
+	CanaryPods             coreinformers.PodInformer
+	ReplicationControllers coreinformers.ReplicationControllerInformer
+	// StablePods only contains pods labelled with a deploymentconfig that
+	// aren't labelled canary=true
+	StablePods coreinformers.PodInformer
+	// ConfigMaps only contains the emergency stop configmap
+	ConfigMaps coreinformers.ConfigMapInformer
+	// Namespaces only contains Namespace itself, it is nil when miniop may
+	// not list and watch namespaces
+	Namespaces coreinformers.NamespaceInformer
+	// ImageStreams contains *imagev1.ImageStream, see newImageClient.  It is
+	// nil when miniop may not list and watch imagestreams.
+	ImageStreams cache.SharedIndexInformer
+
+	apps       appsinformers.SharedInformerFactory
+	canaryPods informers.SharedInformerFactory
+	stablePods informers.SharedInformerFactory
+	kube       informers.SharedInformerFactory
+	stop       informers.SharedInformerFactory
+	namespace  informers.SharedInformerFactory
+}
+
+func canaryOnly(opts *metav1.ListOptions) {
+	opts.LabelSelector = "canary=true"
+}
+
+func stableOnly(opts *metav1.ListOptions) {
+	opts.LabelSelector = "deploymentconfig,canary!=true"
+}
+
+// named restricts a list to the object called name
+func named(name string) func(opts *metav1.ListOptions) {
+	return func(opts *metav1.ListOptions) {
+		opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+	}
+}
+
+// NewInformers creates the informers for Namespace.  Canary pods are resynced
+// every podResync, everything else only on change.  Only the configmap called
+// stopConfigMap is watched.  Namespaces and ImageStreams are only created
+// when a SelfSubjectAccessReview allows them, so that missing access turns
+// the features using them off instead of keeping miniop from syncing.
+func NewInformers(apps appsclient.Interface, images rest.Interface, kube kubernetes.Interface, podResync time.Duration, stopConfigMap string) *Informers {
+	i := &Informers{
+		apps: appsinformers.NewSharedInformerFactoryWithOptions(apps, 0,
+			appsinformers.WithNamespace(Namespace), appsinformers.WithTweakListOptions(canaryOnly)),
+		canaryPods: informers.NewSharedInformerFactoryWithOptions(kube, podResync,
+			informers.WithNamespace(Namespace), informers.WithTweakListOptions(canaryOnly)),
+		stablePods: informers.NewSharedInformerFactoryWithOptions(kube, 0,
+			informers.WithNamespace(Namespace), informers.WithTweakListOptions(stableOnly)),
+		kube: informers.NewSharedInformerFactoryWithOptions(kube, 0, informers.WithNamespace(Namespace)),
+		stop: informers.NewSharedInformerFactoryWithOptions(kube, 0,
+			informers.WithNamespace(Namespace), informers.WithTweakListOptions(named(stopConfigMap))),
+		namespace: informers.NewSharedInformerFactoryWithOptions(kube, 0, informers.WithTweakListOptions(named(Namespace))),
+	}
+
+	i.DeploymentConfigs = i.apps.Apps().V1().DeploymentConfigs()
+	i.CanaryPods = i.canaryPods.Core().V1().Pods()
+	i.StablePods = i.stablePods.Core().V1().Pods()
+	i.ReplicationControllers = i.kube.Core().V1().ReplicationControllers()
+	i.ConfigMaps = i.stop.Core().V1().ConfigMaps()
+	if CanWatch(kube, "", "namespaces", "", Namespace) {
+		i.Namespaces = i.namespace.Core().V1().Namespaces()
+	}
+	if CanWatch(kube, "image.openshift.io", "imagestreams", Namespace, "") {
+		i.ImageStreams = cache.NewSharedIndexInformer(cache.NewListWatchFromClient(images, "imagestreams", Namespace, fields.Everything()),
+			&imagev1.ImageStream{}, 0, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	}
+
+	// informers have to be requested before the factories are started
+	if err := i.DeploymentConfigs.Informer().AddIndexers(cache.Indexers{
+		CanaryFromIndex:       CanaryFromIndexFunc,
+		CanaryRepositoryIndex: CanaryRepositoryIndexFunc,
+	}); err != nil {
+		panic(err.Error())
+	}
+	i.ReplicationControllers.Informer()
+	i.ConfigMaps.Informer()
+	i.StablePods.Informer()
+	if i.Namespaces != nil {
+		i.Namespaces.Informer()
+	}
+	if err := i.CanaryPods.Informer().AddIndexers(cache.Indexers{CanaryForIndex: CanaryForIndexFunc}); err != nil {
+		panic(err.Error())
+	}
+	return i
+}
+
+// Start starts all informers, they stop when stopCh is closed
+func (i *Informers) Start(stopCh <-chan struct{}) {
+	i.apps.Start(stopCh)
+	if i.ImageStreams != nil {
+		go i.ImageStreams.Run(stopCh)
+	}
+	i.canaryPods.Start(stopCh)
+	i.stablePods.Start(stopCh)
+	i.kube.Start(stopCh)
+	i.stop.Start(stopCh)
+	i.namespace.Start(stopCh)
+}
+
+// CanaryForIndexFunc indexes pods by their canary-for label
+func CanaryForIndexFunc(obj interface{}) ([]string, error) {
+	pod, ok := obj.(*apiv1.Pod)
+	if !ok {
+		return nil, fmt.Errorf("object type was unexpected")
+	}
+	if canaryFor, ok := pod.Labels["canary-for"]; ok {
+		return []string{canaryFor}, nil
+	}
+	return nil, nil
+}
+
+// CanaryFromIndexFunc indexes deploymentconfigs by the imagestream of their
+// canary-from annotation
+func CanaryFromIndexFunc(obj interface{}) ([]string, error) {
+	dc, ok := obj.(*appsv1.DeploymentConfig)
+	if !ok {
+		return nil, fmt.Errorf("object type was unexpected")
+	}
+	if stream, _, ok := SplitImageStreamTag(dc.Annotations["canary-from"]); ok {
+		return []string{stream}, nil
+	}
+	return nil, nil
+}
+
+// CanaryRepositoryIndexFunc indexes deploymentconfigs by the repository of
+// their canary-repository annotation
+func CanaryRepositoryIndexFunc(obj interface{}) ([]string, error) {
+	dc, ok := obj.(*appsv1.DeploymentConfig)
+	if !ok {
+		return nil, fmt.Errorf("object type was unexpected")
+	}
+	if annotation := dc.Annotations["canary-repository"]; annotation != "" {
+		repo, _ := SplitRepository(annotation)
+		return []string{repo}, nil
+	}
+	return nil, nil
+}
+
+// SplitImageStreamTag splits name:tag into the imagestream and tag, the tag
+// defaults to latest
+func SplitImageStreamTag(streamTag string) (string, string, bool) {
+	if streamTag == "" {
+		return "", "", false
+	}
+	parts := strings.SplitN(streamTag, ":", 2)
+	if len(parts) == 1 || parts[1] == "" {
+		return parts[0], "latest", parts[0] != ""
+	}
+	return parts[0], parts[1], parts[0] != ""
+}
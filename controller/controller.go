@@ -18,29 +18,178 @@ package controller
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
+	"github.com/redhatinsights/miniop/health"
 	l "github.com/redhatinsights/miniop/logger"
+	"github.com/spf13/viper"
 	"go.uber.org/zap"
-	r "k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/runtime"
-	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/util/workqueue"
 )
 
+func init() {
+	l.InitLogger()
+	viper.SetDefault("WORKER_STALL_TIMEOUT", "5m")
+}
+
 type Worker interface {
 	Work(obj interface{}) error
 }
 
+// RequeueAfter can be returned by a Worker to have the object processed
+// again after the duration has passed, even if it doesn't change.
+type RequeueAfter time.Duration
+
+func (r RequeueAfter) Error() string {
+	return fmt.Sprintf("requeue after %s", time.Duration(r))
+}
+
 type Controller struct {
+	Name     string
 	Indexer  cache.Indexer
 	Queue    workqueue.RateLimitingInterface
-	Informer cache.Controller
+	Informer cache.SharedIndexInformer
 	Worker   Worker
+
+	synced        []cache.InformerSynced
+	mu            sync.Mutex
+	lastProcessed time.Time
+	// inFlight holds when the workers started on the keys they process
+	inFlight map[interface{}]time.Time
+}
+
+// New creates a controller that hands the objects of informer to worker
+// whenever they change.  The informer isn't started by the controller, it is
+// expected to be started by the factory it was created from.  The
+// controller's caches, workers and queue are reported under name by the
+// health endpoints and metrics.
+func New(name string, informer cache.SharedIndexInformer, worker Worker) *Controller {
+	// Note that when we finally process the item from the workqueue, we might see a newer version
+	// of the object than the version which was responsible for triggering the update.
+	c := &Controller{
+		Name:     name,
+		Indexer:  informer.GetIndexer(),
+		Queue:    workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), name),
+		Informer: informer,
+		Worker:   worker,
+	}
+
+	c.Watch(informer, func(obj interface{}) []string {
+		key, err := cache.MetaNamespaceKeyFunc(obj)
+		if err != nil {
+			return nil
+		}
+		return []string{key}
+	})
+
+	health.AddReadinessCheck(name+"-cache", c.Synced)
+	health.AddLivenessCheck(name+"-workers", c.Alive)
+	return c
+}
+
+// Watch adds the keys returned by keys to the queue whenever an object in
+// informer changes.  This lets changes to related objects trigger work, the
+// keys have to refer to objects of the controller's own informer.
+func (c *Controller) Watch(informer cache.SharedIndexInformer, keys func(obj interface{}) []string) {
+	c.synced = append(c.synced, informer.HasSynced)
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			c.enqueue(keys(obj))
+		},
+		UpdateFunc: func(old interface{}, new interface{}) {
+			c.enqueue(keys(new))
+		},
+		DeleteFunc: func(obj interface{}) {
+			// informers use a delta queue, deletes may hand us a tombstone
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			c.enqueue(keys(obj))
+		},
+	})
+}
+
+// WaitFor makes the controller wait for the cache of informer before it
+// starts its workers and report it in Synced.  It is meant for caches the
+// worker reads whose changes don't trigger any work.
+func (c *Controller) WaitFor(informer cache.SharedIndexInformer) {
+	c.synced = append(c.synced, informer.HasSynced)
+}
+
+func (c *Controller) enqueue(keys []string) {
+	for _, key := range keys {
+		c.Queue.Add(key)
+	}
+}
+
+// Synced returns an error until all watched informer caches have synced
+func (c *Controller) Synced() error {
+	for _, synced := range c.synced {
+		if !synced() {
+			return fmt.Errorf("%s caches have not synced", c.Name)
+		}
+	}
+	return nil
+}
+
+// Alive returns an error if a worker has been processing one item for longer
+// than WORKER_STALL_TIMEOUT, or if items are waiting in the queue but the
+// workers haven't successfully processed any for that long.  Items that fail
+// and are retried don't count as progress.
+func (c *Controller) Alive() error {
+	c.mu.Lock()
+	last := c.lastProcessed
+	var wedged interface{}
+	var since time.Time
+	for key, started := range c.inFlight {
+		if wedged == nil || started.Before(since) {
+			wedged, since = key, started
+		}
+	}
+	c.mu.Unlock()
+
+	if last.IsZero() {
+		// workers haven't started yet
+		return nil
+	}
+
+	stall := viper.GetDuration("WORKER_STALL_TIMEOUT")
+	if wedged != nil && time.Since(since) > stall {
+		return fmt.Errorf("%s worker has been processing %v for %s", c.Name, wedged, time.Since(since).Round(time.Second))
+	}
+	if queued := c.Queue.Len(); queued > 0 && time.Since(last) > stall {
+		return fmt.Errorf("%s workers have %d items queued but finished none for %s", c.Name, queued, time.Since(last).Round(time.Second))
+	}
+	return nil
+}
+
+// processed records that the workers made progress
+func (c *Controller) processed() {
+	c.mu.Lock()
+	c.lastProcessed = time.Now()
+	c.mu.Unlock()
+}
+
+// start records that a worker started processing key, the returned func
+// records that it is done
+func (c *Controller) start(key interface{}) func() {
+	c.mu.Lock()
+	if c.inFlight == nil {
+		c.inFlight = map[interface{}]time.Time{}
+	}
+	c.inFlight[key] = time.Now()
+	c.mu.Unlock()
+	return func() {
+		c.mu.Lock()
+		delete(c.inFlight, key)
+		c.mu.Unlock()
+	}
 }
 
-func (c *Controller) processNextItem() bool {
+func (c *Controller) processNextItem(stopCh <-chan struct{}) bool {
 	// Wait until there is a new item in the working queue
 	key, quit := c.Queue.Get()
 	if quit {
@@ -50,6 +199,15 @@ func (c *Controller) processNextItem() bool {
 	// This allows safe parallel processing because two pods with the same key are never processed in
 	// parallel.
 	defer c.Queue.Done(key)
+	defer c.start(key)()
+
+	// Don't start on new items once we are stopping, they will be picked up
+	// again by the initial list after a restart
+	select {
+	case <-stopCh:
+		return false
+	default:
+	}
 
 	// Invoke the method containing the business logic
 	stringKey := key.(string)
@@ -62,6 +220,7 @@ func (c *Controller) processNextItem() bool {
 
 	if !exists {
 		l.Log.Debug(fmt.Sprintf("resource %s does not exist anymore", stringKey))
+		c.processed()
 		return true
 	}
 
@@ -78,6 +237,15 @@ func (c *Controller) handleErr(err error, key interface{}) {
 		// This ensures that future processing of updates for this key is not delayed because of
 		// an outdated error history.
 		c.Queue.Forget(key)
+		c.processed()
+		return
+	}
+
+	if after, ok := err.(RequeueAfter); ok {
+		// not a failure, so the rate limiting history is cleared as well
+		c.Queue.Forget(key)
+		c.Queue.AddAfter(key, time.Duration(after))
+		c.processed()
 		return
 	}
 
@@ -97,79 +265,42 @@ func (c *Controller) handleErr(err error, key interface{}) {
 	l.Log.Info(fmt.Sprintf("Dropping resource %q out of the queue", key), zap.Error(err))
 }
 
-// Run comment
-func (c *Controller) Run(threadiness int, stopCh chan struct{}) {
+// Run starts threadiness workers once the watched caches have synced and
+// blocks until stopCh is closed.  It returns once the items the workers are
+// processing at that time have been finished.
+func (c *Controller) Run(threadiness int, stopCh <-chan struct{}) {
 	defer runtime.HandleCrash()
 
-	// Let the workers stop when we are done
-	defer c.Queue.ShutDown()
-	l.Log.Info("Starting controller")
-
-	go c.Informer.Run(stopCh)
+	l.Log.Info("Starting controller", zap.String("controller", c.Name))
 
 	// Wait for all involved caches to be synced, before processing items from the queue is started
-	if !cache.WaitForCacheSync(stopCh, c.Informer.HasSynced) {
+	if !cache.WaitForCacheSync(stopCh, c.synced...) {
+		c.Queue.ShutDown()
 		runtime.HandleError(fmt.Errorf("Timed out waiting for caches to sync"))
 		return
 	}
 
+	c.processed()
+
+	var wg sync.WaitGroup
 	for i := 0; i < threadiness; i++ {
-		go wait.Until(c.runWorker, time.Second, stopCh)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.runWorker(stopCh)
+		}()
 	}
 
 	<-stopCh
-	l.Log.Info("Stopping controller")
-}
+	l.Log.Info("Stopping controller, waiting for workers to finish")
 
-func (c *Controller) runWorker() {
-	for c.processNextItem() {
-	}
+	// Let the workers stop when we are done
+	c.Queue.ShutDown()
+	wg.Wait()
+	l.Log.Info("Stopped controller")
 }
 
-// Start comment
-func Start(lw cache.ListerWatcher, objType r.Object, worker Worker, resyncPeriod time.Duration) {
-	// create the workqueue
-	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
-
-	// Bind the workqueue to a cache with the help of an informer. This way we make sure that
-	// whenever the cache is updated, the pod key is added to the workqueue.
-	// Note that when we finally process the item from the workqueue, we might see a newer version
-	// of the Pod than the version which was responsible for triggering the update.
-	indexer, informer := cache.NewIndexerInformer(lw, objType, resyncPeriod, cache.ResourceEventHandlerFuncs{
-		AddFunc: func(obj interface{}) {
-			key, err := cache.MetaNamespaceKeyFunc(obj)
-			if err == nil {
-				queue.Add(key)
-			}
-		},
-		UpdateFunc: func(old interface{}, new interface{}) {
-			key, err := cache.MetaNamespaceKeyFunc(new)
-			if err == nil {
-				queue.Add(key)
-			}
-		},
-		DeleteFunc: func(obj interface{}) {
-			// IndexerInformer uses a delta queue, therefore for deletes we have to use this
-			// key function.
-			key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
-			if err == nil {
-				queue.Add(key)
-			}
-		},
-	}, cache.Indexers{})
-
-	controller := &Controller{
-		Indexer:  indexer,
-		Queue:    queue,
-		Informer: informer,
-		Worker:   worker,
+func (c *Controller) runWorker(stopCh <-chan struct{}) {
+	for c.processNextItem(stopCh) {
 	}
-
-	// Now let's start the controller
-	stop := make(chan struct{})
-	defer close(stop)
-	go controller.Run(1, stop)
-
-	// Wait forever
-	select {}
 }
@@ -0,0 +1,123 @@
+package controller
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	fcache "k8s.io/client-go/tools/cache/testing"
+	"k8s.io/client-go/util/workqueue"
+)
+
+type blockingWorker struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingWorker) Work(obj interface{}) error {
+	close(b.started)
+	<-b.release
+	return nil
+}
+
+func TestRunWaitsForInFlightItems(t *testing.T) {
+	source := fcache.NewFakeControllerSource()
+	source.Add(&apiv1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "ns"}})
+	informer := cache.NewSharedIndexInformer(source, &apiv1.Pod{}, 0, cache.Indexers{})
+
+	worker := &blockingWorker{started: make(chan struct{}), release: make(chan struct{})}
+	c := New("test", informer, worker)
+
+	stop := make(chan struct{})
+	go informer.Run(stop)
+
+	stopped := make(chan struct{})
+	go func() {
+		c.Run(1, stop)
+		close(stopped)
+	}()
+
+	select {
+	case <-worker.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker never started")
+	}
+
+	close(stop)
+	select {
+	case <-stopped:
+		t.Fatal("controller stopped before the in-flight item finished")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(worker.release)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("controller did not stop after the in-flight item finished")
+	}
+}
+
+func TestHandleErrRequeueAfter(t *testing.T) {
+	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer queue.ShutDown()
+	c := &Controller{Name: "test", Queue: queue}
+
+	c.handleErr(RequeueAfter(50*time.Millisecond), "ns/name")
+	if queue.Len() != 0 {
+		t.Fatal("item was requeued immediately")
+	}
+	if queue.NumRequeues("ns/name") != 0 {
+		t.Error("requeue after should not count as a failure")
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if queue.Len() != 1 {
+		t.Error("item was not requeued after the delay")
+	}
+}
+
+func TestAliveIgnoresFailures(t *testing.T) {
+	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer queue.ShutDown()
+	c := &Controller{Name: "test", Queue: queue}
+	stalled := time.Now().Add(-time.Hour)
+	c.lastProcessed = stalled
+
+	queue.Add("ns/other")
+	c.handleErr(fmt.Errorf("failed"), "ns/name")
+	if !c.lastProcessed.Equal(stalled) {
+		t.Error("a failure counted as progress")
+	}
+	if err := c.Alive(); err == nil {
+		t.Error("workers that only fail are alive")
+	}
+
+	c.handleErr(RequeueAfter(time.Minute), "ns/name")
+	if err := c.Alive(); err != nil {
+		t.Errorf("a requeue after didn't count as progress: %v", err)
+	}
+}
+
+func TestAliveDetectsWedgedWorker(t *testing.T) {
+	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer queue.ShutDown()
+	c := &Controller{Name: "test", Queue: queue}
+	c.processed()
+
+	done := c.start("ns/name")
+	if err := c.Alive(); err != nil {
+		t.Errorf("a worker that just started is wedged: %v", err)
+	}
+	c.inFlight["ns/name"] = time.Now().Add(-time.Hour)
+	if err := c.Alive(); err == nil {
+		t.Error("a wedged worker with an empty queue is alive")
+	}
+	done()
+	if err := c.Alive(); err != nil {
+		t.Errorf("a finished worker is wedged: %v", err)
+	}
+}
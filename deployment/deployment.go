@@ -1,35 +1,72 @@
 package deployment
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"time"
 
 	v1 "github.com/openshift/api/apps/v1"
+	imagev1 "github.com/openshift/api/image/v1"
 	appsv1 "github.com/openshift/client-go/apps/clientset/versioned/typed/apps/v1"
+	"github.com/redhatinsights/miniop/baseline"
+	"github.com/redhatinsights/miniop/budget"
 	"github.com/redhatinsights/miniop/client"
 	ctl "github.com/redhatinsights/miniop/controller"
 	l "github.com/redhatinsights/miniop/logger"
+	"github.com/redhatinsights/miniop/pod"
+	"github.com/redhatinsights/miniop/policy"
+	"github.com/redhatinsights/miniop/schedule"
+	"github.com/redhatinsights/miniop/signature"
+	"github.com/redhatinsights/miniop/stop"
+	"github.com/spf13/viper"
 	"go.uber.org/zap"
 	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
 )
 
 func init() {
 	l.InitLogger()
+	viper.SetDefault("DEPLOYMENTCONFIG_WORKERS", 1)
 }
 
 type DeploymentWorker struct {
-	deploymentsClient *appsv1.AppsV1Client
-	clientset         *kubernetes.Clientset
+	deploymentsClient appsv1.AppsV1Interface
+	clientset         kubernetes.Interface
+	informers         *client.Informers
+	pods              cache.Indexer
+	stablePods        corelisters.PodLister
+	imageStreams      cache.Indexer
+	emergencyStop     *stop.Switch
+	imagePolicy       *policy.Policy
+	verifier          *signature.Verifier
 }
 
-func NewDeploymentWorker() *DeploymentWorker {
-	return &DeploymentWorker{
-		deploymentsClient: appsv1.NewForConfigOrDie(client.Config),
+func NewDeploymentWorker(informers *client.Informers) *DeploymentWorker {
+	verifier, err := signature.FromConfig()
+	if err != nil {
+		l.Log.Panic("failed to configure signature verification", zap.Error(err))
+	}
+
+	d := &DeploymentWorker{
+		deploymentsClient: client.AppsClientset.AppsV1(),
 		clientset:         client.Clientset,
+		informers:         informers,
+		pods:              informers.CanaryPods.Informer().GetIndexer(),
+		stablePods:        informers.StablePods.Lister(),
+		emergencyStop:     stop.New(informers),
+		imagePolicy:       policy.New(informers),
+		verifier:          verifier,
 	}
+	if informers.ImageStreams != nil {
+		d.imageStreams = informers.ImageStreams.GetIndexer()
+	}
+	return d
 }
 
 func (d *DeploymentWorker) Work(obj interface{}) error {
@@ -37,48 +74,116 @@ func (d *DeploymentWorker) Work(obj interface{}) error {
 	if !ok {
 		return fmt.Errorf("type was unexpected")
 	}
-	d.checkDeploymentConfig(dc)
-	return nil
+	return d.checkDeploymentConfig(dc)
 }
 
-// Start executes the watch loop
-func (d *DeploymentWorker) Start() {
+// Start executes the watch loop until ctx is done
+func (d *DeploymentWorker) Start(ctx context.Context) {
+	c := ctl.New("deploymentconfig", d.informers.DeploymentConfigs.Informer(), d)
 
-	dcListerWatcher := cache.NewFilteredListWatchFromClient(
-		d.deploymentsClient.RESTClient(),
-		"deploymentconfigs",
-		client.Namespace,
-		func(opts *metav1.ListOptions) {
-			opts.LabelSelector = "canary=true"
+	// canary pod events are handled by the deploymentconfig they belong to
+	c.Watch(d.informers.CanaryPods.Informer(), func(obj interface{}) []string {
+		pod, ok := obj.(*apiv1.Pod)
+		if !ok {
+			return nil
+		}
+		canaryFor, ok := pod.Labels["canary-for"]
+		if !ok {
+			return nil
+		}
+		return []string{fmt.Sprintf("%s/%s", pod.GetNamespace(), canaryFor)}
+	})
+	// moving a tag affects the deploymentconfigs following it
+	if d.informers.ImageStreams != nil {
+		c.Watch(d.informers.ImageStreams, func(obj interface{}) []string {
+			is, ok := obj.(*imagev1.ImageStream)
+			if !ok {
+				return nil
+			}
+			dcs, err := c.Indexer.ByIndex(client.CanaryFromIndex, is.GetName())
+			if err != nil {
+				return nil
+			}
+			keys := make([]string, 0, len(dcs))
+			for _, dc := range dcs {
+				if key, err := cache.MetaNamespaceKeyFunc(dc); err == nil {
+					keys = append(keys, key)
+				}
+			}
+			return keys
+		})
+	}
+	d.emergencyStop.Watch(c)
+	// the baseline is read from the stable pod cache
+	c.WaitFor(d.informers.StablePods.Informer())
+	// deleted deploymentconfigs never reach the worker, their error budget
+	// and schedule are forgotten here
+	d.informers.DeploymentConfigs.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if dc, ok := obj.(*v1.DeploymentConfig); ok {
+				budget.Forget(dc.GetName())
+				schedule.Forget(dc.GetName())
+			}
 		},
-	)
+	})
+
+	// the error budgets are exported on their own schedule, Gate only sees
+	// them when a canary is about to start
+	go wait.Until(func() { refreshBudgets(c.Indexer) }, viper.GetDuration("BUDGET_INTERVAL"), ctx.Done())
 
 	l.Log.Info("starting dc watcher")
-	ctl.Start(dcListerWatcher, &v1.DeploymentConfig{}, d, 0)
+	c.Run(viper.GetInt("DEPLOYMENTCONFIG_WORKERS"), ctx.Done())
+}
+
+// refreshBudgets exports the error budget of every deploymentconfig in dcs
+// with an SLO
+func refreshBudgets(dcs cache.Indexer) {
+	now := time.Now()
+	for _, obj := range dcs.List() {
+		dc, ok := obj.(*v1.DeploymentConfig)
+		if !ok || dc.Annotations[budget.Annotation] == "" {
+			continue
+		}
+		if err := budget.Refresh(dc, now); err != nil {
+			l.Log.Error("failed to refresh the error budget", zap.Error(err), zap.String("deploymentconfig", dc.GetName()))
+		}
+	}
 }
 
 // NothingToDo is returned as an error if a deployment is up to date
 var NothingToDo = errors.New("nothing to do")
 
-func shouldSpawn(dc *v1.DeploymentConfig) ([]apiv1.Container, error) {
+func shouldSpawn(dc *v1.DeploymentConfig, imagePolicy *policy.Policy) ([]apiv1.Container, error) {
 	_, ok := dc.Annotations["canary-pod"]
 	if ok {
 		l.Log.Debug(fmt.Sprintf("a canary pod for %s already exists", dc.Name), zap.String("deploymentconfig", dc.Name))
 		return nil, NothingToDo
 	}
 
-	failedImage, ok := dc.Annotations["canary-fail"]
-	if ok {
-		l.Log.Debug("a canary deployment has failed for this deploymentconfig, clear the annotations and try again",
-			zap.String("deploymentconfig", dc.GetName()), zap.String("failed", failedImage))
-		return nil, NothingToDo
-	}
-
 	name, image, err := getNameAndImage(*dc)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := imagePolicy.Check(dc, image); err != nil {
+		return nil, err
+	}
+
+	// a failure only holds back the image that failed, an image rejected by
+	// the policy is tried again as soon as the policy allows it
+	if failedImage, ok := dc.Annotations["canary-fail"]; ok && failedImage == image && dc.Annotations["canary-fail-reason"] != policy.Reason {
+		if err := retryFailed(dc, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := debounce(dc, time.Now()); err != nil {
+		return nil, err
+	}
+
 	containers := dc.Spec.Template.Spec.Containers
 
 	idx, err := findImage(name, containers)
@@ -95,22 +200,86 @@ func shouldSpawn(dc *v1.DeploymentConfig) ([]apiv1.Container, error) {
 	return newContainers, nil
 }
 
-func (d *DeploymentWorker) checkDeploymentConfig(dc *v1.DeploymentConfig) {
+func (d *DeploymentWorker) checkDeploymentConfig(dc *v1.DeploymentConfig) error {
 
-	containers, err := shouldSpawn(dc)
-	if err != nil {
-		return
+	if changed, err := d.reconcile(dc); err != nil {
+		return err
+	} else if changed {
+		return nil
 	}
 
-	podName, err := d.spawnCanary(*dc, containers)
-	if err == nil {
-		dc.Annotations["canary-pod"] = podName
-		d.deploymentsClient.DeploymentConfigs(client.Namespace).Update(dc)
+	if changed, err := d.followTag(dc); err != nil {
+		return err
+	} else if changed {
+		return nil
+	}
+
+	containers, err := shouldSpawn(dc, d.imagePolicy)
+	if violation, ok := err.(*policy.Violation); ok {
+		return d.reject(dc, violation)
 	} else if err == NothingToDo {
 		l.Log.Debug("deploymentconfig appears to be up to date", zap.String("deploymentconfig", dc.GetName()))
-	} else {
+		return nil
+	} else if after, ok := err.(ctl.RequeueAfter); ok {
+		return after
+	} else if err != nil {
+		// missing or invalid annotations won't be fixed by retrying
+		l.Log.Debug("not spawning a canary", zap.String("deploymentconfig", dc.GetName()), zap.Error(err))
+		return nil
+	}
+
+	if engaged, reason := d.emergencyStop.Engaged(); engaged {
+		// releasing the stop requeues the deploymentconfig
+		stop.Suppressed("spawn", dc.GetName(), reason)
+		return nil
+	}
+
+	dc, err = schedule.Gate(d.deploymentsClient.DeploymentConfigs(client.Namespace), dc, schedule.Spawn, time.Now())
+	if err != nil {
+		return err
+	}
+
+	dc, err = budget.Gate(d.deploymentsClient.DeploymentConfigs(client.Namespace), dc, time.Now())
+	if err != nil {
+		return err
+	}
+
+	dc, err = baseline.Gate(d.deploymentsClient.DeploymentConfigs(client.Namespace), d.stablePods, dc)
+	if err != nil {
+		return err
+	}
+
+	if err := d.verifier.Verify(dc.Annotations["canary-image"]); err != nil {
+		if failure, ok := err.(*signature.Failure); ok {
+			return d.failVerification(dc, failure)
+		}
+		return fmt.Errorf("failed to verify signature: %v", err)
+	}
+
+	podName, err := d.spawnCanary(*dc, containers)
+	if err == errCanaryTerminating {
+		// deleting the pod requeues the deploymentconfig
+		l.Log.Debug("waiting for previous canary pod to terminate", zap.String("deploymentconfig", dc.GetName()))
+		return nil
+	} else if err != nil {
 		l.Log.Error("failed to spawn canary", zap.Error(err))
+		return err
 	}
+
+	image := dc.Annotations["canary-image"]
+	_, err = client.UpdateDeploymentConfig(d.deploymentsClient.DeploymentConfigs(client.Namespace), dc, func(dc *v1.DeploymentConfig) error {
+		dc.Annotations["canary-pod"] = podName
+		if failed, ok := dc.Annotations["canary-fail"]; ok && (failed != image || dc.Annotations["canary-fail-reason"] == policy.Reason) {
+			// the failure record of an older image or of a policy that
+			// changed since no longer applies
+			pod.ClearFailure(dc)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record canary pod %s: %v", podName, err)
+	}
+	return nil
 }
 
 func getNameAndImage(dc v1.DeploymentConfig) (string, string, error) {
@@ -153,22 +322,43 @@ func updateObjectMeta(objMeta *metav1.ObjectMeta, dc *v1.DeploymentConfig) {
 	}
 	objMeta.Annotations["canary-duration"] = duration
 
-	objMeta.SetGenerateName(fmt.Sprintf("%s-canary-", dc.GetName()))
+	// a fixed name lets the API server guarantee a single canary per
+	// deploymentconfig
+	objMeta.SetGenerateName("")
+	objMeta.SetName(canaryName(dc))
+
+	// the canary is garbage collected along with its deploymentconfig
+	objMeta.OwnerReferences = []metav1.OwnerReference{{
+		APIVersion: v1.SchemeGroupVersion.String(),
+		Kind:       "DeploymentConfig",
+		Name:       dc.GetName(),
+		UID:        dc.GetUID(),
+	}}
+}
+
+// errCanaryTerminating is returned by spawnCanary while the previous canary
+// pod is still being deleted
+var errCanaryTerminating = errors.New("previous canary pod is terminating")
+
+func canaryName(dc *v1.DeploymentConfig) string {
+	return fmt.Sprintf("%s-canary", dc.GetName())
 }
 
+// spawnCanary creates the canary pod for dc and returns its name.  There is
+// at most one canary per deploymentconfig: an existing canary is adopted
+// instead, even if creating it was never recorded in the canary-pod
+// annotation or it hasn't made it into the cache yet.
 func (d *DeploymentWorker) spawnCanary(dc v1.DeploymentConfig, containers []apiv1.Container) (string, error) {
 	podTemplateSpec := dc.Spec.Template.DeepCopy()
 	podTemplateSpec.Spec.Containers = containers
 
-	pods, err := d.clientset.CoreV1().Pods(client.Namespace).List(metav1.ListOptions{
-		LabelSelector: fmt.Sprintf("canary=%s", dc.GetName()),
-	})
+	pods, err := d.pods.ByIndex(client.CanaryForIndex, dc.GetName())
 	if err != nil {
 		return "", fmt.Errorf("Failed to search for pods: %v", err)
 	}
 
-	if len(pods.Items) > 0 {
-		return "", fmt.Errorf("A canary for this (%s) deployment already exists", dc.GetName())
+	if len(pods) > 0 {
+		return adopt(pods[0].(*apiv1.Pod), &dc)
 	}
 
 	l.Log.Debug("incoming dc", zap.Reflect("deploymentconfig", dc))
@@ -185,9 +375,26 @@ func (d *DeploymentWorker) spawnCanary(dc v1.DeploymentConfig, containers []apiv
 	l.Log.Debug("pod definition", zap.Reflect("pod", podDef))
 
 	pod, err := d.clientset.CoreV1().Pods(client.Namespace).Create(podDef)
-	if err != nil {
+	if k8serrors.IsAlreadyExists(err) {
+		existing, err := d.clientset.CoreV1().Pods(client.Namespace).Get(podDef.GetName(), metav1.GetOptions{})
+		if err != nil {
+			return "", fmt.Errorf("Failed to fetch existing canary pod: %v", err)
+		}
+		return adopt(existing, &dc)
+	} else if err != nil {
 		return "", fmt.Errorf("Failed to create pod: %v", err)
 	}
 
 	return pod.Name, nil
 }
+
+// adopt returns the name of an existing canary pod so it is recorded in the
+// canary-pod annotation instead of creating another one
+func adopt(pod *apiv1.Pod, dc *v1.DeploymentConfig) (string, error) {
+	if pod.GetDeletionTimestamp() != nil {
+		return "", errCanaryTerminating
+	}
+	l.Log.Info(fmt.Sprintf("adopting existing canary pod %s", pod.GetName()),
+		zap.String("deploymentconfig", dc.GetName()), zap.String("pod", pod.GetName()))
+	return pod.GetName(), nil
+}
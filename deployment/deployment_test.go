@@ -1,14 +1,41 @@
 package deployment
 
 import (
+	"bytes"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	v1 "github.com/openshift/api/apps/v1"
+	imagev1 "github.com/openshift/api/image/v1"
+	"github.com/redhatinsights/miniop/baseline"
+	"github.com/redhatinsights/miniop/budget"
+	"github.com/redhatinsights/miniop/client"
+	"github.com/redhatinsights/miniop/client/fake"
+	ctl "github.com/redhatinsights/miniop/controller"
+	"github.com/redhatinsights/miniop/history"
+	"github.com/redhatinsights/miniop/policy"
+	"github.com/redhatinsights/miniop/signature"
+	"github.com/redhatinsights/miniop/stop"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
 	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
 )
 
+func init() {
+	client.Namespace = "test"
+}
+
 var dc = &v1.DeploymentConfig{
 	ObjectMeta: metav1.ObjectMeta{
 		Labels: map[string]string{
@@ -22,6 +49,11 @@ var dc = &v1.DeploymentConfig{
 	},
 	Spec: v1.DeploymentConfigSpec{
 		Template: &apiv1.PodTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{
+				Labels: map[string]string{
+					"deploymentconfig": "testing",
+				},
+			},
 			Spec: apiv1.PodSpec{
 				Containers: []apiv1.Container{
 					apiv1.Container{
@@ -35,7 +67,7 @@ var dc = &v1.DeploymentConfig{
 }
 
 func TestShouldSpawn(t *testing.T) {
-	if _, err := shouldSpawn(dc); err != nil {
+	if _, err := shouldSpawn(dc, nil); err != nil {
 		fmt.Printf("error: %+v\n", err)
 		t.Fail()
 	}
@@ -44,7 +76,7 @@ func TestShouldSpawn(t *testing.T) {
 func TestShouldNotSpawnBlank(t *testing.T) {
 	dc := &v1.DeploymentConfig{}
 
-	if _, err := shouldSpawn(dc); err == nil {
+	if _, err := shouldSpawn(dc, nil); err == nil {
 		t.Fail()
 	}
 }
@@ -56,7 +88,7 @@ func TestFailedCanaryShouldNotSpawn(t *testing.T) {
 	}
 	dc.SetAnnotations(anns)
 
-	if _, err := shouldSpawn(dc); err == nil {
+	if _, err := shouldSpawn(dc, nil); err == nil {
 		t.Fail()
 	}
 }
@@ -68,7 +100,7 @@ func TestCanaryAlreadySpawned(t *testing.T) {
 	}
 	dc.SetAnnotations(anns)
 
-	if _, err := shouldSpawn(dc); err == nil {
+	if _, err := shouldSpawn(dc, nil); err == nil {
 		t.Fail()
 	}
 }
@@ -144,4 +176,454 @@ func TestUpdateObjectMetaDefault(t *testing.T) {
 	if objMeta.Annotations["canary-duration"] != "15m" {
 		t.Fail()
 	}
+	if len(objMeta.OwnerReferences) != 1 || objMeta.OwnerReferences[0].Name != "testing" {
+		t.Errorf("canary is not owned by its deploymentconfig: %v", objMeta.OwnerReferences)
+	}
+}
+
+func newWorker(apps *fake.Apps, pods ...*apiv1.Pod) *DeploymentWorker {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{client.CanaryForIndex: client.CanaryForIndexFunc})
+	for _, pod := range pods {
+		indexer.Add(pod)
+	}
+	return &DeploymentWorker{
+		deploymentsClient: apps,
+		clientset:         kubefake.NewSimpleClientset(),
+		pods:              indexer,
+		stablePods:        corelisters.NewPodLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})),
+		imageStreams:      cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}),
+	}
+}
+
+func TestCheckDeploymentConfigConflict(t *testing.T) {
+	apps := fake.NewApps(dc)
+	stale := apps.Stored(dc.GetName())
+	// an image trigger updates the deploymentconfig after it was read
+	apps.Modify(dc.GetName(), func(dc *v1.DeploymentConfig) {
+		dc.Annotations["concurrent"] = "true"
+	})
+
+	d := newWorker(apps)
+	if err := d.checkDeploymentConfig(stale); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	updated := apps.Stored(dc.GetName())
+	if _, ok := updated.Annotations["canary-pod"]; !ok {
+		t.Error("canary-pod annotation was not recorded")
+	}
+	if updated.Annotations["concurrent"] != "true" {
+		t.Error("concurrent change was clobbered")
+	}
+}
+
+func TestCheckDeploymentConfigUpdateError(t *testing.T) {
+	apps := fake.NewApps(dc)
+	apps.UpdateError = errors.NewInternalError(fmt.Errorf("boom"))
+
+	d := newWorker(apps)
+	if err := d.checkDeploymentConfig(apps.Stored(dc.GetName())); err == nil {
+		t.Error("expected the update error to be returned so the key is requeued")
+	}
+}
+
+func TestExistingCanaryNotDuplicated(t *testing.T) {
+	apps := fake.NewApps(dc)
+	existing := &apiv1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name:   "testing-canary-abcde",
+		Labels: map[string]string{"canary": "true", "canary-for": "testing"},
+	}}
+	d := newWorker(apps, existing)
+
+	if err := d.checkDeploymentConfig(apps.Stored(dc.GetName())); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if pod := apps.Stored(dc.GetName()).Annotations["canary-pod"]; pod != existing.GetName() {
+		t.Errorf("existing canary was not adopted, canary-pod is %q", pod)
+	}
+	if canaries(t, d) != 0 {
+		t.Error("a second canary pod was created")
+	}
+}
+
+func TestTerminatingCanaryNotAdopted(t *testing.T) {
+	apps := fake.NewApps(dc)
+	now := metav1.Now()
+	terminating := &apiv1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name:              "testing-canary",
+		Labels:            map[string]string{"canary": "true", "canary-for": "testing"},
+		DeletionTimestamp: &now,
+	}}
+	d := newWorker(apps, terminating)
+
+	if err := d.checkDeploymentConfig(apps.Stored(dc.GetName())); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if apps.Updates() != 0 {
+		t.Error("deployment should not have been updated")
+	}
+	if canaries(t, d) != 0 {
+		t.Error("a canary pod was created while the previous one terminates")
+	}
+}
+
+func TestCanaryNotDuplicatedAfterFailedAnnotation(t *testing.T) {
+	apps := fake.NewApps(dc)
+	apps.UpdateError = errors.NewInternalError(fmt.Errorf("boom"))
+
+	d := newWorker(apps)
+	if err := d.checkDeploymentConfig(apps.Stored(dc.GetName())); err == nil {
+		t.Fatal("expected the update error to be returned")
+	}
+
+	// a restarted miniop with nothing in its cache yet
+	apps.UpdateError = nil
+	restarted := newWorker(apps)
+	restarted.clientset = d.clientset
+	if err := restarted.checkDeploymentConfig(apps.Stored(dc.GetName())); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if n := canaries(t, d); n != 1 {
+		t.Errorf("expected a single canary pod, found %d", n)
+	}
+	if pod := apps.Stored(dc.GetName()).Annotations["canary-pod"]; pod != "testing-canary" {
+		t.Errorf("canary was not recorded, canary-pod is %q", pod)
+	}
+}
+
+func canaries(t *testing.T, d *DeploymentWorker) int {
+	pods, err := d.clientset.CoreV1().Pods(client.Namespace).List(metav1.ListOptions{LabelSelector: "canary-for=testing"})
+	if err != nil {
+		t.Fatalf("failed to list pods: %v", err)
+	}
+	return len(pods.Items)
+}
+
+func TestDanglingCanaryPodCleared(t *testing.T) {
+	dangling := dc.DeepCopy()
+	dangling.Annotations["canary-pod"] = "testing-canary-gone"
+	dangling.Annotations["canary-phase"] = "promoting"
+	dangling.Annotations["canary-promoted-tag"] = "test/bar:latest"
+	apps := fake.NewApps(dangling)
+	d := newWorker(apps)
+
+	if err := d.checkDeploymentConfig(apps.Stored(dc.GetName())); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, annotation := range []string{"canary-pod", "canary-phase", "canary-promoted-tag"} {
+		if _, ok := apps.Stored(dc.GetName()).Annotations[annotation]; ok {
+			t.Errorf("dangling canary-pod left %s behind", annotation)
+		}
+	}
+}
+
+func failed(image string, annotations map[string]string) *v1.DeploymentConfig {
+	failed := dc.DeepCopy()
+	failed.Annotations["canary-fail"] = image
+	failed.Annotations["canary-fail-reason"] = "restarts"
+	for k, v := range annotations {
+		failed.Annotations[k] = v
+	}
+	return failed
+}
+
+func TestNewImageSupersedesFailure(t *testing.T) {
+	apps := fake.NewApps(failed("barv1.5", map[string]string{"canary-fail-count": "1"}))
+	d := newWorker(apps)
+
+	if err := d.checkDeploymentConfig(apps.Stored(dc.GetName())); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	updated := apps.Stored(dc.GetName())
+	if _, ok := updated.Annotations["canary-pod"]; !ok {
+		t.Error("no canary was started for the new image")
+	}
+	for _, ann := range []string{"canary-fail", "canary-fail-reason", "canary-fail-count"} {
+		if _, ok := updated.Annotations[ann]; ok {
+			t.Errorf("%s of the superseded image was not cleared", ann)
+		}
+	}
+}
+
+func TestFailedImageNotRetriedByDefault(t *testing.T) {
+	if _, err := shouldSpawn(failed("barv2", nil), nil); err != NothingToDo {
+		t.Errorf("expected NothingToDo, got %v", err)
+	}
+}
+
+func TestFailedImageRetryBackoff(t *testing.T) {
+	ago := func(d time.Duration) string {
+		return time.Now().Add(-d).UTC().Format(time.RFC3339)
+	}
+
+	tests := []struct {
+		name     string
+		count    string
+		failedAt string
+		requeue  bool
+		spawn    bool
+	}{
+		{"backing off", "1", ago(time.Minute), true, false},
+		{"backed off", "1", ago(6 * time.Minute), false, true},
+		{"backoff doubles", "2", ago(6 * time.Minute), true, false},
+		{"doubled backoff passed", "2", ago(11 * time.Minute), false, true},
+		{"retries used up", "3", ago(time.Hour), false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dc := failed("barv2", map[string]string{
+				"canary-retries":    "2",
+				"canary-fail-count": test.count,
+				"canary-fail-time":  test.failedAt,
+			})
+			_, err := shouldSpawn(dc, nil)
+			_, requeue := err.(ctl.RequeueAfter)
+			if requeue != test.requeue {
+				t.Errorf("expected requeue %v, got %v", test.requeue, err)
+			}
+			if spawn := err == nil; spawn != test.spawn {
+				t.Errorf("expected spawn %v, got %v", test.spawn, err)
+			}
+		})
+	}
+}
+
+func TestSupersededCanaryDebounced(t *testing.T) {
+	superseded := dc.DeepCopy()
+	superseded.Annotations["canary-debounce"] = "2m"
+	history.Record(superseded, history.Entry{Image: "barv1.5", Outcome: "superseded"})
+
+	if _, err := shouldSpawn(superseded, nil); err == nil {
+		t.Error("expected the new canary to be held back")
+	} else if _, ok := err.(ctl.RequeueAfter); !ok {
+		t.Errorf("expected a requeue, got %v", err)
+	}
+
+	delete(superseded.Annotations, "canary-debounce")
+	if _, err := shouldSpawn(superseded, nil); err != nil {
+		t.Errorf("without a debounce window the canary should spawn right away: %v", err)
+	}
+}
+
+func TestEmergencyStopSuppressesSpawn(t *testing.T) {
+	factory := informers.NewSharedInformerFactory(kubefake.NewSimpleClientset(), 0)
+	configMaps := factory.Core().V1().ConfigMaps().Informer()
+	configMaps.GetIndexer().Add(&apiv1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "miniop", Namespace: client.Namespace},
+		Data:       map[string]string{stop.Key: "true"},
+	})
+
+	apps := fake.NewApps(dc)
+	d := newWorker(apps)
+	d.emergencyStop = stop.NewSwitch(configMaps, factory.Core().V1().Namespaces().Informer())
+
+	if err := d.checkDeploymentConfig(apps.Stored(dc.GetName())); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if canaries(t, d) != 0 {
+		t.Error("a canary was started during an emergency stop")
+	}
+}
+
+func imageStream(items ...imagev1.TagEvent) *imagev1.ImageStream {
+	return &imagev1.ImageStream{
+		ObjectMeta: metav1.ObjectMeta{Name: "myapp", Namespace: client.Namespace},
+		Status: imagev1.ImageStreamStatus{Tags: []imagev1.NamedTagEventList{
+			{Tag: "latest", Items: items},
+		}},
+	}
+}
+
+func TestTagMoveSetsCanaryImage(t *testing.T) {
+	following := dc.DeepCopy()
+	following.Annotations["canary-from"] = "myapp:latest"
+	apps := fake.NewApps(following)
+	d := newWorker(apps)
+	d.imageStreams.Add(imageStream(
+		imagev1.TagEvent{DockerImageReference: "registry:5000/test/myapp@sha256:new", Image: "sha256:new"},
+		imagev1.TagEvent{DockerImageReference: "registry:5000/test/myapp@sha256:old", Image: "sha256:old"},
+	))
+
+	if err := d.checkDeploymentConfig(apps.Stored(dc.GetName())); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if image := apps.Stored(dc.GetName()).Annotations["canary-image"]; image != "registry:5000/test/myapp@sha256:new" {
+		t.Errorf("canary-image does not follow the tag, got %q", image)
+	}
+
+	// the update requeues the deploymentconfig, which then starts the canary
+	if err := d.checkDeploymentConfig(apps.Stored(dc.GetName())); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if canaries(t, d) != 1 {
+		t.Error("no canary was started for the new image")
+	}
+}
+
+func TestCanaryFromWithoutImageStreams(t *testing.T) {
+	following := dc.DeepCopy()
+	following.Annotations["canary-from"] = "myapp:latest"
+	apps := fake.NewApps(following)
+	d := newWorker(apps)
+	d.imageStreams = nil
+
+	if err := d.checkDeploymentConfig(apps.Stored(dc.GetName())); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if image := apps.Stored(dc.GetName()).Annotations["canary-image"]; image != following.Annotations["canary-image"] {
+		t.Errorf("canary-image changed to %q without imagestreams", image)
+	}
+}
+
+func TestResolveTag(t *testing.T) {
+	tests := []struct {
+		event imagev1.TagEvent
+		image string
+	}{
+		{imagev1.TagEvent{DockerImageReference: "quay.io/org/app@sha256:abc", Image: "sha256:abc"}, "quay.io/org/app@sha256:abc"},
+		{imagev1.TagEvent{DockerImageReference: "registry:5000/org/app:v2", Image: "sha256:abc"}, "registry:5000/org/app@sha256:abc"},
+		{imagev1.TagEvent{DockerImageReference: "registry:5000/org/app", Image: "sha256:abc"}, "registry:5000/org/app@sha256:abc"},
+	}
+
+	for _, test := range tests {
+		if image, ok := client.ResolveTag(imageStream(test.event), "latest"); !ok || image != test.image {
+			t.Errorf("expected %q, got %q", test.image, image)
+		}
+	}
+	if _, ok := client.ResolveTag(imageStream(), "latest"); ok {
+		t.Error("a tag without images should not resolve")
+	}
+	if _, ok := client.ResolveTag(imageStream(tests[0].event), "other"); ok {
+		t.Error("an unknown tag should not resolve")
+	}
+}
+
+func TestPolicyRejectsImage(t *testing.T) {
+	namespaces := informers.NewSharedInformerFactory(kubefake.NewSimpleClientset(), 0).Core().V1().Namespaces().Informer()
+	ns := &apiv1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:        client.Namespace,
+		Annotations: map[string]string{policy.RepositoriesAnnotation: "quay.io/myorg"},
+	}}
+	namespaces.GetIndexer().Add(ns)
+
+	apps := fake.NewApps(dc)
+	d := newWorker(apps)
+	d.imagePolicy = policy.NewPolicy(namespaces)
+
+	if err := d.checkDeploymentConfig(apps.Stored(dc.GetName())); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if canaries(t, d) != 0 {
+		t.Error("a canary was started for a disallowed image")
+	}
+	rejected := apps.Stored(dc.GetName())
+	if rejected.Annotations["canary-fail"] != "barv2" || rejected.Annotations["canary-fail-reason"] != policy.Reason {
+		t.Errorf("policy violation was not recorded: %v", rejected.Annotations)
+	}
+	if last, _ := history.Last(rejected); last.Outcome != "rejected" {
+		t.Errorf("rejection was not recorded in the history: %v", last)
+	}
+
+	// relaxing the policy starts the canary
+	ns = ns.DeepCopy()
+	ns.Annotations[policy.RepositoriesAnnotation] = "quay.io/myorg, barv2"
+	namespaces.GetIndexer().Update(ns)
+
+	if err := d.checkDeploymentConfig(rejected); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if canaries(t, d) != 1 {
+		t.Error("no canary was started once the policy allowed the image")
+	}
+	if _, ok := apps.Stored(dc.GetName()).Annotations["canary-fail"]; ok {
+		t.Error("policy violation was not cleared")
+	}
+}
+
+func TestUnsignedImageFailsCanary(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	entity, err := openpgp.NewEntity("release", "", "release@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys bytes.Buffer
+	w, _ := armor.Encode(&keys, openpgp.PublicKeyType, nil)
+	entity.Serialize(w)
+	w.Close()
+
+	signed := dc.DeepCopy()
+	signed.Annotations["canary-image"] = "quay.io/myorg/myapp@sha256:0123"
+	apps := fake.NewApps(signed)
+	d := newWorker(apps)
+	if d.verifier, err = signature.NewVerifier(srv.URL, keys.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.checkDeploymentConfig(apps.Stored(dc.GetName())); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if canaries(t, d) != 0 {
+		t.Error("a canary was started for an unsigned image")
+	}
+	updated := apps.Stored(dc.GetName())
+	if updated.Annotations["canary-fail"] != "quay.io/myorg/myapp@sha256:0123" || updated.Annotations["canary-fail-reason"] != signature.Reason {
+		t.Errorf("signature failure was not recorded: %v", updated.Annotations)
+	}
+}
+
+func TestSpentErrorBudgetHoldsBackCanary(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := "100"
+		if strings.HasPrefix(r.URL.Query().Get("query"), "good") {
+			value = "50"
+		}
+		fmt.Fprintf(w, `{"status": "success", "data": {"resultType": "vector", "result": [{"metric": {}, "value": [0, %q]}]}}`, value)
+	}))
+	defer srv.Close()
+	viper.Set("PROMETHEUS_URL", srv.URL)
+	defer viper.Set("PROMETHEUS_URL", "")
+
+	spent := dc.DeepCopy()
+	spent.Annotations[budget.Annotation] = `{"good": "good", "total": "total", "objective": 0.999}`
+	apps := fake.NewApps(spent)
+	d := newWorker(apps)
+
+	if _, ok := d.checkDeploymentConfig(apps.Stored(dc.GetName())).(ctl.RequeueAfter); !ok {
+		t.Error("expected the deploymentconfig to be checked again later")
+	}
+	if canaries(t, d) != 0 {
+		t.Error("a canary was started with a spent error budget")
+	}
+	if _, ok := apps.Stored(dc.GetName()).Annotations[budget.BlockedAnnotation]; !ok {
+		t.Error("blocked canary was not recorded")
+	}
+}
+
+func TestUnhealthyBaselineHoldsBackCanary(t *testing.T) {
+	apps := fake.NewApps(dc)
+	d := newWorker(apps)
+	stablePods := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	stablePods.Add(&apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "testing-1-a",
+			Namespace: client.Namespace,
+			Labels:    map[string]string{"deploymentconfig": "testing"},
+		},
+		Status: apiv1.PodStatus{Phase: apiv1.PodRunning},
+	})
+	d.stablePods = corelisters.NewPodLister(stablePods)
+
+	if _, ok := d.checkDeploymentConfig(apps.Stored(dc.GetName())).(ctl.RequeueAfter); !ok {
+		t.Error("expected the deploymentconfig to be checked again later")
+	}
+	if canaries(t, d) != 0 {
+		t.Error("a canary was started next to an unhealthy baseline")
+	}
+	if reason := apps.Stored(dc.GetName()).Annotations[baseline.UnhealthyAnnotation]; reason != "stable pods not ready: testing-1-a" {
+		t.Errorf("unhealthy baseline was not recorded: %q", reason)
+	}
 }
@@ -0,0 +1,57 @@
+package deployment
+
+import (
+	"fmt"
+
+	v1 "github.com/openshift/api/apps/v1"
+	imagev1 "github.com/openshift/api/image/v1"
+	"github.com/redhatinsights/miniop/client"
+	l "github.com/redhatinsights/miniop/logger"
+	"go.uber.org/zap"
+)
+
+// followTag points canary-image at the image the imagestream tag in the
+// canary-from annotation currently resolves to.  Moving the tag starts a
+// canary for the new image.  It returns true if the deploymentconfig was
+// changed, the update will requeue it.  Without access to imagestreams the
+// annotation is ignored.
+func (d *DeploymentWorker) followTag(dc *v1.DeploymentConfig) (bool, error) {
+	stream, tag, ok := client.SplitImageStreamTag(dc.Annotations["canary-from"])
+	if !ok {
+		return false, nil
+	}
+	if d.imageStreams == nil {
+		l.Log.Warn("canary-from is ignored, miniop may not watch imagestreams", zap.String("deploymentconfig", dc.GetName()))
+		return false, nil
+	}
+
+	obj, exists, err := d.imageStreams.GetByKey(fmt.Sprintf("%s/%s", client.Namespace, stream))
+	if err != nil {
+		return false, err
+	} else if !exists {
+		// the imagestream requeues the deploymentconfig once it shows up
+		l.Log.Debug(fmt.Sprintf("imagestream %s not found", stream), zap.String("deploymentconfig", dc.GetName()))
+		return false, nil
+	}
+
+	image, ok := client.ResolveTag(obj.(*imagev1.ImageStream), tag)
+	if !ok {
+		l.Log.Debug(fmt.Sprintf("imagestream tag %s:%s has no image yet", stream, tag), zap.String("deploymentconfig", dc.GetName()))
+		return false, nil
+	}
+	if dc.Annotations["canary-image"] == image {
+		return false, nil
+	}
+
+	_, err = client.UpdateDeploymentConfig(d.deploymentsClient.DeploymentConfigs(client.Namespace), dc, func(dc *v1.DeploymentConfig) error {
+		dc.Annotations["canary-image"] = image
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to update canary-image from %s:%s: %v", stream, tag, err)
+	}
+
+	l.Log.Info(fmt.Sprintf("imagestream tag %s:%s moved to %s", stream, tag, image),
+		zap.String("deploymentconfig", dc.GetName()), zap.String("canary", image))
+	return true, nil
+}
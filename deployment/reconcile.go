@@ -0,0 +1,64 @@
+package deployment
+
+import (
+	"fmt"
+
+	v1 "github.com/openshift/api/apps/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redhatinsights/miniop/client"
+	l "github.com/redhatinsights/miniop/logger"
+	"github.com/redhatinsights/miniop/pod"
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var repairCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "canary_repairs_total",
+	Help: "A count of inconsistent canary state repaired per deploymentconfig",
+}, []string{"deploymentconfig", "repair"})
+
+// reconcile clears a canary-pod annotation that refers to a pod which no
+// longer exists, e.g. because it was deleted by hand.  Clearing it lets a
+// new canary be spawned for the same image.  It returns true if the
+// deploymentconfig was changed, the update will requeue it.
+func (d *DeploymentWorker) reconcile(dc *v1.DeploymentConfig) (bool, error) {
+	podName, ok := dc.Annotations["canary-pod"]
+	if !ok {
+		return false, nil
+	}
+
+	_, exists, err := d.pods.GetByKey(fmt.Sprintf("%s/%s", client.Namespace, podName))
+	if err != nil {
+		return false, err
+	} else if exists {
+		return false, nil
+	}
+
+	// the cache may not have caught up with a pod that was just created
+	_, err = d.clientset.CoreV1().Pods(client.Namespace).Get(podName, metav1.GetOptions{})
+	if err == nil {
+		return false, nil
+	} else if !errors.IsNotFound(err) {
+		return false, err
+	}
+
+	_, err = client.UpdateDeploymentConfig(d.deploymentsClient.DeploymentConfigs(client.Namespace), dc, func(dc *v1.DeploymentConfig) error {
+		if dc.Annotations["canary-pod"] != podName {
+			return nil
+		}
+		delete(dc.Annotations, "canary-pod")
+		// a rollout that was in progress carries on without the canary
+		pod.ClearPromotion(dc)
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to clear dangling canary-pod annotation: %v", err)
+	}
+
+	repairCounter.With(prometheus.Labels{"deploymentconfig": dc.GetName(), "repair": "dangling-annotation"}).Inc()
+	l.Log.Info(fmt.Sprintf("canary pod %s no longer exists, cleared canary-pod annotation", podName),
+		zap.String("deploymentconfig", dc.GetName()), zap.String("pod", podName))
+	return true, nil
+}
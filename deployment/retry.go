@@ -0,0 +1,81 @@
+package deployment
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	v1 "github.com/openshift/api/apps/v1"
+	ctl "github.com/redhatinsights/miniop/controller"
+	"github.com/redhatinsights/miniop/history"
+	l "github.com/redhatinsights/miniop/logger"
+	"go.uber.org/zap"
+)
+
+// defaultRetryBackoff is waited after the first failure of an image when
+// canary-retry-backoff isn't set
+const defaultRetryBackoff = 5 * time.Minute
+
+// retryFailed decides whether a canary may be started again for the image
+// recorded in canary-fail.  canary-retries allows that many more attempts,
+// each one waiting canary-retry-backoff after the last failure, doubled for
+// every failure of the image.  It returns NothingToDo once the retries are
+// used up, and RequeueAfter while backing off.
+func retryFailed(dc *v1.DeploymentConfig, now time.Time) error {
+	retries, err := strconv.Atoi(dc.Annotations["canary-retries"])
+	if err != nil {
+		retries = 0
+	}
+
+	failures, err := strconv.Atoi(dc.Annotations["canary-fail-count"])
+	if err != nil || failures < 1 {
+		failures = 1
+	}
+
+	if failures > retries {
+		l.Log.Debug("a canary deployment has failed for this image, set a new canary-image or clear the annotations and try again",
+			zap.String("deploymentconfig", dc.GetName()), zap.String("failed", dc.Annotations["canary-fail"]))
+		return NothingToDo
+	}
+
+	backoff, err := time.ParseDuration(dc.Annotations["canary-retry-backoff"])
+	if err != nil {
+		backoff = defaultRetryBackoff
+	}
+	backoff = backoff << uint(failures-1)
+
+	failedAt, err := time.Parse(time.RFC3339, dc.Annotations["canary-fail-time"])
+	if err != nil {
+		// without a time there is nothing to wait for
+		return nil
+	}
+
+	if wait := failedAt.Add(backoff).Sub(now); wait > 0 {
+		l.Log.Debug(fmt.Sprintf("retrying failed canary in %s", wait.Round(time.Second)),
+			zap.String("deploymentconfig", dc.GetName()), zap.Int("failures", failures))
+		return ctl.RequeueAfter(wait)
+	}
+	return nil
+}
+
+// debounce holds back a new canary for canary-debounce after a canary was
+// superseded, so that rapid pushes to canary-image settle on the newest image
+// instead of starting a canary for each of them.
+func debounce(dc *v1.DeploymentConfig, now time.Time) error {
+	window, err := time.ParseDuration(dc.Annotations["canary-debounce"])
+	if err != nil || window <= 0 {
+		return nil
+	}
+
+	last, ok := history.Last(dc)
+	if !ok || last.Outcome != "superseded" {
+		return nil
+	}
+
+	if wait := last.Time.Add(window).Sub(now); wait > 0 {
+		l.Log.Debug(fmt.Sprintf("canary was superseded, waiting %s for canary-image to settle", wait.Round(time.Second)),
+			zap.String("deploymentconfig", dc.GetName()))
+		return ctl.RequeueAfter(wait)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package deployment
+
+import (
+	"fmt"
+
+	v1 "github.com/openshift/api/apps/v1"
+	"github.com/redhatinsights/miniop/client"
+	"github.com/redhatinsights/miniop/history"
+	l "github.com/redhatinsights/miniop/logger"
+	"github.com/redhatinsights/miniop/pod"
+	"github.com/redhatinsights/miniop/policy"
+	"github.com/redhatinsights/miniop/signature"
+	"go.uber.org/zap"
+)
+
+// reject records an image the policy doesn't allow as failed instead of
+// starting a canary for it.  Changes to the namespace requeue the
+// deploymentconfig, so a policy that is relaxed later starts the canary.
+func (d *DeploymentWorker) reject(dc *v1.DeploymentConfig, violation *policy.Violation) error {
+	if dc.Annotations["canary-fail"] == violation.Image && dc.Annotations["canary-fail-reason"] == policy.Reason {
+		return nil
+	}
+
+	policy.Rejected(dc, violation)
+	_, err := client.UpdateDeploymentConfig(d.deploymentsClient.DeploymentConfigs(client.Namespace), dc, func(dc *v1.DeploymentConfig) error {
+		pod.MarkFailed(dc, policy.Reason, history.Entry{Image: violation.Image, Outcome: "rejected", Reason: violation.Reason})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record policy violation: %v", err)
+	}
+	return nil
+}
+
+// failVerification fails the canary of an image without a valid signature.
+// Failures are counted like those of running canaries, so the retry policy
+// applies to signatures that are published late.
+func (d *DeploymentWorker) failVerification(dc *v1.DeploymentConfig, failure *signature.Failure) error {
+	l.Log.Info(failure.Error(), zap.String("deploymentconfig", dc.GetName()), zap.String("canary", failure.Image))
+	_, err := client.UpdateDeploymentConfig(d.deploymentsClient.DeploymentConfigs(client.Namespace), dc, func(dc *v1.DeploymentConfig) error {
+		pod.MarkFailed(dc, signature.Reason, history.Entry{Image: failure.Image, Outcome: "failed", Reason: fmt.Sprintf("%s: %s", signature.Reason, failure.Reason)})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record signature failure: %v", err)
+	}
+	return nil
+}
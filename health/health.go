@@ -0,0 +1,94 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+
+	l "github.com/redhatinsights/miniop/logger"
+	"go.uber.org/zap"
+)
+
+func init() {
+	l.InitLogger()
+}
+
+// Check returns an error describing why a component is unhealthy
+type Check func() error
+
+var (
+	mu        sync.Mutex
+	liveness  = make(map[string]Check)
+	readiness = make(map[string]Check)
+)
+
+// Report is the JSON body served by the health endpoints
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// AddLivenessCheck registers a check that fails /healthz and /readyz
+func AddLivenessCheck(name string, check Check) {
+	mu.Lock()
+	defer mu.Unlock()
+	liveness[name] = check
+}
+
+// AddReadinessCheck registers a check that only fails /readyz
+func AddReadinessCheck(name string, check Check) {
+	mu.Lock()
+	defer mu.Unlock()
+	readiness[name] = check
+}
+
+// LiveHandler reports whether miniop needs to be restarted
+func LiveHandler(w http.ResponseWriter, r *http.Request) {
+	serve(w, liveness)
+}
+
+// ReadyHandler reports whether miniop is ready to do its work
+func ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	serve(w, liveness, readiness)
+}
+
+func serve(w http.ResponseWriter, checkSets ...map[string]Check) {
+	report := run(checkSets...)
+
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		l.Log.Error("failed to write health report", zap.Error(err))
+	}
+}
+
+func run(checkSets ...map[string]Check) Report {
+	mu.Lock()
+	checks := make(map[string]Check)
+	for _, set := range checkSets {
+		for name, check := range set {
+			checks[name] = check
+		}
+	}
+	mu.Unlock()
+
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	report := Report{Status: "ok", Checks: make(map[string]string)}
+	for _, name := range names {
+		if err := checks[name](); err != nil {
+			report.Status = "failed"
+			report.Checks[name] = err.Error()
+			continue
+		}
+		report.Checks[name] = "ok"
+	}
+	return report
+}
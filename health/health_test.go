@@ -0,0 +1,56 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func reset() {
+	liveness = make(map[string]Check)
+	readiness = make(map[string]Check)
+}
+
+func get(t *testing.T, handler http.HandlerFunc) (int, Report) {
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/", nil))
+
+	var report Report
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("failed to decode report: %v", err)
+	}
+	return rec.Code, report
+}
+
+func TestReadinessFailureDoesNotFailLiveness(t *testing.T) {
+	reset()
+	AddLivenessCheck("workers", func() error { return nil })
+	AddReadinessCheck("cache", func() error { return errors.New("cache has not synced") })
+
+	code, report := get(t, LiveHandler)
+	if code != http.StatusOK || report.Status != "ok" {
+		t.Errorf("liveness failed: %d %+v", code, report)
+	}
+
+	code, report = get(t, ReadyHandler)
+	if code != http.StatusServiceUnavailable || report.Status != "failed" {
+		t.Errorf("readiness passed: %d %+v", code, report)
+	}
+	if report.Checks["cache"] != "cache has not synced" || report.Checks["workers"] != "ok" {
+		t.Errorf("unexpected check details: %+v", report.Checks)
+	}
+}
+
+func TestLivenessFailureFailsReadiness(t *testing.T) {
+	reset()
+	AddLivenessCheck("workers", func() error { return errors.New("stalled") })
+
+	if code, _ := get(t, LiveHandler); code != http.StatusServiceUnavailable {
+		t.Errorf("liveness passed: %d", code)
+	}
+	if code, _ := get(t, ReadyHandler); code != http.StatusServiceUnavailable {
+		t.Errorf("readiness passed: %d", code)
+	}
+}
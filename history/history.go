@@ -0,0 +1,77 @@
+// Package history keeps a record of finished canaries in an annotation on
+// their deploymentconfig.
+package history
+
+import (
+	"encoding/json"
+	"time"
+
+	v1 "github.com/openshift/api/apps/v1"
+)
+
+// Annotation holds the history as a JSON list, oldest entry first
+const Annotation = "canary-history"
+
+// Limit is the number of entries kept, older entries are dropped
+const Limit = 10
+
+// Entry describes how a canary ended
+type Entry struct {
+	Image     string     `json:"image"`
+	Outcome   string     `json:"outcome"`
+	Reason    string     `json:"reason,omitempty"`
+	Decisions []Decision `json:"decisions,omitempty"`
+	Time      time.Time  `json:"time"`
+}
+
+// Decision is what an alert did to a canary while it incubated
+type Decision struct {
+	Alert  string            `json:"alert"`
+	Labels map[string]string `json:"labels,omitempty"`
+	// Action is fail, extend or record
+	Action string `json:"action"`
+	// From and Until are the end of the incubation before and after the
+	// alert extended it
+	From  *time.Time `json:"from,omitempty"`
+	Until *time.Time `json:"until,omitempty"`
+	// Time is when the alert started firing
+	Time time.Time `json:"time"`
+}
+
+// Get returns the history of dc.  An unreadable history is treated as empty.
+func Get(dc *v1.DeploymentConfig) []Entry {
+	var entries []Entry
+	if err := json.Unmarshal([]byte(dc.Annotations[Annotation]), &entries); err != nil {
+		return nil
+	}
+	return entries
+}
+
+// Last returns the most recent entry of the history of dc
+func Last(dc *v1.DeploymentConfig) (Entry, bool) {
+	entries := Get(dc)
+	if len(entries) == 0 {
+		return Entry{}, false
+	}
+	return entries[len(entries)-1], true
+}
+
+// Record appends entry to the history of dc, it is meant to be called from
+// the mutate function of an update.  The time defaults to now.
+func Record(dc *v1.DeploymentConfig, entry Entry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC().Truncate(time.Second)
+	}
+	entries := append(Get(dc), entry)
+	if len(entries) > Limit {
+		entries = entries[len(entries)-Limit:]
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return
+	}
+	if dc.Annotations == nil {
+		dc.Annotations = make(map[string]string)
+	}
+	dc.Annotations[Annotation] = string(data)
+}
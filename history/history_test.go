@@ -0,0 +1,54 @@
+package history
+
+import (
+	"fmt"
+	"testing"
+
+	v1 "github.com/openshift/api/apps/v1"
+)
+
+func TestRecord(t *testing.T) {
+	dc := &v1.DeploymentConfig{}
+	Record(dc, Entry{Image: "barv1", Outcome: "failed", Reason: "restarts"})
+	Record(dc, Entry{Image: "barv2", Outcome: "promoted"})
+
+	entries := Get(dc)
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %v", entries)
+	}
+	if entries[0].Image != "barv1" || entries[0].Reason != "restarts" {
+		t.Errorf("unexpected first entry: %+v", entries[0])
+	}
+	if entries[1].Time.IsZero() {
+		t.Error("time was not set")
+	}
+	if last, _ := Last(dc); last.Outcome != "promoted" {
+		t.Errorf("unexpected last entry: %+v", last)
+	}
+}
+
+func TestRecordLimit(t *testing.T) {
+	dc := &v1.DeploymentConfig{}
+	for i := 0; i < Limit+3; i++ {
+		Record(dc, Entry{Image: fmt.Sprintf("bar%d", i), Outcome: "promoted"})
+	}
+
+	entries := Get(dc)
+	if len(entries) != Limit {
+		t.Fatalf("expected %d entries, got %d", Limit, len(entries))
+	}
+	if entries[0].Image != "bar3" {
+		t.Errorf("oldest entries were not dropped: %+v", entries[0])
+	}
+}
+
+func TestGetInvalid(t *testing.T) {
+	dc := &v1.DeploymentConfig{}
+	dc.SetAnnotations(map[string]string{Annotation: "not json"})
+	if entries := Get(dc); entries != nil {
+		t.Errorf("expected an empty history, got %v", entries)
+	}
+	if _, ok := Last(dc); ok {
+		t.Error("expected no last entry")
+	}
+}
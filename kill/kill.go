@@ -11,6 +11,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/redhatinsights/miniop/client"
 	l "github.com/redhatinsights/miniop/logger"
+	"github.com/redhatinsights/miniop/stop"
 	"go.uber.org/zap"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -49,7 +50,16 @@ func kill(pod string) (int, error) {
 	return http.StatusOK, nil
 }
 
-func Handler(w http.ResponseWriter, r *http.Request) {
+// NewHandler returns the alertmanager webhook killing the pod an alert is
+// about.  While the emergency stop is engaged the pod is left alone and the
+// response says the kill was suppressed.
+func NewHandler(s *stop.Switch) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handle(s, w, r)
+	}
+}
+
+func handle(s *stop.Switch, w http.ResponseWriter, r *http.Request) {
 	webhookBody, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		l.Log.Error("failed to read post body", zap.Error(err))
@@ -66,16 +76,34 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	podname, ok := message.CommonLabels["kubernetes_pod_name"]
+	labels := message.CommonLabels
+	podname, ok := labels["kubernetes_pod_name"]
 	if !ok {
-		podname = message.Alerts.Firing()[0].Labels["kubernetes_pod_name"]
+		labels = message.Alerts.Firing()[0].Labels
+		podname = labels["kubernetes_pod_name"]
 	}
 
 	l.Log.Info(fmt.Sprintf("got a request to kill %s", podname), zap.String("pod", podname), zap.Reflect("message", message))
 
+	if engaged, reason := s.Engaged(); engaged {
+		stop.Suppressed("kill", deploymentConfig(labels), reason)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "suppressed", "reason": reason})
+		return
+	}
+
 	code, err := kill(podname)
 	if err != nil {
 		l.Log.Error(fmt.Sprintf("failed to kill pod %s", podname), zap.Error(err))
 	}
 	w.WriteHeader(code)
 }
+
+// deploymentConfig returns the deploymentconfig label the alert carries over
+// from the pod, or "unknown" so that the metric labels stay bounded
+func deploymentConfig(labels map[string]string) string {
+	if dc := labels["deploymentconfig"]; dc != "" {
+		return dc
+	}
+	return "unknown"
+}
@@ -6,22 +6,34 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
+	"syscall"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spf13/viper"
 
+	"github.com/redhatinsights/miniop/approval"
+	"github.com/redhatinsights/miniop/auth"
+	"github.com/redhatinsights/miniop/client"
 	"github.com/redhatinsights/miniop/deployment"
+	"github.com/redhatinsights/miniop/health"
 	"github.com/redhatinsights/miniop/kill"
 	l "github.com/redhatinsights/miniop/logger"
 
 	"github.com/redhatinsights/miniop/pod"
+	"github.com/redhatinsights/miniop/stop"
+	"github.com/redhatinsights/miniop/webhook"
 	"go.uber.org/zap"
 	"k8s.io/klog"
 )
 
 func init() {
 	l.InitLogger()
+	client.InitClient()
+	viper.SetDefault("SHUTDOWN_TIMEOUT", "30s")
+	viper.SetDefault("POD_RESYNC_PERIOD", "10m")
 }
 
 func main() {
@@ -31,35 +43,93 @@ func main() {
 
 	klog.V(9).Info("klog initialized with verbosity 9")
 
+	health.AddReadinessCheck("kubernetes-api", client.Ping)
+
+	informers := client.NewInformers(client.AppsClientset, client.ImageClient, client.Clientset, viper.GetDuration("POD_RESYNC_PERIOD"),
+		viper.GetString("STOP_CONFIGMAP"))
+	emergencyStop := stop.New(informers)
+
 	r := chi.NewRouter()
-	r.Use(middleware.Logger)
-	r.Post("/kill", kill.Handler)
-	r.Handle("/metrics", promhttp.Handler())
+	// probes are left out of the request log
+	r.Get("/healthz", health.LiveHandler)
+	r.Get("/readyz", health.ReadyHandler)
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.Logger)
+		r.Post("/kill", kill.NewHandler(emergencyStop))
+		r.With(auth.Middleware(client.Clientset, "update")).
+			Post("/approve/{deploymentconfig}", approval.NewHandler(client.AppsClientset.AppsV1()))
+		r.With(auth.RequireAccess(client.Clientset, stop.Access("get"))).
+			Get("/emergency-stop", stop.StatusHandler(emergencyStop))
+		r.With(auth.RequireAccess(client.Clientset, stop.Access("update"))).
+			Post("/emergency-stop", stop.EngageHandler(client.Clientset))
+		r.With(auth.RequireAccess(client.Clientset, stop.Access("update"))).
+			Delete("/emergency-stop", stop.ReleaseHandler(client.Clientset))
+		r.Handle("/metrics", promhttp.Handler())
+	})
+	// the token the webhook may carry in its query is redacted from the log
+	r.With(webhook.RedactToken, middleware.Logger).
+		Post("/webhook/registry", webhook.NewHandler(client.AppsClientset.AppsV1(),
+			informers.DeploymentConfigs.Informer().GetIndexer(),
+			webhook.NewRegistry(viper.GetString("REGISTRY_USERNAME"), viper.GetString("REGISTRY_PASSWORD")),
+			viper.GetString("WEBHOOK_TOKEN")))
 
 	srv := http.Server{
 		Addr:    ":8080",
 		Handler: r,
 	}
 
-	idleConnsClosed := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+
+	podWorker := pod.NewWorker(informers)
+	deploymentWorker := deployment.NewDeploymentWorker(informers)
+
+	var workers sync.WaitGroup
+	workers.Add(2)
 	go func() {
-		sigint := make(chan os.Signal, 1)
-		signal.Notify(sigint, os.Interrupt)
-		<-sigint
+		defer workers.Done()
+		podWorker.Start(ctx)
+	}()
+	go func() {
+		defer workers.Done()
+		deploymentWorker.Start(ctx)
+	}()
+	informers.Start(ctx.Done())
 
-		if err := srv.Shutdown(context.Background()); err != nil {
+	stopped := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		l.Log.Info("received signal, shutting down", zap.String("signal", (<-sig).String()))
+
+		timeout := viper.GetDuration("SHUTDOWN_TIMEOUT")
+		shutdownCtx, done := context.WithTimeout(context.Background(), timeout)
+		defer done()
+
+		// stop accepting requests and stop the controllers, which finish the
+		// items they are working on
+		cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
 			l.Log.Error("HTTP Server Shutdown Error", zap.Error(err))
 		}
-		close(idleConnsClosed)
-	}()
 
-	go pod.NewWorker().Start()
-	go deployment.NewDeploymentWorker().Start()
+		drained := make(chan struct{})
+		go func() {
+			workers.Wait()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+			l.Log.Info("workers stopped")
+		case <-shutdownCtx.Done():
+			l.Log.Error("timed out waiting for workers to stop", zap.Duration("timeout", timeout))
+		}
+		close(stopped)
+	}()
 
 	l.Log.Info("starting web server")
 	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
 		l.Log.Panic("HTTP server failed to start", zap.Error(err))
 	}
 
-	<-idleConnsClosed
+	<-stopped
 }
@@ -0,0 +1,70 @@
+package pod
+
+import (
+	"fmt"
+	"time"
+
+	v1 "github.com/openshift/api/apps/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redhatinsights/miniop/analysis"
+	"github.com/redhatinsights/miniop/client"
+	"github.com/redhatinsights/miniop/history"
+	l "github.com/redhatinsights/miniop/logger"
+	"go.uber.org/zap"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+// analyze runs the analyzers of the deploymentconfig for the canary and
+// records their verdicts on the canary pod
+func (p *PodWorker) analyze(pod *apiv1.Pod, analyzers []analysis.Named, canary *analysis.Canary) (analysis.Record, error) {
+	previous := analysis.GetRecord(pod.Annotations)
+	record, err := analysis.Analyze(analyzers, canary, previous, time.Now())
+	if err != nil {
+		l.Log.Error("failed to analyze canary", zap.Error(err), zap.String("deploymentconfig", canary.DeploymentConfig.GetName()))
+		return record, err
+	}
+	if record.Equal(previous) {
+		return record, nil
+	}
+
+	updated := pod.DeepCopy()
+	if updated.Annotations == nil {
+		updated.Annotations = make(map[string]string)
+	}
+	record.Set(updated.Annotations)
+	if _, err := p.clientset.CoreV1().Pods(client.Namespace).Update(updated); err != nil && !errors.IsNotFound(err) {
+		// the analyzers are started again on the next check
+		l.Log.Error("failed to record verdicts on canary pod", zap.Error(err), zap.String("pod", pod.GetName()))
+		return record, err
+	}
+	return record, nil
+}
+
+// failAnalysis fails a canary that an analyzer found unhealthy
+func (p *PodWorker) failAnalysis(pod *apiv1.Pod, dc *v1.DeploymentConfig, image string, record analysis.Record) error {
+	failed := record.FailedAnalyzer()
+	reason := record.Combined().Reason
+	_, err := client.UpdateDeploymentConfig(p.deploymentsClient.DeploymentConfigs(client.Namespace), dc, func(dc *v1.DeploymentConfig) error {
+		MarkFailed(dc, failed, history.Entry{Image: image, Outcome: "failed", Reason: reason, Decisions: record.Decisions()})
+		record.Set(dc.Annotations)
+		ClearPromotion(dc)
+		delete(dc.Annotations, "canary-pod")
+		return nil
+	})
+	if err != nil {
+		l.Log.Error("failed to mark canary as failed", zap.Error(err), zap.String("deploymentconfig", dc.GetName()))
+		return err
+	}
+	outcomeCounter.With(prometheus.Labels{"deploymentconfig": dc.GetName(), "outcome": "failed"}).Inc()
+	record.Count(dc)
+
+	l.Log.Info(fmt.Sprintf("canary failed analysis, marking as failed: %s", reason),
+		zap.String("deploymentconfig", dc.GetName()), zap.String("canary", image), zap.String("analyzer", failed))
+
+	if err := p.deletePod(pod); err != nil && !errors.IsNotFound(err) {
+		l.Log.Error("failed to delete stale canary pod", zap.Error(err))
+		return err
+	}
+	return nil
+}
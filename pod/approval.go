@@ -0,0 +1,87 @@
+package pod
+
+import (
+	"fmt"
+	"time"
+
+	v1 "github.com/openshift/api/apps/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redhatinsights/miniop/approval"
+	"github.com/redhatinsights/miniop/client"
+	ctl "github.com/redhatinsights/miniop/controller"
+	l "github.com/redhatinsights/miniop/logger"
+	"go.uber.org/zap"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+// awaitApproval holds a canary that finished incubating until it is approved
+// through the canary-approved-by annotation or the approval API.  Approvals
+// given before the canary started waiting don't count.  If
+// canary-approval-timeout is set, a canary that isn't approved in time fails.
+func (p *PodWorker) awaitApproval(pod *apiv1.Pod, dc *v1.DeploymentConfig) error {
+	if dc.Annotations["canary-phase"] != approval.PhaseAwaiting {
+		_, err := client.UpdateDeploymentConfig(p.deploymentsClient.DeploymentConfigs(client.Namespace), dc, func(dc *v1.DeploymentConfig) error {
+			dc.Annotations["canary-phase"] = approval.PhaseAwaiting
+			dc.Annotations[approval.AwaitingSince] = time.Now().UTC().Format(time.RFC3339)
+			delete(dc.Annotations, approval.ApprovedBy)
+			return nil
+		})
+		if err != nil {
+			l.Log.Error("failed to mark canary as awaiting approval", zap.Error(err), zap.String("deploymentconfig", dc.GetName()))
+			return err
+		}
+		l.Log.Info(fmt.Sprintf("canary pod %s for deployment %s is ripe, awaiting approval", pod.GetName(), dc.GetName()),
+			zap.String("deploymentconfig", dc.GetName()))
+		// the update requeues the pod
+		return nil
+	}
+
+	if approver, ok := dc.Annotations[approval.ApprovedBy]; ok {
+		l.Log.Info(fmt.Sprintf("canary for %s approved by %s, upgrading the deployment...", dc.GetName(), approver),
+			zap.String("deploymentconfig", dc.GetName()), zap.String("user", approver))
+		return p.promote(dc)
+	}
+
+	timeout, err := time.ParseDuration(dc.Annotations["canary-approval-timeout"])
+	if err != nil || timeout <= 0 {
+		return nil
+	}
+	since, err := time.Parse(time.RFC3339, dc.Annotations[approval.AwaitingSince])
+	if err != nil {
+		l.Log.Error("deployment has an invalid canary-awaiting-since annotation", zap.Error(err), zap.String("deploymentconfig", dc.GetName()))
+		return nil
+	}
+	if wait := since.Add(timeout).Sub(time.Now()); wait > 0 {
+		return ctl.RequeueAfter(wait)
+	}
+	return p.failApproval(pod, dc)
+}
+
+// failApproval fails a canary that wasn't approved within the timeout
+func (p *PodWorker) failApproval(pod *apiv1.Pod, dc *v1.DeploymentConfig) error {
+	image := podImage(pod, dc.Annotations["canary-name"])
+	_, err := client.UpdateDeploymentConfig(p.deploymentsClient.DeploymentConfigs(client.Namespace), dc, func(dc *v1.DeploymentConfig) error {
+		if dc.Annotations["canary-pod"] != pod.GetName() {
+			return nil
+		}
+		markFailed(dc, image, "approval-timeout")
+		ClearPromotion(dc)
+		delete(dc.Annotations, "canary-pod")
+		return nil
+	})
+	if err != nil {
+		l.Log.Error("failed to mark canary as failed", zap.Error(err), zap.String("deploymentconfig", dc.GetName()))
+		return err
+	}
+
+	if err := p.deletePod(pod); err != nil && !errors.IsNotFound(err) {
+		l.Log.Error("failed to delete unapproved canary pod", zap.Error(err), zap.String("pod", pod.GetName()))
+		return err
+	}
+
+	outcomeCounter.With(prometheus.Labels{"deploymentconfig": dc.GetName(), "outcome": "approval-timeout"}).Inc()
+	l.Log.Info("canary was not approved in time, marking as failed",
+		zap.String("deploymentconfig", dc.GetName()), zap.String("canary", image))
+	return nil
+}
@@ -0,0 +1,49 @@
+package pod
+
+import (
+	"fmt"
+	"time"
+
+	v1 "github.com/openshift/api/apps/v1"
+	"github.com/redhatinsights/miniop/baseline"
+	"github.com/redhatinsights/miniop/client"
+	l "github.com/redhatinsights/miniop/logger"
+	"go.uber.org/zap"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// checkBaseline pauses the clock of the canary while the baseline of dc is
+// unhealthy and starts it again once the baseline recovered.  It returns the
+// current canary pod and whether its clock is paused.
+func (p *PodWorker) checkBaseline(pod *apiv1.Pod, dc *v1.DeploymentConfig) (*apiv1.Pod, bool, error) {
+	reason, err := baseline.Unhealthy(p.stablePods, dc, pod.GetName())
+	if err != nil {
+		l.Log.Error("failed to check the baseline", zap.Error(err), zap.String("deploymentconfig", dc.GetName()))
+		return pod, false, err
+	}
+	baseline.Observe(dc, reason)
+
+	updated := pod.DeepCopy()
+	if updated.Annotations == nil {
+		updated.Annotations = make(map[string]string)
+	}
+	now := time.Now()
+	if reason != "" {
+		if !baseline.Pause(updated.Annotations, reason, now) {
+			return pod, true, nil
+		}
+		l.Log.Info(fmt.Sprintf("pausing canary pod %s, the baseline is unhealthy", pod.GetName()),
+			zap.String("deploymentconfig", dc.GetName()), zap.String("reason", reason))
+	} else if !baseline.Resume(updated.Annotations, now) {
+		return pod, false, nil
+	} else {
+		l.Log.Info(fmt.Sprintf("resuming canary pod %s, the baseline recovered", pod.GetName()),
+			zap.String("deploymentconfig", dc.GetName()), zap.String("paused", updated.Annotations[baseline.PausedAnnotation]))
+	}
+
+	updated, err = p.clientset.CoreV1().Pods(client.Namespace).Update(updated)
+	if err != nil {
+		return pod, false, fmt.Errorf("failed to record paused canary: %v", err)
+	}
+	return updated, reason != "", nil
+}
@@ -0,0 +1,41 @@
+package pod
+
+import (
+	"strconv"
+	"time"
+
+	v1 "github.com/openshift/api/apps/v1"
+	"github.com/redhatinsights/miniop/history"
+)
+
+// markFailed records that image failed as a canary for reason
+func markFailed(dc *v1.DeploymentConfig, image, reason string) {
+	MarkFailed(dc, reason, history.Entry{Image: image, Outcome: "failed", Reason: reason})
+}
+
+// MarkFailed records that entry.Image failed as a canary for reason and
+// appends entry to the history, it is meant to be called from the mutate
+// function of an update.  The record belongs to the image: a different
+// canary-image starts a new canary, and failures of the same image are
+// counted in canary-fail-count so that the retry policy can back off.
+func MarkFailed(dc *v1.DeploymentConfig, reason string, entry history.Entry) {
+	count := 1
+	if dc.Annotations["canary-fail"] == entry.Image {
+		if previous, err := strconv.Atoi(dc.Annotations["canary-fail-count"]); err == nil {
+			count = previous + 1
+		}
+	}
+	dc.Annotations["canary-fail"] = entry.Image
+	dc.Annotations["canary-fail-reason"] = reason
+	dc.Annotations["canary-fail-count"] = strconv.Itoa(count)
+	dc.Annotations["canary-fail-time"] = time.Now().UTC().Format(time.RFC3339)
+	history.Record(dc, entry)
+}
+
+// ClearFailure removes the failure record written by MarkFailed
+func ClearFailure(dc *v1.DeploymentConfig) {
+	delete(dc.Annotations, "canary-fail")
+	delete(dc.Annotations, "canary-fail-reason")
+	delete(dc.Annotations, "canary-fail-count")
+	delete(dc.Annotations, "canary-fail-time")
+}
@@ -0,0 +1,125 @@
+package pod
+
+import (
+	"fmt"
+	"strings"
+
+	v1 "github.com/openshift/api/apps/v1"
+	imagev1 "github.com/openshift/api/image/v1"
+	"github.com/redhatinsights/miniop/client"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+// promotedTagAnnotation records the namespace/imagestream:tag a canary was
+// promoted through, so that a failed rollout retags it back
+const promotedTagAnnotation = "canary-promoted-tag"
+
+// canaryTrigger returns the automatic image change trigger managing the
+// canary container.  The trigger owns the image of the container, writing
+// the canary image into the pod template would be reverted by it, so these
+// canaries are promoted by moving the imagestream tag the trigger follows.
+func canaryTrigger(dc *v1.DeploymentConfig) (string, bool) {
+	for _, trigger := range dc.Spec.Triggers {
+		params := trigger.ImageChangeParams
+		if trigger.Type != v1.DeploymentTriggerOnImageChange || params == nil || !params.Automatic {
+			continue
+		}
+		if params.From.Kind != "ImageStreamTag" {
+			continue
+		}
+		for _, name := range params.ContainerNames {
+			if name == dc.Annotations["canary-name"] {
+				namespace := params.From.Namespace
+				if namespace == "" {
+					namespace = dc.GetNamespace()
+				}
+				return fmt.Sprintf("%s/%s", namespace, params.From.Name), true
+			}
+		}
+	}
+	return "", false
+}
+
+// splitTagRef splits namespace/imagestream:tag
+func splitTagRef(ref string) (string, string, string, error) {
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) != 2 {
+		return "", "", "", fmt.Errorf("%q is not a namespace/imagestream:tag reference", ref)
+	}
+	stream, tag, ok := client.SplitImageStreamTag(parts[1])
+	if !ok {
+		return "", "", "", fmt.Errorf("%q is not a namespace/imagestream:tag reference", ref)
+	}
+	return parts[0], stream, tag, nil
+}
+
+// taggedImage returns the image the tag currently points to
+func (p *PodWorker) taggedImage(ref string) (string, error) {
+	namespace, stream, tag, err := splitTagRef(ref)
+	if err != nil {
+		return "", err
+	}
+	is, err := p.images.ImageStreams(namespace).Get(stream, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	image, _ := client.ResolveTag(is, tag)
+	return image, nil
+}
+
+// retag points the tag at image, doing nothing if it already does
+func (p *PodWorker) retag(ref, image string) error {
+	namespace, stream, tag, err := splitTagRef(ref)
+	if err != nil {
+		return err
+	}
+	streams := p.images.ImageStreams(namespace)
+
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		is, err := streams.Get(stream, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		from := tagSource(is, image)
+		found := false
+		for idx := range is.Spec.Tags {
+			if is.Spec.Tags[idx].Name != tag {
+				continue
+			}
+			if current := is.Spec.Tags[idx].From; current != nil && *current == from {
+				return nil
+			}
+			is.Spec.Tags[idx].From = &from
+			found = true
+		}
+		if !found {
+			is.Spec.Tags = append(is.Spec.Tags, imagev1.TagReference{Name: tag, From: &from})
+		}
+
+		_, err = streams.Update(is)
+		return err
+	})
+}
+
+// tagSource refers to image through the imagestream if it already contains
+// it, otherwise the image has to be imported from its pullspec
+func tagSource(is *imagev1.ImageStream, image string) apiv1.ObjectReference {
+	if idx := strings.Index(image, "@"); idx >= 0 {
+		digest := image[idx+1:]
+		for _, history := range is.Status.Tags {
+			for _, event := range history.Items {
+				if event.Image == digest {
+					return apiv1.ObjectReference{
+						Kind:      "ImageStreamImage",
+						Namespace: is.GetNamespace(),
+						Name:      fmt.Sprintf("%s@%s", is.GetName(), digest),
+					}
+				}
+			}
+		}
+	}
+	return apiv1.ObjectReference{Kind: "DockerImage", Name: image}
+}
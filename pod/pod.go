@@ -1,35 +1,59 @@
 package pod
 
 import (
+	"context"
 	"fmt"
 	"time"
 
 	v1 "github.com/openshift/api/apps/v1"
 	appsv1 "github.com/openshift/client-go/apps/clientset/versioned/typed/apps/v1"
+	appslisters "github.com/openshift/client-go/apps/listers/apps/v1"
+	"github.com/redhatinsights/miniop/analysis"
+	"github.com/redhatinsights/miniop/approval"
+	"github.com/redhatinsights/miniop/baseline"
 	"github.com/redhatinsights/miniop/client"
 	ctl "github.com/redhatinsights/miniop/controller"
 	l "github.com/redhatinsights/miniop/logger"
+	"github.com/redhatinsights/miniop/stop"
+	"github.com/spf13/viper"
 	"go.uber.org/zap"
 	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog"
 )
 
 func init() {
 	l.InitLogger()
+	viper.SetDefault("POD_WORKERS", 1)
 }
 
 type PodWorker struct {
-	deploymentsClient *appsv1.AppsV1Client
-	clientset         *kubernetes.Clientset
+	deploymentsClient appsv1.AppsV1Interface
+	clientset         kubernetes.Interface
+	informers         *client.Informers
+	dcLister          appslisters.DeploymentConfigLister
+	rcLister          corelisters.ReplicationControllerLister
+	stablePods        corelisters.PodLister
+	pods              cache.Indexer
+	images            client.ImagesInterface
+	emergencyStop     *stop.Switch
 }
 
-func NewWorker() *PodWorker {
+func NewWorker(informers *client.Informers) *PodWorker {
 	return &PodWorker{
-		deploymentsClient: appsv1.NewForConfigOrDie(client.Config),
+		deploymentsClient: client.AppsClientset.AppsV1(),
 		clientset:         client.Clientset,
+		informers:         informers,
+		dcLister:          informers.DeploymentConfigs.Lister(),
+		rcLister:          informers.ReplicationControllers.Lister(),
+		stablePods:        informers.StablePods.Lister(),
+		pods:              informers.CanaryPods.Informer().GetIndexer(),
+		images:            client.NewImages(client.ImageClient),
+		emergencyStop:     stop.New(informers),
 	}
 }
 
@@ -38,24 +62,55 @@ func (p *PodWorker) Work(obj interface{}) error {
 	if !ok {
 		return fmt.Errorf("object type was unexpected")
 	}
-	p.check(pod)
-	return nil
+	return p.check(pod)
 }
 
-func (p *PodWorker) Start() {
+// Start executes the watch loop until ctx is done
+func (p *PodWorker) Start(ctx context.Context) {
+	c := ctl.New("pod", p.informers.CanaryPods.Informer(), p)
 
-	podListerWatcher := cache.NewFilteredListWatchFromClient(
-		p.clientset.CoreV1().RESTClient(),
-		"pods",
-		client.Namespace,
-		func(opts *metav1.ListOptions) {
-			opts.LabelSelector = "canary=true"
-		},
-	)
+	// changes to a deploymentconfig or to its rollouts affect its canary
+	c.Watch(p.informers.DeploymentConfigs.Informer(), func(obj interface{}) []string {
+		dc, ok := obj.(*v1.DeploymentConfig)
+		if !ok {
+			return nil
+		}
+		return p.canaryKeys(dc.GetName())
+	})
+	c.Watch(p.informers.ReplicationControllers.Informer(), func(obj interface{}) []string {
+		rc, ok := obj.(*apiv1.ReplicationController)
+		if !ok {
+			return nil
+		}
+		dcName, ok := rc.Annotations[deploymentConfigAnnotation]
+		if !ok {
+			return nil
+		}
+		return p.canaryKeys(dcName)
+	})
+	p.emergencyStop.Watch(c)
+	// the baseline is read from the stable pod cache
+	c.WaitFor(p.informers.StablePods.Informer())
 
 	l.Log.Info("starting pod watcher")
 	klog.V(9).Info("can see klog")
-	ctl.Start(podListerWatcher, &apiv1.Pod{}, p, 60*time.Second)
+	c.Run(viper.GetInt("POD_WORKERS"), ctx.Done())
+}
+
+// canaryKeys returns the keys of the canary pods for a deploymentconfig
+func (p *PodWorker) canaryKeys(dcName string) []string {
+	objs, err := p.pods.ByIndex(client.CanaryForIndex, dcName)
+	if err != nil {
+		l.Log.Error("failed to look up canary pods", zap.Error(err), zap.String("deploymentconfig", dcName))
+		return nil
+	}
+	keys := make([]string, 0, len(objs))
+	for _, obj := range objs {
+		if key, err := cache.MetaNamespaceKeyFunc(obj); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys
 }
 
 func getNameAndImage(dc v1.DeploymentConfig) (string, string, error) {
@@ -74,53 +129,38 @@ func getNameAndImage(dc v1.DeploymentConfig) (string, string, error) {
 	return name, image, nil
 }
 
-func (p *PodWorker) check(pod *apiv1.Pod) {
+func (p *PodWorker) check(pod *apiv1.Pod) error {
 	canaryFor, ok := pod.Labels["canary-for"]
 	if !ok {
 		l.Log.Debug("canary pod does not have a canary-for label", zap.String("pod", pod.GetName()))
-		return
+		return nil
 	}
 
-	dc, err := p.deploymentsClient.DeploymentConfigs(client.Namespace).Get(canaryFor, metav1.GetOptions{})
-	if err != nil {
+	dc, err := p.dcLister.DeploymentConfigs(client.Namespace).Get(canaryFor)
+	if errors.IsNotFound(err) {
+		return p.collectOrphan(pod, canaryFor)
+	} else if err != nil {
 		l.Log.Error("failed to fetch deployment", zap.Error(err))
-		return
+		return err
 	}
 
 	name, image, err := getNameAndImage(*dc)
 	if err != nil {
 		l.Log.Info("failed to get canary details from dc", zap.Error(err))
-		return
+		return nil
 	}
 
-	for _, status := range pod.Status.ContainerStatuses {
-		if status.Name != name {
-			continue
-		}
-
-		if status.Image != image {
-			// this canary is likely out of date
-			if err := p.deletePod(pod); err != nil {
-				l.Log.Error("failed to delete stale canary pod", zap.Error(err))
-				return
-			}
-			l.Log.Info("canary image didn't match desired image from dc, deleted",
-				zap.String("deploymentconfig", canaryFor), zap.String("desired", image), zap.String("canary", status.Image))
-		}
-
-		if status.RestartCount > 0 {
-			dc.Annotations["canary-fail"] = status.Image
-			delete(dc.Annotations, "canary-pod")
-			p.deploymentsClient.DeploymentConfigs(client.Namespace).Update(dc)
+	if pod.Status.Phase == apiv1.PodFailed || pod.Status.Phase == apiv1.PodSucceeded {
+		return p.handleFailedPod(pod, dc)
+	}
 
-			l.Log.Info("canary image had container restarts, marking as failed",
-				zap.String("deploymentconfig", canaryFor), zap.String("canary", status.Image))
+	if dc.Annotations["canary-phase"] == phasePromoting {
+		return p.watchRollout(pod, dc)
+	}
 
-			if err := p.deletePod(pod); err != nil {
-				l.Log.Error("failed to delete stale canary pod", zap.Error(err))
-			}
-			return
-		}
+	if podImage(pod, name) != image {
+		// canary-image changed while this canary was running
+		return p.supersede(pod, dc)
 	}
 
 	durationString, ok := pod.Annotations["canary-duration"]
@@ -133,47 +173,87 @@ func (p *PodWorker) check(pod *apiv1.Pod) {
 		duration = 15 * time.Minute
 	}
 
-	deadline := pod.GetCreationTimestamp().Add(duration)
-	if !time.Now().After(deadline) {
-		l.Log.Debug(fmt.Sprintf("canary pod %s for deployment %s is not old enough, letting it ripen...", pod.GetName(), canaryFor), zap.String("deploymentconfig", canaryFor))
-		return
+	analyzers, err := analysis.ForDeploymentConfig(dc)
+	if err != nil {
+		// changing the annotation requeues the canary
+		l.Log.Info("deployment has an invalid analysis", zap.Error(err), zap.String("deploymentconfig", canaryFor))
+		return nil
+	}
+	pod, paused, err := p.checkBaseline(pod, dc)
+	if err != nil {
+		return err
+	} else if paused {
+		// the baseline isn't watched, look again later
+		return ctl.RequeueAfter(viper.GetDuration("ANALYSIS_INTERVAL"))
 	}
 
-	l.Log.Info(fmt.Sprintf("canary pod %s for deployment %s is old enough, upgrading the deployment...", pod.GetName(), canaryFor), zap.String("deploymentconfig", canaryFor))
-	p.upgrade(pod, canaryFor)
-}
-
-func (p *PodWorker) upgrade(pod *apiv1.Pod, canaryFor string) {
-	dc, err := p.deploymentsClient.DeploymentConfigs(client.Namespace).Get(canaryFor, metav1.GetOptions{})
+	canary := &analysis.Canary{
+		Pod:              pod,
+		DeploymentConfig: dc,
+		Container:        name,
+		Image:            image,
+		// alerts can extend the incubation
+		Deadline: analysis.GetRecord(pod.Annotations).Deadline(pod.GetCreationTimestamp().Add(duration + baseline.Paused(pod.Annotations, time.Now()))),
+		Baseline: func() ([]apiv1.Pod, error) {
+			return baseline.Pods(p.stablePods, dc)
+		},
+	}
+	record, err := p.analyze(pod, analyzers, canary)
 	if err != nil {
-		l.Log.Error("failed to fetch deployment", zap.Error(err))
-		return
+		return err
 	}
-	if ok := updateContainer(dc); !ok {
-		l.Log.Error("failed to update image in container specs")
-		return
+
+	switch result := record.Combined(); result.Verdict {
+	case analysis.Fail:
+		return p.failAnalysis(pod, dc, image, record)
+	case analysis.Pending:
+		canary.Deadline = record.Deadline(canary.Deadline)
+		wait := viper.GetDuration("ANALYSIS_INTERVAL")
+		if time.Now().After(canary.Deadline) {
+			l.Log.Debug(fmt.Sprintf("canary pod %s for deployment %s is ripe, %s", pod.GetName(), canaryFor, result.Reason), zap.String("deploymentconfig", canaryFor))
+		} else {
+			l.Log.Debug(fmt.Sprintf("canary pod %s for deployment %s is not old enough, letting it ripen...", pod.GetName(), canaryFor), zap.String("deploymentconfig", canaryFor))
+			// check back right when the canary is ripe
+			wait = analysis.NextCheck(analyzers, canary, time.Now())
+		}
+		// failed calls of analyzers are retried without waiting for the next check
+		if retry, ok := record.NextRetry(time.Now()); ok && retry < wait {
+			wait = retry
+		}
+		return ctl.RequeueAfter(wait)
 	}
 
-	if err := p.deletePod(pod); err != nil {
-		l.Log.Error("failed to delete pod, not updating deployment", zap.Error(err))
-		return
+	if approval.Required(dc) {
+		return p.awaitApproval(pod, dc)
 	}
 
-	delete(dc.Annotations, "canary-pod")
-	p.deploymentsClient.DeploymentConfigs(client.Namespace).Update(dc)
-	l.Log.Info(fmt.Sprintf("canary for %s completed, upgrading", canaryFor), zap.String("deploymentconfig", canaryFor))
+	l.Log.Info(fmt.Sprintf("canary pod %s for deployment %s is old enough, upgrading the deployment...", pod.GetName(), canaryFor), zap.String("deploymentconfig", canaryFor))
+	return p.promote(dc)
 }
 
 func updateContainer(dc *v1.DeploymentConfig) bool {
+	return setContainerImage(dc, dc.Annotations["canary-image"])
+}
+
+func setContainerImage(dc *v1.DeploymentConfig, image string) bool {
 	for idx, container := range dc.Spec.Template.Spec.Containers {
 		if container.Name == dc.Annotations["canary-name"] {
-			dc.Spec.Template.Spec.Containers[idx].Image = dc.Annotations["canary-image"]
+			dc.Spec.Template.Spec.Containers[idx].Image = image
 			return true
 		}
 	}
 	return false
 }
 
+func containerImage(dc *v1.DeploymentConfig) (string, bool) {
+	for _, container := range dc.Spec.Template.Spec.Containers {
+		if container.Name == dc.Annotations["canary-name"] {
+			return container.Image, true
+		}
+	}
+	return "", false
+}
+
 func (p *PodWorker) deletePod(pod *apiv1.Pod) error {
 	if err := p.clientset.CoreV1().Pods(client.Namespace).Delete(pod.GetName(), &metav1.DeleteOptions{}); err != nil {
 		return err
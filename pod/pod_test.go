@@ -0,0 +1,742 @@
+package pod
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	v1 "github.com/openshift/api/apps/v1"
+	imagev1 "github.com/openshift/api/image/v1"
+	appslisters "github.com/openshift/client-go/apps/listers/apps/v1"
+	"github.com/redhatinsights/miniop/analysis"
+	"github.com/redhatinsights/miniop/approval"
+	"github.com/redhatinsights/miniop/baseline"
+	"github.com/redhatinsights/miniop/client"
+	"github.com/redhatinsights/miniop/client/fake"
+	ctl "github.com/redhatinsights/miniop/controller"
+	"github.com/redhatinsights/miniop/history"
+	"github.com/redhatinsights/miniop/stop"
+	"github.com/spf13/viper"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func init() {
+	client.Namespace = "test"
+}
+
+var dc = &v1.DeploymentConfig{
+	ObjectMeta: metav1.ObjectMeta{
+		Name:      "testing",
+		Namespace: "test",
+		Annotations: map[string]string{
+			"canary-name":  "foo",
+			"canary-image": "barv2",
+			"canary-pod":   "testing-canary-abcde",
+		},
+	},
+	Spec: v1.DeploymentConfigSpec{
+		Template: &apiv1.PodTemplateSpec{
+			Spec: apiv1.PodSpec{
+				Containers: []apiv1.Container{
+					apiv1.Container{
+						Name:  "foo",
+						Image: "barv1",
+					},
+				},
+			},
+		},
+	},
+}
+
+func canaryPod(restarts int32, age time.Duration) *apiv1.Pod {
+	return &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              "testing-canary-abcde",
+			Namespace:         "test",
+			Labels:            map[string]string{"canary": "true", "canary-for": "testing"},
+			Annotations:       map[string]string{"canary-duration": "15m"},
+			CreationTimestamp: metav1.NewTime(time.Now().Add(-age)),
+		},
+		Spec: apiv1.PodSpec{
+			Containers: []apiv1.Container{
+				apiv1.Container{
+					Name:  "foo",
+					Image: "barv2",
+				},
+			},
+		},
+		Status: apiv1.PodStatus{
+			Phase: apiv1.PodRunning,
+			ContainerStatuses: []apiv1.ContainerStatus{
+				apiv1.ContainerStatus{
+					Name:         "foo",
+					Image:        "barv2",
+					RestartCount: restarts,
+				},
+			},
+		},
+	}
+}
+
+// newWorker returns a worker whose caches contain pod and the
+// deploymentconfigs stored in apps
+func newWorker(apps *fake.Apps, pod *apiv1.Pod) *PodWorker {
+	dcs := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	list, _ := apps.DeploymentConfigs(client.Namespace).List(metav1.ListOptions{})
+	for idx := range list.Items {
+		dcs.Add(&list.Items[idx])
+	}
+	pods := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{client.CanaryForIndex: client.CanaryForIndexFunc})
+	pods.Add(pod)
+	rcs := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+
+	return &PodWorker{
+		deploymentsClient: apps,
+		clientset:         kubefake.NewSimpleClientset(pod),
+		dcLister:          appslisters.NewDeploymentConfigLister(dcs),
+		rcLister:          corelisters.NewReplicationControllerLister(rcs),
+		stablePods:        corelisters.NewPodLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})),
+		pods:              pods,
+		images:            fake.NewImages(),
+	}
+}
+
+func concurrentChange(dc *v1.DeploymentConfig) {
+	dc.Annotations["concurrent"] = "true"
+}
+
+func TestRestartsFailCanaryOnConflict(t *testing.T) {
+	apps := fake.NewApps(dc)
+	apps.BeforeUpdate = concurrentChange
+	pod := canaryPod(1, time.Minute)
+	p := newWorker(apps, pod)
+
+	if err := p.check(pod); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	updated := apps.Stored("testing")
+	if updated.Annotations["canary-fail"] != "barv2" {
+		t.Errorf("canary was not marked as failed: %v", updated.Annotations)
+	}
+	if _, ok := updated.Annotations["canary-pod"]; ok {
+		t.Error("canary-pod annotation was not removed")
+	}
+	if updated.Annotations["concurrent"] != "true" {
+		t.Error("concurrent change was clobbered")
+	}
+}
+
+func TestPromoteOnConflict(t *testing.T) {
+	apps := fake.NewApps(dc)
+	apps.BeforeUpdate = concurrentChange
+	pod := canaryPod(0, time.Hour)
+	p := newWorker(apps, pod)
+
+	if err := p.check(pod); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	updated := apps.Stored("testing")
+	if updated.Annotations["canary-phase"] != phasePromoting {
+		t.Errorf("deployment is not promoting: %v", updated.Annotations)
+	}
+	if image, _ := containerImage(updated); image != "barv2" {
+		t.Errorf("container image was not updated: %s", image)
+	}
+	if updated.Annotations["canary-previous-image"] != "barv1" {
+		t.Errorf("previous image was not recorded: %v", updated.Annotations)
+	}
+	if updated.Annotations["concurrent"] != "true" {
+		t.Error("concurrent change was clobbered")
+	}
+}
+
+func TestUpdateErrorIsReturned(t *testing.T) {
+	apps := fake.NewApps(dc)
+	apps.UpdateError = errors.NewInternalError(fmt.Errorf("boom"))
+	pod := canaryPod(1, time.Minute)
+	p := newWorker(apps, pod)
+
+	if err := p.check(pod); err == nil {
+		t.Error("expected the update error to be returned so the key is requeued")
+	}
+}
+
+func TestUnripeCanaryRequeuedAtDeadline(t *testing.T) {
+	apps := fake.NewApps(dc)
+	pod := canaryPod(0, 5*time.Minute)
+	p := newWorker(apps, pod)
+
+	after, ok := p.check(pod).(ctl.RequeueAfter)
+	if !ok {
+		t.Fatal("expected the canary to be requeued")
+	}
+	if d := time.Duration(after); d > 10*time.Minute || d < 9*time.Minute {
+		t.Errorf("expected a requeue at the deadline in ~10m, got %s", d)
+	}
+	if apps.Updates() != 0 {
+		t.Error("deployment should not have been updated")
+	}
+}
+
+func podExists(t *testing.T, p *PodWorker, pod *apiv1.Pod) bool {
+	_, err := p.clientset.CoreV1().Pods(client.Namespace).Get(pod.GetName(), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return false
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return true
+}
+
+func TestOrphanedCanaryDeleted(t *testing.T) {
+	pod := canaryPod(0, time.Minute)
+	p := newWorker(fake.NewApps(), pod)
+
+	if err := p.check(pod); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if podExists(t, p, pod) {
+		t.Error("orphaned canary pod was not deleted")
+	}
+}
+
+func evictedPod() *apiv1.Pod {
+	pod := canaryPod(0, time.Minute)
+	pod.Status.Phase = apiv1.PodFailed
+	pod.Status.Reason = "Evicted"
+	return pod
+}
+
+func TestEvictedCanaryRetried(t *testing.T) {
+	apps := fake.NewApps(dc)
+	pod := evictedPod()
+	p := newWorker(apps, pod)
+
+	if err := p.check(pod); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	updated := apps.Stored("testing")
+	if _, ok := updated.Annotations["canary-pod"]; ok {
+		t.Error("canary-pod annotation was not removed")
+	}
+	if _, ok := updated.Annotations["canary-fail"]; ok {
+		t.Error("evicted canary should be retried, not failed")
+	}
+	if podExists(t, p, pod) {
+		t.Error("evicted canary pod was not deleted")
+	}
+}
+
+func TestEvictedCanaryFailedByPolicy(t *testing.T) {
+	failPolicy := dc.DeepCopy()
+	failPolicy.Annotations["canary-eviction-policy"] = "fail"
+	apps := fake.NewApps(failPolicy)
+	pod := evictedPod()
+	p := newWorker(apps, pod)
+
+	if err := p.check(pod); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	updated := apps.Stored("testing")
+	if updated.Annotations["canary-fail"] != "barv2" || updated.Annotations["canary-fail-reason"] != "evicted" {
+		t.Errorf("evicted canary was not failed: %v", updated.Annotations)
+	}
+}
+
+func TestRepeatedFailureCounted(t *testing.T) {
+	failed := dc.DeepCopy()
+	markFailed(failed, "barv2", "restarts")
+	markFailed(failed, "barv2", "pod-failed")
+	if failed.Annotations["canary-fail-count"] != "2" {
+		t.Errorf("expected 2 failures of the same image, got %v", failed.Annotations)
+	}
+	if failed.Annotations["canary-fail-reason"] != "pod-failed" {
+		t.Errorf("latest failure reason not recorded: %v", failed.Annotations)
+	}
+
+	markFailed(failed, "barv3", "restarts")
+	if failed.Annotations["canary-fail-count"] != "1" {
+		t.Errorf("failures of a new image are counted from 1, got %v", failed.Annotations)
+	}
+}
+
+func TestChangedImageSupersedesCanary(t *testing.T) {
+	changed := dc.DeepCopy()
+	changed.Annotations["canary-image"] = "barv3"
+	apps := fake.NewApps(changed)
+	pod := canaryPod(0, time.Minute)
+	p := newWorker(apps, pod)
+
+	if err := p.check(pod); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	updated := apps.Stored("testing")
+	if _, ok := updated.Annotations["canary-pod"]; ok {
+		t.Error("canary-pod annotation was not removed, no canary would be started for the new image")
+	}
+	if _, ok := updated.Annotations["canary-fail"]; ok {
+		t.Error("a superseded canary should not fail the image")
+	}
+	if last, _ := history.Last(updated); last.Image != "barv2" || last.Outcome != "superseded" {
+		t.Errorf("superseded canary was not recorded in the history: %+v", last)
+	}
+	if podExists(t, p, pod) {
+		t.Error("superseded canary pod was not deleted")
+	}
+}
+
+func approvalRequired(annotations map[string]string) *v1.DeploymentConfig {
+	required := dc.DeepCopy()
+	required.Annotations["canary-approval"] = "required"
+	for k, v := range annotations {
+		required.Annotations[k] = v
+	}
+	return required
+}
+
+func TestRipeCanaryAwaitsApproval(t *testing.T) {
+	apps := fake.NewApps(approvalRequired(nil))
+	pod := canaryPod(0, 20*time.Minute)
+	p := newWorker(apps, pod)
+
+	if err := p.check(pod); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	updated := apps.Stored("testing")
+	if updated.Annotations["canary-phase"] != approval.PhaseAwaiting {
+		t.Errorf("canary is not awaiting approval: %v", updated.Annotations)
+	}
+	if updated.Spec.Template.Spec.Containers[0].Image != "barv1" {
+		t.Error("canary was promoted without approval")
+	}
+}
+
+func TestApprovedCanaryPromoted(t *testing.T) {
+	apps := fake.NewApps(approvalRequired(map[string]string{
+		"canary-phase":         approval.PhaseAwaiting,
+		approval.AwaitingSince: time.Now().UTC().Format(time.RFC3339),
+		approval.ApprovedBy:    "alice",
+	}))
+	pod := canaryPod(0, 20*time.Minute)
+	p := newWorker(apps, pod)
+
+	if err := p.check(pod); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	updated := apps.Stored("testing")
+	if updated.Annotations["canary-phase"] != phasePromoting {
+		t.Errorf("approved canary was not promoted: %v", updated.Annotations)
+	}
+	if updated.Annotations[approval.ApprovedBy] != "alice" {
+		t.Error("approver was not kept for the rollout")
+	}
+}
+
+func TestUnapprovedCanaryTimesOut(t *testing.T) {
+	apps := fake.NewApps(approvalRequired(map[string]string{
+		"canary-phase":            approval.PhaseAwaiting,
+		"canary-approval-timeout": "1h",
+		approval.AwaitingSince:    time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339),
+	}))
+	pod := canaryPod(0, 3*time.Hour)
+	p := newWorker(apps, pod)
+
+	if err := p.check(pod); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	updated := apps.Stored("testing")
+	if updated.Annotations["canary-fail"] != "barv2" || updated.Annotations["canary-fail-reason"] != "approval-timeout" {
+		t.Errorf("unapproved canary was not failed: %v", updated.Annotations)
+	}
+	if _, ok := updated.Annotations["canary-phase"]; ok {
+		t.Error("canary-phase was not cleared")
+	}
+	if podExists(t, p, pod) {
+		t.Error("unapproved canary pod was not deleted")
+	}
+}
+
+func TestFrozenPromotionHeldBack(t *testing.T) {
+	frozen := dc.DeepCopy()
+	frozen.Annotations["canary-freezes"] = fmt.Sprintf("%s/%s",
+		time.Now().Add(-time.Hour).UTC().Format(time.RFC3339), time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	apps := fake.NewApps(frozen)
+	pod := canaryPod(0, 20*time.Minute)
+	p := newWorker(apps, pod)
+
+	err := p.check(pod)
+	if _, ok := err.(ctl.RequeueAfter); !ok {
+		t.Fatalf("expected a requeue at the end of the freeze, got %v", err)
+	}
+
+	updated := apps.Stored("testing")
+	if updated.Spec.Template.Spec.Containers[0].Image != "barv1" {
+		t.Error("canary was promoted during a freeze")
+	}
+	if _, ok := updated.Annotations["canary-blocked"]; !ok {
+		t.Errorf("blocked promotion was not reported: %v", updated.Annotations)
+	}
+}
+
+func engagedStop() *stop.Switch {
+	factory := informers.NewSharedInformerFactory(kubefake.NewSimpleClientset(), 0)
+	configMaps := factory.Core().V1().ConfigMaps().Informer()
+	configMaps.GetIndexer().Add(&apiv1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "miniop", Namespace: "test"},
+		Data:       map[string]string{stop.Key: "true"},
+	})
+	return stop.NewSwitch(configMaps, factory.Core().V1().Namespaces().Informer())
+}
+
+func TestEmergencyStopSuppressesPromotion(t *testing.T) {
+	apps := fake.NewApps(dc)
+	pod := canaryPod(0, 20*time.Minute)
+	p := newWorker(apps, pod)
+	p.emergencyStop = engagedStop()
+
+	if err := p.check(pod); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if apps.Updates() != 0 {
+		t.Error("canary was promoted during an emergency stop")
+	}
+}
+
+const (
+	currentDigest = "sha256:1111"
+	canaryDigest  = "sha256:2222"
+)
+
+// triggered returns dc with its container managed by an image change trigger
+// following myapp:prod
+func triggered(annotations map[string]string) *v1.DeploymentConfig {
+	d := dc.DeepCopy()
+	d.Annotations["canary-image"] = "registry/test/myapp@" + canaryDigest
+	for k, v := range annotations {
+		d.Annotations[k] = v
+	}
+	d.Spec.Template.Spec.Containers[0].Image = "registry/test/myapp@" + currentDigest
+	d.Spec.Triggers = []v1.DeploymentTriggerPolicy{{
+		Type: v1.DeploymentTriggerOnImageChange,
+		ImageChangeParams: &v1.DeploymentTriggerImageChangeParams{
+			Automatic:      true,
+			ContainerNames: []string{"foo"},
+			From:           apiv1.ObjectReference{Kind: "ImageStreamTag", Name: "myapp:prod"},
+		},
+	}}
+	return d
+}
+
+func myappStream() *imagev1.ImageStream {
+	event := func(digest string) []imagev1.TagEvent {
+		return []imagev1.TagEvent{{DockerImageReference: "registry/test/myapp@" + digest, Image: digest}}
+	}
+	return &imagev1.ImageStream{
+		ObjectMeta: metav1.ObjectMeta{Name: "myapp", Namespace: "test"},
+		Spec: imagev1.ImageStreamSpec{Tags: []imagev1.TagReference{{
+			Name: "prod",
+			From: &apiv1.ObjectReference{Kind: "ImageStreamImage", Namespace: "test", Name: "myapp@" + currentDigest},
+		}}},
+		Status: imagev1.ImageStreamStatus{Tags: []imagev1.NamedTagEventList{
+			{Tag: "prod", Items: event(currentDigest)},
+			{Tag: "latest", Items: event(canaryDigest)},
+		}},
+	}
+}
+
+func prodSource(t *testing.T, images *fake.Images) string {
+	t.Helper()
+	for _, tag := range images.Stored("test", "myapp").Spec.Tags {
+		if tag.Name == "prod" && tag.From != nil {
+			return tag.From.Name
+		}
+	}
+	t.Fatal("prod tag is missing")
+	return ""
+}
+
+func TestTriggeredCanaryPromotedByRetagging(t *testing.T) {
+	apps := fake.NewApps(triggered(nil))
+	pod := canaryPod(0, time.Hour)
+	pod.Spec.Containers[0].Image = "registry/test/myapp@" + canaryDigest
+	p := newWorker(apps, pod)
+	images := fake.NewImages(myappStream())
+	p.images = images
+
+	if err := p.check(pod); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if source := prodSource(t, images); source != "myapp@"+canaryDigest {
+		t.Errorf("prod tag was not moved to the canary: %s", source)
+	}
+	updated := apps.Stored("testing")
+	if image, _ := containerImage(updated); image != "registry/test/myapp@"+currentDigest {
+		t.Errorf("trigger-managed container image was changed: %s", image)
+	}
+	if updated.Annotations["canary-phase"] != phasePromoting {
+		t.Errorf("deployment is not promoting: %v", updated.Annotations)
+	}
+	if updated.Annotations["canary-previous-image"] != "registry/test/myapp@"+currentDigest {
+		t.Errorf("previous image was not recorded: %v", updated.Annotations)
+	}
+	if updated.Status.LatestVersion != 0 {
+		t.Error("rollout was instantiated instead of left to the trigger")
+	}
+}
+
+func TestFailedTriggeredRolloutRetagsBack(t *testing.T) {
+	d := triggered(map[string]string{
+		"canary-phase":          phasePromoting,
+		"canary-rollout-from":   "1",
+		"canary-previous-image": "registry/test/myapp@" + currentDigest,
+		promotedTagAnnotation:   "test/myapp:prod",
+	})
+	d.Status.LatestVersion = 2
+	apps := fake.NewApps(d)
+	pod := canaryPod(0, time.Hour)
+	p := newWorker(apps, pod)
+	stream := myappStream()
+	stream.Spec.Tags[0].From.Name = "myapp@" + canaryDigest
+	images := fake.NewImages(stream)
+	p.images = images
+	rcs := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	rcs.Add(&apiv1.ReplicationController{ObjectMeta: metav1.ObjectMeta{
+		Name:        "testing-2",
+		Namespace:   "test",
+		Annotations: map[string]string{deploymentPhaseAnnotation: deploymentPhaseFailed},
+	}})
+	p.rcLister = corelisters.NewReplicationControllerLister(rcs)
+
+	if err := p.check(pod); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if source := prodSource(t, images); source != "myapp@"+currentDigest {
+		t.Errorf("prod tag was not moved back: %s", source)
+	}
+	updated := apps.Stored("testing")
+	if updated.Annotations["canary-fail"] != "registry/test/myapp@"+canaryDigest {
+		t.Errorf("canary was not marked as failed: %v", updated.Annotations)
+	}
+	if _, ok := updated.Annotations[promotedTagAnnotation]; ok {
+		t.Error("promoted tag annotation was not removed")
+	}
+}
+
+func TestAnalyzerFailsCanary(t *testing.T) {
+	d := dc.DeepCopy()
+	d.Annotations[analysis.Annotation] = `[{"analyzer": "restarts"}, {"analyzer": "conditions"}]`
+	apps := fake.NewApps(d)
+	pod := canaryPod(0, time.Hour)
+	pod.Status.Conditions = []apiv1.PodCondition{{Type: apiv1.PodReady, Status: apiv1.ConditionFalse, Reason: "ContainersNotReady"}}
+	p := newWorker(apps, pod)
+
+	if err := p.check(pod); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	updated := apps.Stored("testing")
+	if updated.Annotations["canary-fail"] != "barv2" || updated.Annotations["canary-fail-reason"] != "conditions" {
+		t.Errorf("canary was not failed by the conditions analyzer: %v", updated.Annotations)
+	}
+	verdicts := analysis.GetRecord(updated.Annotations).Verdicts
+	if verdicts["restarts"].Verdict != analysis.Pass || verdicts["conditions"].Verdict != analysis.Fail {
+		t.Errorf("verdicts were not recorded per analyzer: %v", verdicts)
+	}
+	if podExists(t, p, pod) {
+		t.Error("failed canary pod was not deleted")
+	}
+}
+
+func TestVerdictsRecordedOnCanaryPod(t *testing.T) {
+	apps := fake.NewApps(dc)
+	pod := canaryPod(0, 5*time.Minute)
+	p := newWorker(apps, pod)
+
+	if _, ok := p.check(pod).(ctl.RequeueAfter); !ok {
+		t.Fatal("expected the canary to be requeued")
+	}
+	stored, err := p.clientset.CoreV1().Pods("test").Get(pod.GetName(), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record := analysis.GetRecord(stored.Annotations); record.Verdicts["restarts"].Verdict != analysis.Pending {
+		t.Errorf("pending verdict was not recorded on the canary pod: %v", stored.Annotations)
+	}
+}
+
+func TestUnhealthyBaselinePausesCanary(t *testing.T) {
+	apps := fake.NewApps(dc)
+	pod := canaryPod(1, time.Hour)
+	p := newWorker(apps, pod)
+	stable := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "testing-1-a",
+			Namespace: "test",
+			Labels:    map[string]string{"deploymentconfig": "testing"},
+		},
+		Status: apiv1.PodStatus{
+			Phase:      apiv1.PodRunning,
+			Conditions: []apiv1.PodCondition{{Type: apiv1.PodReady, Status: apiv1.ConditionFalse}},
+		},
+	}
+	stablePods := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	stablePods.Add(stable)
+	p.stablePods = corelisters.NewPodLister(stablePods)
+
+	if _, ok := p.check(pod).(ctl.RequeueAfter); !ok {
+		t.Fatal("expected the paused canary to be requeued")
+	}
+	if apps.Updates() != 0 {
+		t.Error("a paused canary should neither fail nor be promoted")
+	}
+	paused, _ := p.clientset.CoreV1().Pods("test").Get(pod.GetName(), metav1.GetOptions{})
+	if paused.Annotations[baseline.PausedReasonAnnotation] != "stable pods not ready: testing-1-a" {
+		t.Errorf("pause was not recorded: %v", paused.Annotations)
+	}
+
+	// the baseline recovered after the canary was paused for an hour
+	delete(paused.Annotations, baseline.PausedSinceAnnotation)
+	baseline.Pause(paused.Annotations, paused.Annotations[baseline.PausedReasonAnnotation], time.Now().Add(-time.Hour))
+	p.clientset.CoreV1().Pods("test").Update(paused)
+	stable.Status.Conditions[0].Status = apiv1.ConditionTrue
+	p.clientset.CoreV1().Pods("test").Update(stable)
+	healthy := canaryPod(0, time.Hour)
+	healthy.Annotations = paused.Annotations
+
+	after, ok := p.check(healthy).(ctl.RequeueAfter)
+	if !ok {
+		t.Fatal("expected the resumed canary to wait for its deadline")
+	}
+	if d := time.Duration(after); d > 15*time.Minute || d < 14*time.Minute {
+		t.Errorf("expected the deadline to move by the pause, requeued after %s", d)
+	}
+}
+
+func TestWarningExtendsIncubation(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `[{"labels": {"alertname": "SlowRequests", "severity": "warning", "kubernetes_pod_name": "testing-canary-abcde"}, "startsAt": %q}]`,
+			time.Now().UTC().Format(time.RFC3339))
+	}))
+	defer srv.Close()
+	viper.Set("ALERTMANAGER_URL", srv.URL)
+	defer viper.Set("ALERTMANAGER_URL", "")
+
+	d := dc.DeepCopy()
+	d.Annotations[analysis.Annotation] = `[{"analyzer": "alerts", "actions": [{"labels": {"severity": "warning"}, "action": "extend", "extend": "10m"}]}]`
+	apps := fake.NewApps(d)
+	pod := canaryPod(0, time.Hour)
+	p := newWorker(apps, pod)
+
+	after, ok := p.check(pod).(ctl.RequeueAfter)
+	if !ok {
+		t.Fatal("expected the extended canary to be requeued")
+	}
+	if time.Duration(after) > viper.GetDuration("ANALYSIS_INTERVAL") {
+		t.Errorf("expected the alert to be polled again, requeued after %s", time.Duration(after))
+	}
+	if apps.Updates() != 0 {
+		t.Error("canary was decided before its extended incubation ended")
+	}
+	updated, _ := p.clientset.CoreV1().Pods("test").Get(pod.GetName(), metav1.GetOptions{})
+	decisions := analysis.GetRecord(updated.Annotations).Decisions()
+	if len(decisions) != 1 || decisions[0].Alert != "SlowRequests" || decisions[0].Until == nil {
+		t.Errorf("decision was not recorded on the canary pod: %+v", decisions)
+	}
+}
+
+func TestAlertDecisionsRecordedInHistory(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"labels": {"alertname": "HighErrorRate", "severity": "critical", "kubernetes_pod_name": "testing-canary-abcde"}}]`)
+	}))
+	defer srv.Close()
+	viper.Set("ALERTMANAGER_URL", srv.URL)
+	defer viper.Set("ALERTMANAGER_URL", "")
+
+	d := dc.DeepCopy()
+	d.Annotations[analysis.Annotation] = `[{"analyzer": "alerts", "actions": [{"labels": {"severity": "critical"}, "action": "fail"}]}]`
+	apps := fake.NewApps(d)
+	pod := canaryPod(0, time.Minute)
+	p := newWorker(apps, pod)
+
+	if err := p.check(pod); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	last, _ := history.Last(apps.Stored("testing"))
+	if last.Outcome != "failed" || len(last.Decisions) != 1 {
+		t.Fatalf("decision was not recorded in the history: %+v", last)
+	}
+	if decision := last.Decisions[0]; decision.Action != "fail" || decision.Labels["severity"] != "critical" {
+		t.Errorf("unexpected decision %+v", decision)
+	}
+}
+
+func TestFailedInstantiateRetried(t *testing.T) {
+	d := dc.DeepCopy()
+	// without a config change trigger the rollout is instantiated
+	d.Spec.Triggers = v1.DeploymentTriggerPolicies{}
+	apps := fake.NewApps(d)
+	apps.InstantiateError = errors.NewInternalError(fmt.Errorf("boom"))
+	pod := canaryPod(0, time.Hour)
+
+	if err := newWorker(apps, pod).check(pod); err == nil {
+		t.Fatal("expected the instantiate error to be returned")
+	}
+	promoting := apps.Stored("testing")
+	if promoting.Annotations["canary-phase"] != phasePromoting || promoting.Status.LatestVersion != 0 {
+		t.Fatalf("expected a promotion without a rollout: %v", promoting.Annotations)
+	}
+
+	// a worker whose cache hasn't seen the rollout start yet
+	stale := newWorker(apps, pod)
+
+	apps.InstantiateError = nil
+	if err := newWorker(apps, pod).check(pod); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if version := apps.Stored("testing").Status.LatestVersion; version != 1 {
+		t.Errorf("rollout was not instantiated again, latest version is %d", version)
+	}
+
+	if err := stale.check(pod); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if version := apps.Stored("testing").Status.LatestVersion; version != 1 {
+		t.Errorf("rollout was instantiated twice, latest version is %d", version)
+	}
+}
+
+func TestPromoteStaleOnce(t *testing.T) {
+	d := dc.DeepCopy()
+	d.Spec.Triggers = v1.DeploymentTriggerPolicies{}
+	apps := fake.NewApps(d)
+	pod := canaryPod(0, time.Hour)
+	p := newWorker(apps, pod)
+
+	stale := apps.Stored("testing")
+	for i := 0; i < 2; i++ {
+		if err := p.promote(stale); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if version := apps.Stored("testing").Status.LatestVersion; version != 1 {
+		t.Errorf("expected a single rollout, latest version is %d", version)
+	}
+}
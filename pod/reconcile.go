@@ -0,0 +1,136 @@
+package pod
+
+import (
+	"fmt"
+
+	v1 "github.com/openshift/api/apps/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redhatinsights/miniop/client"
+	"github.com/redhatinsights/miniop/history"
+	l "github.com/redhatinsights/miniop/logger"
+	"go.uber.org/zap"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// collectOrphan deletes a canary pod whose deploymentconfig was deleted or
+// is no longer labelled for canaries.  Canary pods have an owner reference
+// to their deploymentconfig, this catches pods created before that and
+// deploymentconfigs that stopped being managed.
+func (p *PodWorker) collectOrphan(pod *apiv1.Pod, canaryFor string) error {
+	dc, err := p.deploymentsClient.DeploymentConfigs(client.Namespace).Get(canaryFor, metav1.GetOptions{})
+	if err == nil && dc.Labels["canary"] == "true" {
+		// the cache hasn't caught up yet
+		return nil
+	} else if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+
+	if err := p.deletePod(pod); err != nil && !errors.IsNotFound(err) {
+		l.Log.Error("failed to delete orphaned canary pod", zap.Error(err), zap.String("pod", pod.GetName()))
+		return err
+	}
+
+	outcomeCounter.With(prometheus.Labels{"deploymentconfig": canaryFor, "outcome": "orphaned"}).Inc()
+	l.Log.Info(fmt.Sprintf("deleted canary pod %s, deploymentconfig %s is gone or no longer managed", pod.GetName(), canaryFor),
+		zap.String("deploymentconfig", canaryFor), zap.String("pod", pod.GetName()))
+	return nil
+}
+
+// handleFailedPod deals with a canary pod that stopped running.  An evicted
+// canary says nothing about the image, so by default it is retried; setting
+// canary-eviction-policy: fail on the deploymentconfig fails it instead.  A
+// canary pod that failed for any other reason fails the canary.
+func (p *PodWorker) handleFailedPod(pod *apiv1.Pod, dc *v1.DeploymentConfig) error {
+	image := podImage(pod, dc.Annotations["canary-name"])
+	evicted := pod.Status.Reason == "Evicted"
+	retry := evicted && dc.Annotations["canary-eviction-policy"] != "fail"
+
+	reason := "pod-failed"
+	if evicted {
+		reason = "evicted"
+	}
+
+	_, err := client.UpdateDeploymentConfig(p.deploymentsClient.DeploymentConfigs(client.Namespace), dc, func(dc *v1.DeploymentConfig) error {
+		if dc.Annotations["canary-pod"] != pod.GetName() {
+			// the deploymentconfig has moved on
+			return nil
+		}
+		delete(dc.Annotations, "canary-pod")
+		if dc.Annotations["canary-phase"] == phasePromoting {
+			// the rollout carries on without the canary
+			ClearPromotion(dc)
+			return nil
+		}
+		ClearPromotion(dc)
+		if retry {
+			history.Record(dc, history.Entry{Image: image, Outcome: "retried", Reason: reason})
+		} else {
+			markFailed(dc, image, reason)
+		}
+		return nil
+	})
+	if err != nil {
+		l.Log.Error("failed to update deployment for failed canary pod", zap.Error(err), zap.String("deploymentconfig", dc.GetName()))
+		return err
+	}
+
+	if err := p.deletePod(pod); err != nil && !errors.IsNotFound(err) {
+		l.Log.Error("failed to delete failed canary pod", zap.Error(err), zap.String("pod", pod.GetName()))
+		return err
+	}
+
+	outcome := reason
+	if retry {
+		outcome = "evicted-retried"
+	}
+	outcomeCounter.With(prometheus.Labels{"deploymentconfig": dc.GetName(), "outcome": outcome}).Inc()
+	l.Log.Info(fmt.Sprintf("canary pod %s stopped running: %s", pod.GetName(), pod.Status.Reason),
+		zap.String("deploymentconfig", dc.GetName()), zap.String("canary", image), zap.Bool("retry", retry))
+	return nil
+}
+
+// supersede cancels a canary whose image is no longer the canary-image of
+// its deploymentconfig.  Clearing canary-pod lets the deploymentconfig
+// worker start a canary for the new image once the pod is gone.
+func (p *PodWorker) supersede(pod *apiv1.Pod, dc *v1.DeploymentConfig) error {
+	image := podImage(pod, dc.Annotations["canary-name"])
+	_, err := client.UpdateDeploymentConfig(p.deploymentsClient.DeploymentConfigs(client.Namespace), dc, func(dc *v1.DeploymentConfig) error {
+		if dc.Annotations["canary-pod"] != pod.GetName() {
+			return nil
+		}
+		delete(dc.Annotations, "canary-pod")
+		ClearPromotion(dc)
+		history.Record(dc, history.Entry{
+			Image:   image,
+			Outcome: "superseded",
+			Reason:  fmt.Sprintf("canary-image changed to %s", dc.Annotations["canary-image"]),
+		})
+		return nil
+	})
+	if err != nil {
+		l.Log.Error("failed to update deployment for superseded canary", zap.Error(err), zap.String("deploymentconfig", dc.GetName()))
+		return err
+	}
+
+	if err := p.deletePod(pod); err != nil && !errors.IsNotFound(err) {
+		l.Log.Error("failed to delete superseded canary pod", zap.Error(err), zap.String("pod", pod.GetName()))
+		return err
+	}
+
+	outcomeCounter.With(prometheus.Labels{"deploymentconfig": dc.GetName(), "outcome": "superseded"}).Inc()
+	l.Log.Info("canary image didn't match desired image from dc, superseded",
+		zap.String("deploymentconfig", dc.GetName()), zap.String("desired", dc.Annotations["canary-image"]), zap.String("canary", image))
+	return nil
+}
+
+// podImage returns the image of the named container in the pod spec
+func podImage(pod *apiv1.Pod, name string) string {
+	for _, container := range pod.Spec.Containers {
+		if container.Name == name {
+			return container.Image
+		}
+	}
+	return ""
+}
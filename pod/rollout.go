@@ -0,0 +1,336 @@
+package pod
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	v1 "github.com/openshift/api/apps/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redhatinsights/miniop/analysis"
+	"github.com/redhatinsights/miniop/approval"
+	"github.com/redhatinsights/miniop/client"
+	"github.com/redhatinsights/miniop/history"
+	l "github.com/redhatinsights/miniop/logger"
+	"github.com/redhatinsights/miniop/schedule"
+	"github.com/redhatinsights/miniop/stop"
+	"go.uber.org/zap"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// phasePromoting is stored in the canary-phase annotation while the
+	// deploymentconfig is rolling out the canary image
+	phasePromoting = "promoting"
+
+	// deploymentPhaseAnnotation is set by openshift on the replication
+	// controller of each deploymentconfig rollout
+	deploymentPhaseAnnotation = "openshift.io/deployment.phase"
+	deploymentPhaseComplete   = "Complete"
+	deploymentPhaseFailed     = "Failed"
+
+	// deploymentConfigAnnotation names the deploymentconfig a replication
+	// controller was created for
+	deploymentConfigAnnotation = "openshift.io/deployment-config.name"
+)
+
+var outcomeCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "canary_outcomes_total",
+	Help: "A count of finished canaries per deploymentconfig and outcome",
+}, []string{"deploymentconfig", "outcome"})
+
+// errNotPromotable is returned when the canary container can't be found in
+// the deploymentconfig, retrying won't help so it isn't requeued
+var errNotPromotable = fmt.Errorf("canary container not found in container specs")
+
+// errPromoting is returned by the update of a promotion that an earlier
+// attempt already got through, the rollout it started is left alone
+var errPromoting = fmt.Errorf("canary is already promoting")
+
+// promote patches the canary image into the deploymentconfig and records
+// where the rollout started so that it can be tracked on later checks.  The
+// canary keeps running while the schedule or the emergency stop hold back
+// promotion.
+func (p *PodWorker) promote(dc *v1.DeploymentConfig) error {
+	if engaged, reason := p.emergencyStop.Engaged(); engaged {
+		// releasing the stop requeues the canary
+		stop.Suppressed("promote", dc.GetName(), reason)
+		return nil
+	}
+
+	dcs := p.deploymentsClient.DeploymentConfigs(client.Namespace)
+	dc, err := schedule.Gate(dcs, dc, schedule.Promote, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if ref, ok := canaryTrigger(dc); ok {
+		return p.promoteTag(dc, ref)
+	}
+
+	name := dc.GetName()
+	dc, err = client.UpdateDeploymentConfig(dcs, dc, func(dc *v1.DeploymentConfig) error {
+		if dc.Annotations["canary-phase"] == phasePromoting {
+			return errPromoting
+		}
+		previous, ok := containerImage(dc)
+		if !ok {
+			return errNotPromotable
+		}
+		updateContainer(dc)
+
+		dc.Annotations["canary-phase"] = phasePromoting
+		dc.Annotations["canary-rollout-from"] = strconv.FormatInt(dc.Status.LatestVersion, 10)
+		dc.Annotations["canary-previous-image"] = previous
+		return nil
+	})
+	if err == errNotPromotable {
+		l.Log.Error("failed to update image in container specs", zap.Error(err))
+		return nil
+	} else if err == errPromoting {
+		// watchRollout takes over on the next check
+		l.Log.Debug("a previous attempt already promoted the canary", zap.String("deploymentconfig", name))
+		return nil
+	} else if err != nil {
+		l.Log.Error("failed to update deployment with canary image", zap.Error(err))
+		return err
+	}
+
+	if !hasConfigChangeTrigger(dc) {
+		// without a config change trigger the new template won't be rolled
+		// out on its own, a failure is retried by watchRollout
+		if err := p.instantiate(dc); err != nil {
+			return err
+		}
+	}
+
+	l.Log.Info(fmt.Sprintf("canary image for %s patched into deployment, waiting for rollout", dc.GetName()), zap.String("deploymentconfig", dc.GetName()))
+	return nil
+}
+
+// instantiate starts a rollout of the current template of dc
+func (p *PodWorker) instantiate(dc *v1.DeploymentConfig) error {
+	req := &v1.DeploymentRequest{Name: dc.GetName(), Force: true}
+	if _, err := p.deploymentsClient.DeploymentConfigs(client.Namespace).Instantiate(dc.GetName(), req); err != nil {
+		l.Log.Error("failed to instantiate rollout", zap.Error(err), zap.String("deploymentconfig", dc.GetName()))
+		return err
+	}
+	return nil
+}
+
+// promoteTag moves the imagestream tag followed by the image change trigger
+// of the canary container to the canary image.  The trigger then updates the
+// pod template and rolls it out.
+func (p *PodWorker) promoteTag(dc *v1.DeploymentConfig, ref string) error {
+	previous, err := p.taggedImage(ref)
+	if err != nil {
+		l.Log.Error("failed to read imagestream tag", zap.Error(err), zap.String("deploymentconfig", dc.GetName()), zap.String("tag", ref))
+		return err
+	}
+
+	name := dc.GetName()
+	dc, err = client.UpdateDeploymentConfig(p.deploymentsClient.DeploymentConfigs(client.Namespace), dc, func(dc *v1.DeploymentConfig) error {
+		if dc.Annotations["canary-phase"] == phasePromoting {
+			return errPromoting
+		}
+		dc.Annotations["canary-phase"] = phasePromoting
+		dc.Annotations["canary-rollout-from"] = strconv.FormatInt(dc.Status.LatestVersion, 10)
+		dc.Annotations["canary-previous-image"] = previous
+		dc.Annotations[promotedTagAnnotation] = ref
+		return nil
+	})
+	if err == errPromoting {
+		// watchRollout makes sure the tag was moved
+		l.Log.Debug("a previous attempt already promoted the canary", zap.String("deploymentconfig", name))
+		return nil
+	} else if err != nil {
+		l.Log.Error("failed to update deployment for promotion", zap.Error(err))
+		return err
+	}
+
+	if err := p.retag(ref, dc.Annotations["canary-image"]); err != nil {
+		// retried while waiting for the rollout
+		l.Log.Error("failed to move imagestream tag to canary image", zap.Error(err), zap.String("tag", ref))
+		return err
+	}
+
+	l.Log.Info(fmt.Sprintf("imagestream tag %s moved to the canary image of %s, waiting for rollout", ref, dc.GetName()),
+		zap.String("deploymentconfig", dc.GetName()), zap.String("tag", ref))
+	return nil
+}
+
+// watchRollout checks the replication controller created for the promotion.
+// The canary pod is kept until the new pods are ready so that the
+// deployment doesn't lose capacity while rolling out.  Changes to the
+// deploymentconfig and its replication controllers requeue the canary pod.
+func (p *PodWorker) watchRollout(pod *apiv1.Pod, dc *v1.DeploymentConfig) error {
+	from, err := strconv.ParseInt(dc.Annotations["canary-rollout-from"], 10, 64)
+	if err != nil {
+		l.Log.Error("deployment has an invalid canary-rollout-from annotation", zap.Error(err), zap.String("deploymentconfig", dc.GetName()))
+		return nil
+	}
+
+	if dc.Status.LatestVersion <= from {
+		if ref, ok := dc.Annotations[promotedTagAnnotation]; ok {
+			// make sure the tag was moved, the trigger starts the rollout
+			if err := p.retag(ref, dc.Annotations["canary-image"]); err != nil {
+				l.Log.Error("failed to move imagestream tag to canary image", zap.Error(err), zap.String("tag", ref))
+				return err
+			}
+		} else if !hasConfigChangeTrigger(dc) {
+			return p.retryInstantiate(dc, from)
+		}
+		l.Log.Debug(fmt.Sprintf("rollout for %s has not started yet", dc.GetName()), zap.String("deploymentconfig", dc.GetName()))
+		return nil
+	}
+
+	rcName := fmt.Sprintf("%s-%d", dc.GetName(), dc.Status.LatestVersion)
+	rc, err := p.rcLister.ReplicationControllers(client.Namespace).Get(rcName)
+	if errors.IsNotFound(err) {
+		l.Log.Debug(fmt.Sprintf("replication controller %s is not in the cache yet", rcName), zap.String("deploymentconfig", dc.GetName()))
+		return nil
+	} else if err != nil {
+		l.Log.Error("failed to fetch replication controller", zap.Error(err), zap.String("replicationcontroller", rcName))
+		return err
+	}
+
+	switch rc.Annotations[deploymentPhaseAnnotation] {
+	case deploymentPhaseComplete:
+		if !rcReady(rc) {
+			l.Log.Debug(fmt.Sprintf("rollout %s is complete but not all pods are ready", rcName), zap.String("deploymentconfig", dc.GetName()))
+			return nil
+		}
+		return p.finishPromotion(pod, dc)
+	case deploymentPhaseFailed:
+		return p.failRollout(pod, dc, rcName)
+	default:
+		l.Log.Debug(fmt.Sprintf("rollout %s is still in progress", rcName), zap.String("deploymentconfig", dc.GetName()))
+	}
+	return nil
+}
+
+// retryInstantiate starts the rollout of a promotion whose Instantiate call
+// failed.  The cache may lag behind a rollout that did start, so the
+// deploymentconfig is read from the API first.
+func (p *PodWorker) retryInstantiate(dc *v1.DeploymentConfig, from int64) error {
+	current, err := p.deploymentsClient.DeploymentConfigs(client.Namespace).Get(dc.GetName(), metav1.GetOptions{})
+	if err != nil {
+		l.Log.Error("failed to fetch deployment", zap.Error(err), zap.String("deploymentconfig", dc.GetName()))
+		return err
+	}
+	if current.Status.LatestVersion > from {
+		// the cache will catch up and requeue the canary
+		return nil
+	}
+	l.Log.Info(fmt.Sprintf("rollout for %s has not started, instantiating it again", dc.GetName()), zap.String("deploymentconfig", dc.GetName()))
+	return p.instantiate(current)
+}
+
+func (p *PodWorker) finishPromotion(pod *apiv1.Pod, dc *v1.DeploymentConfig) error {
+	if err := p.deletePod(pod); err != nil {
+		l.Log.Error("failed to delete canary pod after rollout", zap.Error(err))
+		return err
+	}
+
+	verdicts := analysis.GetRecord(pod.Annotations)
+	_, err := client.UpdateDeploymentConfig(p.deploymentsClient.DeploymentConfigs(client.Namespace), dc, func(dc *v1.DeploymentConfig) error {
+		if verdicts.Pod != "" {
+			verdicts.Set(dc.Annotations)
+		}
+		entry := history.Entry{Image: dc.Annotations["canary-image"], Outcome: "promoted", Decisions: verdicts.Decisions()}
+		if approver, ok := dc.Annotations[approval.ApprovedBy]; ok {
+			entry.Reason = fmt.Sprintf("approved by %s", approver)
+		}
+		history.Record(dc, entry)
+		ClearPromotion(dc)
+		// a retried image made it after all
+		ClearFailure(dc)
+		delete(dc.Annotations, "canary-pod")
+		return nil
+	})
+	if err != nil {
+		l.Log.Error("failed to clear canary annotations", zap.Error(err), zap.String("deploymentconfig", dc.GetName()))
+		return err
+	}
+
+	outcomeCounter.With(prometheus.Labels{"deploymentconfig": dc.GetName(), "outcome": "promoted"}).Inc()
+	verdicts.Count(dc)
+	l.Log.Info(fmt.Sprintf("canary for %s completed, deployment rolled out", dc.GetName()), zap.String("deploymentconfig", dc.GetName()))
+	return nil
+}
+
+// failRollout restores the previous image in the deploymentconfig, or moves
+// the imagestream tag back to it, and marks the canary image as failed.
+// Openshift scales the previous replication controller back up on a failed
+// rollout, so the canary is no longer needed.
+func (p *PodWorker) failRollout(pod *apiv1.Pod, dc *v1.DeploymentConfig, rcName string) error {
+	image := dc.Annotations["canary-image"]
+	ref, viaTag := dc.Annotations[promotedTagAnnotation]
+	if previous := dc.Annotations["canary-previous-image"]; viaTag && previous != "" {
+		// before the annotations are cleared so that a failure is retried
+		if err := p.retag(ref, previous); err != nil {
+			l.Log.Error("failed to move imagestream tag back", zap.Error(err), zap.String("tag", ref))
+			return err
+		}
+	}
+
+	_, err := client.UpdateDeploymentConfig(p.deploymentsClient.DeploymentConfigs(client.Namespace), dc, func(dc *v1.DeploymentConfig) error {
+		if previous, ok := dc.Annotations["canary-previous-image"]; ok && !viaTag {
+			setContainerImage(dc, previous)
+		}
+		markFailed(dc, image, "rollout")
+		ClearPromotion(dc)
+		delete(dc.Annotations, "canary-pod")
+		return nil
+	})
+	if err != nil {
+		l.Log.Error("failed to roll back deployment", zap.Error(err), zap.String("deploymentconfig", dc.GetName()))
+		return err
+	}
+
+	outcomeCounter.With(prometheus.Labels{"deploymentconfig": dc.GetName(), "outcome": "rollout-failed"}).Inc()
+	l.Log.Error(fmt.Sprintf("rollout %s of canary image failed, rolled back", rcName),
+		zap.String("deploymentconfig", dc.GetName()), zap.String("canary", image))
+
+	if err := p.deletePod(pod); err != nil {
+		l.Log.Error("failed to delete canary pod", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// ClearPromotion removes the annotations of the awaiting-approval and
+// promoting phases, it is meant to be called from the mutate function of an
+// update
+func ClearPromotion(dc *v1.DeploymentConfig) {
+	delete(dc.Annotations, "canary-phase")
+	delete(dc.Annotations, "canary-rollout-from")
+	delete(dc.Annotations, "canary-previous-image")
+	delete(dc.Annotations, promotedTagAnnotation)
+	delete(dc.Annotations, approval.AwaitingSince)
+	delete(dc.Annotations, approval.ApprovedBy)
+}
+
+func hasConfigChangeTrigger(dc *v1.DeploymentConfig) bool {
+	// a deploymentconfig without triggers defaults to a config change trigger
+	if dc.Spec.Triggers == nil {
+		return true
+	}
+	for _, trigger := range dc.Spec.Triggers {
+		if trigger.Type == v1.DeploymentTriggerOnConfigChange {
+			return true
+		}
+	}
+	return false
+}
+
+func rcReady(rc *apiv1.ReplicationController) bool {
+	replicas := int32(1)
+	if rc.Spec.Replicas != nil {
+		replicas = *rc.Spec.Replicas
+	}
+	return rc.Status.ReadyReplicas >= replicas
+}
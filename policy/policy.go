@@ -0,0 +1,157 @@
+// Package policy restricts the images canaries may run.  Anyone who can
+// annotate a deploymentconfig can set canary-image, so the images are checked
+// against rules set globally, on the namespace and on the deploymentconfig.
+// Each of them can only narrow down what the others allow.
+package policy
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	v1 "github.com/openshift/api/apps/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redhatinsights/miniop/client"
+	l "github.com/redhatinsights/miniop/logger"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/api/errors"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func init() {
+	l.InitLogger()
+	viper.SetDefault("POLICY_REPOSITORIES", "")
+	viper.SetDefault("POLICY_REQUIRE_DIGEST", false)
+}
+
+const (
+	// RepositoriesAnnotation lists the allowed repositories on the namespace
+	// or deploymentconfig
+	RepositoriesAnnotation = "canary-allowed-repositories"
+	// RequireDigestAnnotation requires images to be referenced by digest when
+	// set to "true" on the namespace or deploymentconfig
+	RequireDigestAnnotation = "canary-require-digest"
+
+	// Reason is recorded in canary-fail-reason for rejected images
+	Reason = "policy"
+)
+
+var rejectedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "canary_policy_rejected_total",
+	Help: "A count of canary images rejected by the image policy per deploymentconfig",
+}, []string{"deploymentconfig"})
+
+// Violation is returned for images the policy doesn't allow
+type Violation struct {
+	Image  string
+	Reason string
+}
+
+func (v *Violation) Error() string {
+	return fmt.Sprintf("image %s is not allowed: %s", v.Image, v.Reason)
+}
+
+// Rules is one layer of the policy
+type Rules struct {
+	// Source describes where the rules were set
+	Source string
+	// Repositories are the allowed repositories, any repository is allowed
+	// if empty.  An entry allows the repository itself and everything below
+	// it, and may contain path.Match wildcards.
+	Repositories []string
+	// RequireDigest only allows images referenced by digest
+	RequireDigest bool
+}
+
+// ParseRules parses a comma separated list of repositories
+func ParseRules(source, repositories string, requireDigest bool) Rules {
+	rules := Rules{Source: source, RequireDigest: requireDigest}
+	for _, repository := range strings.Split(repositories, ",") {
+		if repository = strings.TrimSpace(repository); repository != "" {
+			rules.Repositories = append(rules.Repositories, strings.TrimSuffix(repository, "/"))
+		}
+	}
+	return rules
+}
+
+func annotationRules(source string, annotations map[string]string) Rules {
+	return ParseRules(source, annotations[RepositoriesAnnotation], annotations[RequireDigestAnnotation] == "true")
+}
+
+// Check returns a Violation if image breaks the rules
+func (r Rules) Check(image string) error {
+	repository, _ := client.SplitRepository(image)
+	if at := strings.Index(image, "@"); at >= 0 {
+		repository = image[:at]
+	} else if r.RequireDigest {
+		return &Violation{Image: image, Reason: fmt.Sprintf("%s requires a digest reference", r.Source)}
+	}
+
+	if len(r.Repositories) == 0 {
+		return nil
+	}
+	for _, allowed := range r.Repositories {
+		if repository == allowed || strings.HasPrefix(repository, allowed+"/") {
+			return nil
+		}
+		if matched, _ := path.Match(allowed, repository); matched {
+			return nil
+		}
+	}
+	return &Violation{Image: image, Reason: fmt.Sprintf("repository %s is not allowed by %s", repository, r.Source)}
+}
+
+// Policy reads the namespace rules from the namespace cache.  A nil Policy
+// only applies the global and deploymentconfig rules.
+type Policy struct {
+	namespaces cache.SharedIndexInformer
+}
+
+// New returns the policy reading the shared namespace informer, or nil when
+// miniop may not watch namespaces
+func New(informers *client.Informers) *Policy {
+	if informers.Namespaces == nil {
+		return nil
+	}
+	return NewPolicy(informers.Namespaces.Informer())
+}
+
+// NewPolicy returns a policy reading the given namespace informer
+func NewPolicy(namespaces cache.SharedIndexInformer) *Policy {
+	return &Policy{namespaces: namespaces}
+}
+
+// Rules returns the layers of rules that apply to dc
+func (p *Policy) Rules(dc *v1.DeploymentConfig) []Rules {
+	rules := []Rules{ParseRules("global policy", viper.GetString("POLICY_REPOSITORIES"), viper.GetBool("POLICY_REQUIRE_DIGEST"))}
+
+	if p != nil {
+		ns, err := corelisters.NewNamespaceLister(p.namespaces.GetIndexer()).Get(client.Namespace)
+		if err != nil && !errors.IsNotFound(err) {
+			l.Log.Error("failed to read namespace", zap.Error(err))
+		} else if err == nil {
+			rules = append(rules, annotationRules(fmt.Sprintf("namespace %s", ns.GetName()), ns.Annotations))
+		}
+	}
+
+	return append(rules, annotationRules(fmt.Sprintf("deploymentconfig %s", dc.GetName()), dc.Annotations))
+}
+
+// Check returns a Violation if any rule for dc doesn't allow image
+func (p *Policy) Check(dc *v1.DeploymentConfig, image string) error {
+	for _, rules := range p.Rules(dc) {
+		if err := rules.Check(image); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rejected logs and counts an image rejected for dc
+func Rejected(dc *v1.DeploymentConfig, violation *Violation) {
+	rejectedCounter.With(prometheus.Labels{"deploymentconfig": dc.GetName()}).Inc()
+	l.Log.Info(violation.Error(), zap.String("deploymentconfig", dc.GetName()), zap.String("canary", violation.Image))
+}
@@ -0,0 +1,58 @@
+package policy
+
+import (
+	"testing"
+
+	v1 "github.com/openshift/api/apps/v1"
+	"github.com/spf13/viper"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRulesCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   Rules
+		image   string
+		allowed bool
+	}{
+		{"no rules", ParseRules("test", "", false), "docker.io/anything:latest", true},
+		{"exact repository", ParseRules("test", "quay.io/myorg/myapp", false), "quay.io/myorg/myapp:v2", true},
+		{"below organization", ParseRules("test", "quay.io/myorg/", false), "quay.io/myorg/myapp@sha256:abc", true},
+		{"other organization", ParseRules("test", "quay.io/myorg", false), "quay.io/myorgs/myapp:v2", false},
+		{"other registry", ParseRules("test", "quay.io/myorg", false), "docker.io/myorg/myapp:v2", false},
+		{"wildcard", ParseRules("test", "quay.io/*/myapp", false), "quay.io/other/myapp:v2", true},
+		{"second entry", ParseRules("test", "quay.io/myorg, registry.example.com:5000", false), "registry.example.com:5000/myapp:v2", true},
+		{"digest required", ParseRules("test", "", true), "quay.io/myorg/myapp:v2", false},
+		{"digest given", ParseRules("test", "quay.io/myorg", true), "quay.io/myorg/myapp@sha256:abc", true},
+	}
+	for _, test := range tests {
+		err := test.rules.Check(test.image)
+		if allowed := err == nil; allowed != test.allowed {
+			t.Errorf("%s: expected allowed %v, got %v", test.name, test.allowed, err)
+		}
+		if _, ok := err.(*Violation); err != nil && !ok {
+			t.Errorf("%s: expected a Violation, got %v", test.name, err)
+		}
+	}
+}
+
+func TestDeploymentConfigOnlyNarrows(t *testing.T) {
+	viper.Set("POLICY_REPOSITORIES", "quay.io/myorg")
+	defer viper.Set("POLICY_REPOSITORIES", "")
+
+	dc := &v1.DeploymentConfig{ObjectMeta: metav1.ObjectMeta{
+		Name:        "testing",
+		Annotations: map[string]string{RepositoriesAnnotation: "docker.io/evil, quay.io/myorg/myapp"},
+	}}
+	var p *Policy
+
+	if err := p.Check(dc, "docker.io/evil/miner:latest"); err == nil {
+		t.Error("deploymentconfig widened the global policy")
+	}
+	if err := p.Check(dc, "quay.io/myorg/other:latest"); err == nil {
+		t.Error("deploymentconfig rules were not applied")
+	}
+	if err := p.Check(dc, "quay.io/myorg/myapp:latest"); err != nil {
+		t.Errorf("unexpected violation: %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	v1 "github.com/openshift/api/apps/v1"
+	appsv1 "github.com/openshift/client-go/apps/clientset/versioned/typed/apps/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redhatinsights/miniop/client"
+	ctl "github.com/redhatinsights/miniop/controller"
+	l "github.com/redhatinsights/miniop/logger"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// Action is something the schedule can hold back
+type Action string
+
+const (
+	// Spawn starts a canary
+	Spawn Action = "spawn"
+	// Promote rolls the canary image out to the deploymentconfig
+	Promote Action = "promote"
+)
+
+const (
+	// BlockedAnnotation tells why an action is held back
+	BlockedAnnotation = "canary-blocked"
+	// NextEligibleAnnotation tells when the action will be allowed again
+	NextEligibleAnnotation = "canary-next-eligible"
+)
+
+// recheck is used when there is no eligible time within the horizon or the
+// schedule is invalid
+const recheck = time.Hour
+
+var (
+	blockedGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "canary_schedule_blocked",
+		Help: "Whether an action is held back by the schedule per deploymentconfig",
+	}, []string{"deploymentconfig", "action"})
+
+	nextEligibleGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "canary_schedule_next_eligible_timestamp_seconds",
+		Help: "When the action held back by the schedule will be allowed per deploymentconfig",
+	}, []string{"deploymentconfig", "action"})
+)
+
+// Blocks returns true if the schedule applies to action for dc, see the
+// canary-schedule-blocks annotation and SCHEDULE_BLOCKS
+func Blocks(dc *v1.DeploymentConfig, action Action) bool {
+	blocks := viper.GetString("SCHEDULE_BLOCKS")
+	if b, ok := dc.Annotations["canary-schedule-blocks"]; ok {
+		blocks = b
+	}
+	for _, blocked := range split(blocks, ",") {
+		if Action(blocked) == action {
+			return true
+		}
+	}
+	return false
+}
+
+// Gate returns nil and the current deploymentconfig if action may happen at
+// now.  Otherwise it records why and until when the action is held back in
+// the canary-blocked and canary-next-eligible annotations and returns a
+// RequeueAfter for the next eligible time.  An invalid schedule holds back
+// the action.
+func Gate(dcs appsv1.DeploymentConfigInterface, dc *v1.DeploymentConfig, action Action, now time.Time) (*v1.DeploymentConfig, error) {
+	name := dc.GetName()
+	if !Blocks(dc, action) {
+		// the schedule doesn't apply (anymore), its series are dropped
+		updated, err := clearBlocked(dcs, dc, action)
+		forget(name, action)
+		return updated, err
+	}
+
+	s, err := ForDeploymentConfig(dc)
+	if err != nil {
+		l.Log.Error("deployment has an invalid schedule", zap.Error(err), zap.String("deploymentconfig", name))
+		return setBlocked(dcs, dc, action, fmt.Sprintf("invalid schedule: %v", err), time.Time{}, now)
+	}
+
+	next, ok := s.Next(now)
+	if ok && next.Equal(now) {
+		return clearBlocked(dcs, dc, action)
+	}
+
+	reason := "outside of the allowed windows"
+	if freeze, frozen := s.Frozen(now); frozen {
+		reason = fmt.Sprintf("frozen until %s", freeze.End.In(s.Location).Format(time.RFC3339))
+	}
+	return setBlocked(dcs, dc, action, reason, next, now)
+}
+
+// Forget stops exporting the schedule of the deploymentconfig called name,
+// e.g. once it was deleted
+func Forget(name string) {
+	for _, action := range []Action{Spawn, Promote} {
+		forget(name, action)
+	}
+}
+
+func forget(name string, action Action) {
+	labels := prometheus.Labels{"deploymentconfig": name, "action": string(action)}
+	blockedGauge.Delete(labels)
+	nextEligibleGauge.Delete(labels)
+}
+
+func setBlocked(dcs appsv1.DeploymentConfigInterface, dc *v1.DeploymentConfig, action Action, reason string, next, now time.Time) (*v1.DeploymentConfig, error) {
+	blocked := fmt.Sprintf("%s: %s", action, reason)
+	nextEligible := ""
+	wait := recheck
+	if !next.IsZero() {
+		nextEligible = next.UTC().Format(time.RFC3339)
+		wait = next.Sub(now)
+		nextEligibleGauge.With(prometheus.Labels{"deploymentconfig": dc.GetName(), "action": string(action)}).Set(float64(next.Unix()))
+	}
+	blockedGauge.With(prometheus.Labels{"deploymentconfig": dc.GetName(), "action": string(action)}).Set(1)
+
+	if dc.Annotations[BlockedAnnotation] != blocked || dc.Annotations[NextEligibleAnnotation] != nextEligible {
+		l.Log.Info(fmt.Sprintf("%s for %s held back by schedule", action, dc.GetName()),
+			zap.String("deploymentconfig", dc.GetName()), zap.String("reason", reason), zap.String("next", nextEligible))
+		_, err := client.UpdateDeploymentConfig(dcs, dc, func(dc *v1.DeploymentConfig) error {
+			dc.Annotations[BlockedAnnotation] = blocked
+			if nextEligible == "" {
+				delete(dc.Annotations, NextEligibleAnnotation)
+			} else {
+				dc.Annotations[NextEligibleAnnotation] = nextEligible
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to record blocked %s: %v", action, err)
+		}
+	}
+	return nil, ctl.RequeueAfter(wait)
+}
+
+func clearBlocked(dcs appsv1.DeploymentConfigInterface, dc *v1.DeploymentConfig, action Action) (*v1.DeploymentConfig, error) {
+	blockedGauge.With(prometheus.Labels{"deploymentconfig": dc.GetName(), "action": string(action)}).Set(0)
+	nextEligibleGauge.Delete(prometheus.Labels{"deploymentconfig": dc.GetName(), "action": string(action)})
+
+	if !strings.HasPrefix(dc.Annotations[BlockedAnnotation], string(action)+":") {
+		return dc, nil
+	}
+	return client.UpdateDeploymentConfig(dcs, dc, func(dc *v1.DeploymentConfig) error {
+		delete(dc.Annotations, BlockedAnnotation)
+		delete(dc.Annotations, NextEligibleAnnotation)
+		return nil
+	})
+}
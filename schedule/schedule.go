@@ -0,0 +1,203 @@
+// Package schedule restricts when canaries may be started and promoted.  A
+// schedule consists of allowed windows, each a cron expression for when the
+// window opens and how long it stays open, and freeze ranges during which
+// nothing is allowed regardless of the windows.
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	v1 "github.com/openshift/api/apps/v1"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	viper.SetDefault("SCHEDULE_BLOCKS", "spawn,promote")
+}
+
+// horizon is how far ahead the next eligible time is searched
+const horizon = 366 * 24 * time.Hour
+
+// maxWindow is the longest an allowed window may stay open
+const maxWindow = 7 * 24 * time.Hour
+
+// Window is a period during which actions are allowed
+type Window struct {
+	Start    *Cron
+	Duration time.Duration
+}
+
+// Freeze is a period during which no actions are allowed
+type Freeze struct {
+	Start, End time.Time
+}
+
+// Schedule decides when actions are allowed.  Without windows any time
+// outside of the freezes is allowed.
+type Schedule struct {
+	Windows  []Window
+	Freezes  []Freeze
+	Location *time.Location
+}
+
+// Parse builds a schedule.  windows is a semicolon separated list of cron
+// expressions each followed by a duration, e.g. "0 9 * * mon-fri 8h".
+// freezes is a comma separated list of start/end ranges, either RFC3339 times
+// or dates, an end date includes the whole day.  Cron expressions and dates
+// are evaluated in timezone, UTC if empty.
+func Parse(windows, freezes, timezone string) (*Schedule, error) {
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time zone %q: %v", timezone, err)
+	}
+	s := &Schedule{Location: loc}
+
+	for _, spec := range split(windows, ";") {
+		fields := strings.Fields(spec)
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("window %q must be a cron expression followed by a duration", spec)
+		}
+		cron, err := ParseCron(strings.Join(fields[:5], " "))
+		if err != nil {
+			return nil, err
+		}
+		duration, err := time.ParseDuration(fields[5])
+		if err != nil || duration <= 0 || duration > maxWindow {
+			return nil, fmt.Errorf("window %q must last between 0 and %s", spec, maxWindow)
+		}
+		s.Windows = append(s.Windows, Window{Start: cron, Duration: duration})
+	}
+
+	for _, spec := range split(freezes, ",") {
+		bounds := strings.Split(spec, "/")
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("freeze %q must be a start/end range", spec)
+		}
+		start, err := parseTime(bounds[0], loc, false)
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseTime(bounds[1], loc, true)
+		if err != nil {
+			return nil, err
+		}
+		if !end.After(start) {
+			return nil, fmt.Errorf("freeze %q ends before it starts", spec)
+		}
+		s.Freezes = append(s.Freezes, Freeze{Start: start, End: end})
+	}
+	return s, nil
+}
+
+func split(s, sep string) []string {
+	var parts []string
+	for _, part := range strings.Split(s, sep) {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+func parseTime(s string, loc *time.Location, end bool) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither an RFC3339 time nor a date", s)
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// Frozen returns the freeze t falls into
+func (s *Schedule) Frozen(t time.Time) (Freeze, bool) {
+	for _, freeze := range s.Freezes {
+		if !t.Before(freeze.Start) && t.Before(freeze.End) {
+			return freeze, true
+		}
+	}
+	return Freeze{}, false
+}
+
+// Next returns the earliest time from t on at which actions are allowed.  It
+// returns false if there is none within a year.
+func (s *Schedule) Next(t time.Time) (time.Time, bool) {
+	if len(s.Windows) == 0 {
+		// only freezes, which may overlap
+		for {
+			freeze, ok := s.Frozen(t)
+			if !ok {
+				return t, true
+			}
+			t = freeze.End
+		}
+	}
+
+	// alternate between skipping to the next open window and to the end of
+	// the freeze it falls into until both agree
+	limit := t.Add(horizon)
+	for t.Before(limit) {
+		open, ok := s.nextOpen(t, limit)
+		if !ok {
+			break
+		}
+		freeze, frozen := s.Frozen(open)
+		if !frozen {
+			return open, true
+		}
+		t = freeze.End
+	}
+	return time.Time{}, false
+}
+
+// nextOpen returns the earliest time from t on that falls into a window
+func (s *Schedule) nextOpen(t, limit time.Time) (time.Time, bool) {
+	var next time.Time
+	for _, window := range s.Windows {
+		// the earliest start of the window that is still open at t
+		start, ok := window.Start.Next(t.Add(-window.Duration).Add(time.Nanosecond).In(s.Location), limit)
+		if !ok {
+			continue
+		}
+		if !start.After(t) {
+			return t, true
+		}
+		if next.IsZero() || start.Before(next) {
+			next = start
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// Allowed returns true if actions are allowed at t
+func (s *Schedule) Allowed(t time.Time) bool {
+	next, ok := s.Next(t)
+	return ok && next.Equal(t)
+}
+
+// ForDeploymentConfig returns the schedule of dc.  The canary-windows and
+// canary-timezone annotations replace the global SCHEDULE_WINDOWS and
+// SCHEDULE_TIMEZONE, freezes from canary-freezes apply in addition to the
+// global SCHEDULE_FREEZES.
+func ForDeploymentConfig(dc *v1.DeploymentConfig) (*Schedule, error) {
+	windows := viper.GetString("SCHEDULE_WINDOWS")
+	if w, ok := dc.Annotations["canary-windows"]; ok {
+		windows = w
+	}
+	timezone := viper.GetString("SCHEDULE_TIMEZONE")
+	if tz, ok := dc.Annotations["canary-timezone"]; ok {
+		timezone = tz
+	}
+	freezes := viper.GetString("SCHEDULE_FREEZES")
+	if f, ok := dc.Annotations["canary-freezes"]; ok {
+		freezes = freezes + "," + f
+	}
+	return Parse(windows, freezes, timezone)
+}
@@ -0,0 +1,201 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	v1 "github.com/openshift/api/apps/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redhatinsights/miniop/client/fake"
+	ctl "github.com/redhatinsights/miniop/controller"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func at(s string) time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestCron(t *testing.T) {
+	tests := []struct {
+		spec  string
+		time  string
+		match bool
+	}{
+		{"* * * * *", "2026-10-19T10:15:00Z", true},
+		{"0 9 * * mon-fri", "2026-10-19T09:00:00Z", true},  // monday
+		{"0 9 * * mon-fri", "2026-10-18T09:00:00Z", false}, // sunday
+		{"0 9 * * mon-fri", "2026-10-19T09:01:00Z", false},
+		{"*/15 * * * *", "2026-10-19T10:45:00Z", true},
+		{"*/15 * * * *", "2026-10-19T10:40:00Z", false},
+		{"0 0 * * 7", "2026-10-18T00:00:00Z", true},
+		{"0 0 1 * mon", "2026-10-19T00:00:00Z", true}, // day of week or month
+		{"0 0 1 jan,jul *", "2026-07-01T00:00:00Z", true},
+		{"30 8-10/2 * * *", "2026-10-19T10:30:00Z", true},
+		{"30 8-10/2 * * *", "2026-10-19T09:30:00Z", false},
+	}
+
+	for _, test := range tests {
+		c, err := ParseCron(test.spec)
+		if err != nil {
+			t.Errorf("%q: %v", test.spec, err)
+			continue
+		}
+		if match := c.Matches(at(test.time)); match != test.match {
+			t.Errorf("%q at %s: expected %v", test.spec, test.time, test.match)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	tests := []struct {
+		spec string
+		from string
+		next string
+	}{
+		{"0 9 * * mon-fri", "2026-10-19T09:00:00Z", "2026-10-19T09:00:00Z"},
+		{"0 9 * * mon-fri", "2026-10-19T09:00:01Z", "2026-10-20T09:00:00Z"},
+		{"0 9 * * mon-fri", "2026-10-23T12:00:00Z", "2026-10-26T09:00:00Z"}, // friday
+		{"*/15 * * * *", "2026-10-19T10:46:00Z", "2026-10-19T11:00:00Z"},
+		{"0 0 1 jan,jul *", "2026-07-01T00:01:00Z", "2027-01-01T00:00:00Z"},
+		{"30 23 31 * *", "2026-10-19T00:00:00Z", "2026-10-31T23:30:00Z"},
+		{"0 0 1 * mon", "2026-10-20T00:00:00Z", "2026-10-26T00:00:00Z"},
+	}
+
+	for _, test := range tests {
+		c, err := ParseCron(test.spec)
+		if err != nil {
+			t.Fatalf("%q: %v", test.spec, err)
+		}
+		next, ok := c.Next(at(test.from), at(test.from).Add(horizon))
+		if !ok || !next.Equal(at(test.next)) {
+			t.Errorf("%q from %s: expected %s, got %s", test.spec, test.from, test.next, next)
+		}
+	}
+
+	leap, _ := ParseCron("0 0 29 feb *")
+	if next, ok := leap.Next(at("2026-10-19T00:00:00Z"), at("2026-10-19T00:00:00Z").Add(horizon)); ok {
+		t.Errorf("expected no leap day within a year, got %s", next)
+	}
+}
+
+func TestCronInvalid(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * * * foo", "5-1 * * * *", "*/0 * * * *"} {
+		if _, err := ParseCron(spec); err == nil {
+			t.Errorf("expected %q to be invalid", spec)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	// weekdays from 9 to 17 in Prague, CEST is UTC+2
+	s, err := Parse("0 9 * * mon-fri 8h", "2026-10-20/2026-10-20", "Europe/Prague")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		now  string
+		next string
+	}{
+		{"2026-10-19T08:30:00Z", "2026-10-19T08:30:00Z"}, // monday 10:30
+		{"2026-10-19T15:00:00Z", "2026-10-21T07:00:00Z"}, // tuesday is frozen
+		{"2026-10-17T12:00:00Z", "2026-10-19T07:00:00Z"}, // saturday
+		{"2026-10-23T14:59:00Z", "2026-10-23T14:59:00Z"}, // friday 16:59
+		{"2026-10-23T15:00:00Z", "2026-10-26T08:00:00Z"}, // friday 17:00, CET from sunday
+	}
+
+	for _, test := range tests {
+		next, ok := s.Next(at(test.now))
+		if !ok || !next.Equal(at(test.next)) {
+			t.Errorf("at %s: expected %s, got %s", test.now, test.next, next)
+		}
+	}
+}
+
+func TestNextFreezesOnly(t *testing.T) {
+	s, err := Parse("", "2026-12-20T00:00:00Z/2026-12-27T00:00:00Z,2026-12-26/2027-01-03", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !s.Allowed(at("2026-12-19T12:00:00Z")) {
+		t.Error("expected to be allowed before the freeze")
+	}
+	next, ok := s.Next(at("2026-12-24T12:00:00Z"))
+	if !ok || !next.Equal(at("2027-01-04T00:00:00Z")) {
+		t.Errorf("expected the overlapping freezes to end on Jan 4th, got %s", next)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, args := range [][3]string{
+		{"0 9 * * *", "", ""},
+		{"0 9 * * * 30d", "", ""},
+		{"", "2026-12-20", ""},
+		{"", "2026-12-20/2026-12-19", ""},
+		{"", "", "Nowhere/Special"},
+	} {
+		if _, err := Parse(args[0], args[1], args[2]); err == nil {
+			t.Errorf("expected %q to be invalid", args)
+		}
+	}
+}
+
+func TestGate(t *testing.T) {
+	dc := &v1.DeploymentConfig{ObjectMeta: metav1.ObjectMeta{
+		Name:        "testing",
+		Annotations: map[string]string{"canary-freezes": "2026-12-20T00:00:00Z/2026-12-27T00:00:00Z"},
+	}}
+	apps := fake.NewApps(dc)
+	dcs := apps.DeploymentConfigs("test")
+
+	_, err := Gate(dcs, apps.Stored("testing"), Promote, at("2026-12-24T12:00:00Z"))
+	if after, ok := err.(ctl.RequeueAfter); !ok || time.Duration(after) != 60*time.Hour {
+		t.Fatalf("expected a requeue at the end of the freeze, got %v", err)
+	}
+	blocked := apps.Stored("testing")
+	if blocked.Annotations[BlockedAnnotation] != "promote: frozen until 2026-12-27T00:00:00Z" {
+		t.Errorf("blocked state not recorded: %v", blocked.Annotations)
+	}
+	if blocked.Annotations[NextEligibleAnnotation] != "2026-12-27T00:00:00Z" {
+		t.Errorf("next eligible time not recorded: %v", blocked.Annotations)
+	}
+
+	updated, err := Gate(dcs, blocked, Promote, at("2026-12-28T12:00:00Z"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := updated.Annotations[BlockedAnnotation]; ok {
+		t.Error("blocked state was not cleared")
+	}
+
+	dc.Annotations["canary-schedule-blocks"] = "spawn"
+	if _, err := Gate(dcs, dc, Promote, at("2026-12-24T12:00:00Z")); err != nil {
+		t.Errorf("promotion should not be held back: %v", err)
+	}
+	labels := prometheus.Labels{"deploymentconfig": "testing", "action": string(Promote)}
+	if blockedGauge.Delete(labels) {
+		t.Error("the schedule of a promotion it no longer holds back is still exported")
+	}
+}
+
+func TestForget(t *testing.T) {
+	dc := &v1.DeploymentConfig{ObjectMeta: metav1.ObjectMeta{
+		Name:        "forgotten",
+		Annotations: map[string]string{"canary-freezes": "2026-12-20T00:00:00Z/2026-12-27T00:00:00Z"},
+	}}
+	apps := fake.NewApps(dc)
+	Gate(apps.DeploymentConfigs("test"), apps.Stored("forgotten"), Promote, at("2026-12-24T12:00:00Z"))
+
+	Forget("forgotten")
+	labels := prometheus.Labels{"deploymentconfig": "forgotten", "action": string(Promote)}
+	for name, gauge := range map[string]*prometheus.GaugeVec{"blocked": blockedGauge, "next eligible": nextEligibleGauge} {
+		if gauge.Delete(labels) {
+			t.Errorf("the %s series of a deleted deploymentconfig is still exported", name)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+// Package signature verifies detached image signatures before canaries are
+// started.  Signatures are read from a signature store laid out like the
+// lookaside storage of containers/image:
+//
+//	<store>/<repository path>@sha256=<digest>/signature-<n>
+//
+// and have to be "atomic container signature" claims signed with one of the
+// configured OpenPGP public keys.
+package signature
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/redhatinsights/miniop/client"
+	l "github.com/redhatinsights/miniop/logger"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/openpgp"
+)
+
+func init() {
+	l.InitLogger()
+	viper.SetDefault("SIGNATURE_KEYS", "")
+	viper.SetDefault("SIGNATURE_STORE", "")
+}
+
+// Reason is recorded in canary-fail-reason for images that failed
+// verification
+const Reason = "signature"
+
+// maxSignatures limits how many signatures are read for an image
+const maxSignatures = 16
+
+const claimType = "atomic container signature"
+
+// Failure is returned for images without a valid signature
+type Failure struct {
+	Image  string
+	Reason string
+}
+
+func (f *Failure) Error() string {
+	return fmt.Sprintf("image %s failed signature verification: %s", f.Image, f.Reason)
+}
+
+// claim is the signed payload
+type claim struct {
+	Critical struct {
+		Type     string `json:"type"`
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+	} `json:"critical"`
+}
+
+// Verifier checks images against a keyring.  A nil Verifier accepts every
+// image.
+type Verifier struct {
+	Client  *http.Client
+	store   string
+	keyring openpgp.EntityList
+}
+
+// NewVerifier returns a verifier reading signatures from store, a http(s) or
+// file URL, and accepting signatures of the armored public keys
+func NewVerifier(store string, armoredKeys []byte) (*Verifier, error) {
+	keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(armoredKeys))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public keys: %v", err)
+	}
+	if store == "" {
+		return nil, fmt.Errorf("no signature store configured")
+	}
+
+	transport := &http.Transport{}
+	transport.RegisterProtocol("file", http.NewFileTransport(http.Dir("/")))
+	return &Verifier{
+		Client:  &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		store:   strings.TrimSuffix(store, "/"),
+		keyring: keyring,
+	}, nil
+}
+
+// FromConfig returns the verifier configured by SIGNATURE_KEYS and
+// SIGNATURE_STORE, or nil if no keys are configured
+func FromConfig() (*Verifier, error) {
+	path := viper.GetString("SIGNATURE_KEYS")
+	if path == "" {
+		return nil, nil
+	}
+	keys, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewVerifier(viper.GetString("SIGNATURE_STORE"), keys)
+}
+
+// Verify returns a Failure unless image is referenced by digest and one of
+// its signatures is valid.  Other errors mean the signatures couldn't be
+// read and are worth retrying.
+func (v *Verifier) Verify(image string) error {
+	if v == nil {
+		return nil
+	}
+
+	at := strings.Index(image, "@")
+	if at < 0 {
+		return &Failure{Image: image, Reason: "not referenced by digest"}
+	}
+	repository, digest := image[:at], image[at+1:]
+	parts := strings.SplitN(repository, "/", 2)
+	if len(parts) != 2 {
+		return &Failure{Image: image, Reason: "no registry host"}
+	}
+
+	reasons := []string{}
+	for n := 1; n <= maxSignatures; n++ {
+		blob, err := v.fetch(fmt.Sprintf("%s/%s@%s/signature-%d", v.store, parts[1], strings.Replace(digest, ":", "=", 1), n))
+		if err != nil {
+			return err
+		} else if blob == nil {
+			break
+		}
+
+		if err := v.check(blob, repository, digest); err != nil {
+			reasons = append(reasons, fmt.Sprintf("signature-%d: %v", n, err))
+			continue
+		}
+		return nil
+	}
+
+	if len(reasons) == 0 {
+		return &Failure{Image: image, Reason: "no signatures found"}
+	}
+	return &Failure{Image: image, Reason: strings.Join(reasons, "; ")}
+}
+
+// fetch returns the signature at url or nil if there is none
+func (v *Verifier) fetch(url string) ([]byte, error) {
+	resp, err := v.Client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return ioutil.ReadAll(resp.Body)
+	case http.StatusNotFound, http.StatusForbidden:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("signature store answered %s for %s", resp.Status, url)
+	}
+}
+
+// check verifies the signature and that its claim is about the image
+func (v *Verifier) check(blob []byte, repository, digest string) error {
+	md, err := openpgp.ReadMessage(bytes.NewReader(blob), v.keyring, nil, nil)
+	if err != nil {
+		return err
+	}
+	if !md.IsSigned || md.SignedBy == nil {
+		return fmt.Errorf("not signed by a trusted key")
+	}
+	payload, err := ioutil.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		return err
+	}
+	// only known once the body was read
+	if md.SignatureError != nil {
+		return md.SignatureError
+	}
+
+	var c claim
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return fmt.Errorf("invalid claim: %v", err)
+	}
+	if c.Critical.Type != claimType {
+		return fmt.Errorf("unexpected claim type %q", c.Critical.Type)
+	}
+	if c.Critical.Image.DockerManifestDigest != digest {
+		return fmt.Errorf("signed for digest %s", c.Critical.Image.DockerManifestDigest)
+	}
+	signed, _ := client.SplitRepository(c.Critical.Identity.DockerReference)
+	if at := strings.Index(c.Critical.Identity.DockerReference, "@"); at >= 0 {
+		signed = c.Critical.Identity.DockerReference[:at]
+	}
+	if signed != repository {
+		return fmt.Errorf("signed for %s", c.Critical.Identity.DockerReference)
+	}
+	return nil
+}
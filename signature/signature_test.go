@@ -0,0 +1,142 @@
+package signature
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+const (
+	repository = "quay.io/myorg/myapp"
+	digest     = "sha256:0123"
+	image      = repository + "@" + digest
+)
+
+func newKey(t *testing.T) (*openpgp.Entity, []byte) {
+	t.Helper()
+	entity, err := openpgp.NewEntity("release", "", "release@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, identity := range entity.Identities {
+		// SHA-256, the default preference isn't compiled in
+		identity.SelfSignature.PreferredHash = []uint8{8}
+	}
+	var keys bytes.Buffer
+	w, err := armor.Encode(&keys, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	return entity, keys.Bytes()
+}
+
+func sign(t *testing.T, signer *openpgp.Entity, reference, digest string) []byte {
+	t.Helper()
+	var signed bytes.Buffer
+	w, err := openpgp.Sign(&signed, signer, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(w, `{"critical": {"type": %q, "identity": {"docker-reference": %q}, "image": {"docker-manifest-digest": %q}}, "optional": {}}`,
+		claimType, reference, digest)
+	w.Close()
+	return signed.Bytes()
+}
+
+// store serves signatures like a lookaside store
+func store(signatures ...[]byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for n, signature := range signatures {
+			if r.URL.Path == fmt.Sprintf("/myorg/myapp@sha256=0123/signature-%d", n+1) {
+				w.Write(signature)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+}
+
+func TestVerify(t *testing.T) {
+	trusted, keys := newKey(t)
+	untrusted, _ := newKey(t)
+
+	tests := []struct {
+		name       string
+		signatures [][]byte
+		image      string
+		valid      bool
+	}{
+		{"valid", [][]byte{sign(t, trusted, repository+":latest", digest)}, image, true},
+		{"valid second", [][]byte{sign(t, untrusted, repository, digest), sign(t, trusted, repository, digest)}, image, true},
+		{"untrusted key", [][]byte{sign(t, untrusted, repository, digest)}, image, false},
+		{"other digest", [][]byte{sign(t, trusted, repository, "sha256:4567")}, image, false},
+		{"other repository", [][]byte{sign(t, trusted, "quay.io/myorg/other", digest)}, image, false},
+		{"not signed", nil, image, false},
+		{"tag reference", nil, repository + ":latest", false},
+	}
+	for _, test := range tests {
+		srv := store(test.signatures...)
+		v, err := NewVerifier(srv.URL, keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = v.Verify(test.image)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("%s: expected valid %v, got %v", test.name, test.valid, err)
+		}
+		if _, ok := err.(*Failure); err != nil && !ok {
+			t.Errorf("%s: expected a Failure, got %v", test.name, err)
+		}
+		srv.Close()
+	}
+}
+
+func TestVerifyFileStore(t *testing.T) {
+	trusted, keys := newKey(t)
+	dir, err := ioutil.TempDir("", "signatures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "myorg", "myapp@sha256=0123")
+	os.MkdirAll(path, 0755)
+	ioutil.WriteFile(filepath.Join(path, "signature-1"), sign(t, trusted, repository, digest), 0644)
+
+	v, err := NewVerifier("file://"+dir, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Verify(image); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestUnreachableStoreIsNotAFailure(t *testing.T) {
+	_, keys := newKey(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	v, err := NewVerifier(srv.URL, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = v.Verify(image)
+	if _, ok := err.(*Failure); err == nil || ok {
+		t.Errorf("expected a retryable error, got %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package stop
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/redhatinsights/miniop/auth"
+	"github.com/redhatinsights/miniop/client"
+	l "github.com/redhatinsights/miniop/logger"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	authzv1 "k8s.io/api/authorization/v1"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// Status is the JSON body served by the emergency stop API
+type Status struct {
+	Engaged bool   `json:"engaged"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// Access returns the attributes callers of the emergency stop API need access
+// to, see auth.RequireAccess
+func Access(verb string) func(r *http.Request) authzv1.ResourceAttributes {
+	return func(r *http.Request) authzv1.ResourceAttributes {
+		return authzv1.ResourceAttributes{
+			Namespace: client.Namespace,
+			Verb:      verb,
+			Resource:  "configmaps",
+			Name:      viper.GetString("STOP_CONFIGMAP"),
+		}
+	}
+}
+
+// StatusHandler reports whether the emergency stop is engaged
+func StatusHandler(s *Switch) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		engaged, reason := s.Engaged()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Status{Engaged: engaged, Reason: reason})
+	}
+}
+
+// EngageHandler engages the emergency stop on behalf of the authenticated
+// user.  The request body may give a reason as {"reason": "..."}.
+func EngageHandler(kube kubernetes.Interface) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Reason string `json:"reason"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, "invalid body", http.StatusBadRequest)
+				return
+			}
+		}
+
+		user := auth.User(r)
+		err := updateConfigMap(kube, func(cm *apiv1.ConfigMap) {
+			cm.Data[Key] = "true"
+			cm.Data[ByKey] = user
+			if body.Reason != "" {
+				cm.Data[ReasonKey] = body.Reason
+			} else {
+				delete(cm.Data, ReasonKey)
+			}
+		})
+		if err != nil {
+			l.Log.Error("failed to engage emergency stop", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		l.Log.Info(fmt.Sprintf("emergency stop engaged by %s", user), zap.String("user", user), zap.String("reason", body.Reason))
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// ReleaseHandler releases the emergency stop engaged through the configmap.
+// A stop engaged through the namespace annotation stays engaged.
+func ReleaseHandler(kube kubernetes.Interface) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := auth.User(r)
+		err := updateConfigMap(kube, func(cm *apiv1.ConfigMap) {
+			delete(cm.Data, Key)
+			delete(cm.Data, ByKey)
+			delete(cm.Data, ReasonKey)
+		})
+		if err != nil {
+			l.Log.Error("failed to release emergency stop", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		l.Log.Info(fmt.Sprintf("emergency stop released by %s", user), zap.String("user", user))
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// updateConfigMap applies mutate to the STOP_CONFIGMAP configmap, creating it
+// if it doesn't exist
+func updateConfigMap(kube kubernetes.Interface, mutate func(*apiv1.ConfigMap)) error {
+	configMaps := kube.CoreV1().ConfigMaps(client.Namespace)
+	name := viper.GetString("STOP_CONFIGMAP")
+
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		cm, err := configMaps.Get(name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			cm = &apiv1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: client.Namespace}, Data: map[string]string{}}
+			mutate(cm)
+			_, err = configMaps.Create(cm)
+			if errors.IsAlreadyExists(err) {
+				// retry as an update
+				return errors.NewConflict(apiv1.Resource("configmaps"), name, err)
+			}
+			return err
+		} else if err != nil {
+			return err
+		}
+
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		mutate(cm)
+		_, err = configMaps.Update(cm)
+		return err
+	})
+}
@@ -0,0 +1,140 @@
+// Package stop implements the emergency stop.  While it is engaged miniop
+// doesn't start or promote canaries and doesn't kill pods, it only logs and
+// counts what it would have done.  The stop is engaged by setting the
+// emergency-stop key of the STOP_CONFIGMAP configmap or the
+// canary-emergency-stop annotation of the namespace to "true".
+package stop
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redhatinsights/miniop/client"
+	ctl "github.com/redhatinsights/miniop/controller"
+	l "github.com/redhatinsights/miniop/logger"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/api/errors"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func init() {
+	l.InitLogger()
+	viper.SetDefault("STOP_CONFIGMAP", "miniop")
+}
+
+const (
+	// Key engages the stop when set to "true" in the configmap
+	Key = "emergency-stop"
+	// ReasonKey and ByKey describe why and by whom the stop was engaged
+	// through the API
+	ReasonKey = "emergency-stop-reason"
+	ByKey     = "emergency-stop-by"
+
+	// NamespaceAnnotation engages the stop when set to "true" on the
+	// namespace
+	NamespaceAnnotation = "canary-emergency-stop"
+)
+
+var suppressedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "emergency_stop_suppressed_total",
+	Help: "A count of actions suppressed by the emergency stop per action and target",
+}, []string{"action", "target"})
+
+// Switch reads the emergency stop from the configmap and namespace caches.
+// A nil Switch is never engaged, a Switch without a namespace cache only
+// reads the configmap.
+type Switch struct {
+	configMaps cache.SharedIndexInformer
+	namespaces cache.SharedIndexInformer
+}
+
+// New returns the switch reading the shared configmap and namespace
+// informers, or only the configmap one when miniop may not watch namespaces
+func New(informers *client.Informers) *Switch {
+	if informers.Namespaces == nil {
+		return NewSwitch(informers.ConfigMaps.Informer(), nil)
+	}
+	return NewSwitch(informers.ConfigMaps.Informer(), informers.Namespaces.Informer())
+}
+
+// NewSwitch returns a switch reading the given configmap and namespace
+// informers, namespaces may be nil
+func NewSwitch(configMaps, namespaces cache.SharedIndexInformer) *Switch {
+	return &Switch{configMaps: configMaps, namespaces: namespaces}
+}
+
+// Engaged returns true and why if the emergency stop is engaged
+func (s *Switch) Engaged() (bool, string) {
+	if s == nil {
+		return false, ""
+	}
+
+	cm, err := corelisters.NewConfigMapLister(s.configMaps.GetIndexer()).ConfigMaps(client.Namespace).Get(viper.GetString("STOP_CONFIGMAP"))
+	if err != nil && !errors.IsNotFound(err) {
+		l.Log.Error("failed to read emergency stop configmap", zap.Error(err))
+	} else if err == nil && cm.Data[Key] == "true" {
+		reason := fmt.Sprintf("configmap %s", cm.GetName())
+		if by, ok := cm.Data[ByKey]; ok {
+			reason = fmt.Sprintf("%s, engaged by %s", reason, by)
+		}
+		if why, ok := cm.Data[ReasonKey]; ok {
+			reason = fmt.Sprintf("%s: %s", reason, why)
+		}
+		return true, reason
+	}
+
+	if s.namespaces == nil {
+		return false, ""
+	}
+	ns, err := corelisters.NewNamespaceLister(s.namespaces.GetIndexer()).Get(client.Namespace)
+	if err != nil && !errors.IsNotFound(err) {
+		l.Log.Error("failed to read namespace", zap.Error(err))
+	} else if err == nil && ns.Annotations[NamespaceAnnotation] == "true" {
+		return true, fmt.Sprintf("namespace %s annotation", ns.GetName())
+	}
+	return false, ""
+}
+
+// Watch requeues everything in the controller when the emergency stop is
+// engaged or released, so that held back work resumes once it is released.
+// Other changes to the configmap or namespace don't requeue anything.  The
+// controller also waits for the caches of the switch to sync, nothing is done
+// before the state of the switch is known.
+func (s *Switch) Watch(c *ctl.Controller) {
+	if s == nil {
+		return
+	}
+	all := s.onChange(c.Indexer.ListKeys)
+	c.Watch(s.configMaps, all)
+	if s.namespaces != nil {
+		c.Watch(s.namespaces, all)
+	}
+}
+
+// onChange returns the keys returned by keys whenever the switch was engaged
+// or released since the last call, and none otherwise
+func (s *Switch) onChange(keys func() []string) func(obj interface{}) []string {
+	var mu sync.Mutex
+	var engaged bool
+	return func(obj interface{}) []string {
+		mu.Lock()
+		defer mu.Unlock()
+		if now, _ := s.Engaged(); now != engaged {
+			engaged = now
+			return keys()
+		}
+		return nil
+	}
+}
+
+// Suppressed logs and counts an action that wasn't taken because the
+// emergency stop is engaged
+func Suppressed(action, target, reason string) {
+	suppressedCounter.With(prometheus.Labels{"action": action, "target": target}).Inc()
+	l.Log.Info(fmt.Sprintf("emergency stop engaged, suppressed %s of %s", action, target),
+		zap.String("action", action), zap.String("target", target), zap.String("reason", reason))
+}
@@ -0,0 +1,134 @@
+package stop
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/redhatinsights/miniop/auth"
+	"github.com/redhatinsights/miniop/client"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+func init() {
+	client.Namespace = "test"
+}
+
+// newSwitch returns a switch whose caches contain objs
+func newSwitch(objs ...interface{}) *Switch {
+	factory := informers.NewSharedInformerFactory(kubefake.NewSimpleClientset(), 0)
+	s := NewSwitch(factory.Core().V1().ConfigMaps().Informer(), factory.Core().V1().Namespaces().Informer())
+	for _, obj := range objs {
+		switch obj.(type) {
+		case *apiv1.ConfigMap:
+			s.configMaps.GetIndexer().Add(obj)
+		case *apiv1.Namespace:
+			s.namespaces.GetIndexer().Add(obj)
+		}
+	}
+	return s
+}
+
+// configMapOnly returns a switch without a namespace cache whose configmap
+// cache contains cms
+func configMapOnly(cms ...*apiv1.ConfigMap) *Switch {
+	s := newSwitch()
+	s.namespaces = nil
+	for _, cm := range cms {
+		s.configMaps.GetIndexer().Add(cm)
+	}
+	return s
+}
+
+func configMap(data map[string]string) *apiv1.ConfigMap {
+	return &apiv1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "miniop", Namespace: "test"}, Data: data}
+}
+
+func TestEngaged(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       *Switch
+		engaged bool
+	}{
+		{"nil switch", nil, false},
+		{"nothing set", newSwitch(), false},
+		{"configmap", newSwitch(configMap(map[string]string{Key: "true", ByKey: "alice"})), true},
+		{"configmap released", newSwitch(configMap(map[string]string{Key: "false"})), false},
+		{"namespace", newSwitch(&apiv1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:        "test",
+			Annotations: map[string]string{NamespaceAnnotation: "true"},
+		}}), true},
+		{"other namespace", newSwitch(&apiv1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:        "other",
+			Annotations: map[string]string{NamespaceAnnotation: "true"},
+		}}), false},
+		{"configmap only", configMapOnly(configMap(map[string]string{Key: "true"})), true},
+		{"configmap only released", configMapOnly(), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if engaged, reason := test.s.Engaged(); engaged != test.engaged {
+				t.Errorf("expected engaged %v, got %v (%s)", test.engaged, engaged, reason)
+			}
+		})
+	}
+}
+
+func TestOnChange(t *testing.T) {
+	s := newSwitch()
+	requeue := s.onChange(func() []string { return []string{"test/testing"} })
+
+	if keys := requeue(nil); len(keys) != 0 {
+		t.Errorf("requeued %v without a change", keys)
+	}
+	s.configMaps.GetIndexer().Add(configMap(map[string]string{Key: "true"}))
+	if keys := requeue(nil); len(keys) != 1 {
+		t.Error("engaging the stop didn't requeue")
+	}
+	s.configMaps.GetIndexer().Update(configMap(map[string]string{Key: "true", ReasonKey: "incident"}))
+	if keys := requeue(nil); len(keys) != 0 {
+		t.Errorf("requeued %v while the stop stayed engaged", keys)
+	}
+	s.configMaps.GetIndexer().Update(configMap(map[string]string{Key: "false"}))
+	if keys := requeue(nil); len(keys) != 1 {
+		t.Error("releasing the stop didn't requeue")
+	}
+}
+
+func TestEngageAndRelease(t *testing.T) {
+	kube := kubefake.NewSimpleClientset()
+
+	req := auth.WithUser(httptest.NewRequest("POST", "/emergency-stop", strings.NewReader(`{"reason": "incident"}`)), "alice")
+	rec := httptest.NewRecorder()
+	EngageHandler(kube)(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+
+	cm, err := kube.CoreV1().ConfigMaps("test").Get("miniop", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("configmap was not created: %v", err)
+	}
+	if cm.Data[Key] != "true" || cm.Data[ByKey] != "alice" || cm.Data[ReasonKey] != "incident" {
+		t.Errorf("stop was not recorded: %v", cm.Data)
+	}
+	if engaged, reason := newSwitch(cm).Engaged(); !engaged || !strings.Contains(reason, "alice: incident") {
+		t.Errorf("expected the stop to be engaged by alice, got %v (%s)", engaged, reason)
+	}
+
+	rec = httptest.NewRecorder()
+	ReleaseHandler(kube)(rec, auth.WithUser(httptest.NewRequest("DELETE", "/emergency-stop", nil), "alice"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+
+	cm, _ = kube.CoreV1().ConfigMaps("test").Get("miniop", metav1.GetOptions{})
+	if engaged, _ := newSwitch(cm).Engaged(); engaged {
+		t.Errorf("stop was not released: %v", cm.Data)
+	}
+}
@@ -0,0 +1,204 @@
+// Package webhook starts canaries for images pushed to a registry outside of
+// the cluster.  Registries send push notifications to the handler, which sets
+// canary-image of every deploymentconfig whose canary-repository annotation
+// refers to the pushed repository to the digest of the pushed image.
+package webhook
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	v1 "github.com/openshift/api/apps/v1"
+	appsv1 "github.com/openshift/client-go/apps/clientset/versioned/typed/apps/v1"
+	"github.com/redhatinsights/miniop/client"
+	l "github.com/redhatinsights/miniop/logger"
+	"go.uber.org/zap"
+	"k8s.io/client-go/tools/cache"
+)
+
+func init() {
+	l.InitLogger()
+}
+
+// Push is an image pushed to a repository.  Digest is empty if the
+// notification only named the tag.
+type Push struct {
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// quayPush is the payload of a Quay repository push notification
+type quayPush struct {
+	DockerURL   string   `json:"docker_url"`
+	UpdatedTags []string `json:"updated_tags"`
+}
+
+// registryEnvelope is the payload of a Docker Registry v2 notification
+type registryEnvelope struct {
+	Events []struct {
+		Action string `json:"action"`
+		Target struct {
+			MediaType  string `json:"mediaType"`
+			Digest     string `json:"digest"`
+			Repository string `json:"repository"`
+			Tag        string `json:"tag"`
+		} `json:"target"`
+		Request struct {
+			Host string `json:"host"`
+		} `json:"request"`
+	} `json:"events"`
+}
+
+// Parse returns the pushes in a Quay or Docker Registry v2 notification
+func Parse(body []byte) ([]Push, error) {
+	var envelope registryEnvelope
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, err
+	}
+	if envelope.Events != nil {
+		pushes := []Push{}
+		for _, event := range envelope.Events {
+			// blob uploads and pulls are reported as well
+			if event.Action != "push" || !strings.Contains(event.Target.MediaType, "manifest") {
+				continue
+			}
+			pushes = append(pushes, Push{
+				Repository: fmt.Sprintf("%s/%s", event.Request.Host, event.Target.Repository),
+				Tag:        event.Target.Tag,
+				Digest:     event.Target.Digest,
+			})
+		}
+		return pushes, nil
+	}
+
+	var quay quayPush
+	if err := json.Unmarshal(body, &quay); err != nil {
+		return nil, err
+	}
+	if quay.DockerURL == "" {
+		return nil, fmt.Errorf("neither a quay nor a registry notification")
+	}
+	pushes := []Push{}
+	for _, tag := range quay.UpdatedTags {
+		pushes = append(pushes, Push{Repository: quay.DockerURL, Tag: tag})
+	}
+	return pushes, nil
+}
+
+// Resolver looks up the digest a tag points to
+type Resolver interface {
+	Digest(repository, tag string) (string, error)
+}
+
+// RedactToken hides the token query parameter from the request URI, so that
+// request logs wrapped by it don't record the secret.  The handler still
+// reads the token from the URL.
+func RedactToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if _, ok := query["token"]; !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		query.Set("token", "REDACTED")
+		redacted := *r.URL
+		redacted.RawQuery = query.Encode()
+		req := *r
+		req.RequestURI = redacted.RequestURI()
+		next.ServeHTTP(w, &req)
+	})
+}
+
+// NewHandler returns a handler for registry push notifications.  Requests
+// have to carry token, either as bearer token or in the token query
+// parameter, as registries can't authenticate against the cluster.  Requests
+// passing the token in the query must only be logged through RedactToken.
+// Deploymentconfigs are looked up in dcs by client.CanaryRepositoryIndex.
+func NewHandler(apps appsv1.AppsV1Interface, dcs cache.Indexer, resolver Resolver, token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		given := r.URL.Query().Get("token")
+		if bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); bearer != r.Header.Get("Authorization") {
+			given = bearer
+		}
+		if token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var body json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid notification", http.StatusBadRequest)
+			return
+		}
+		pushes, err := Parse(body)
+		if err != nil {
+			l.Log.Info("invalid registry notification", zap.Error(err))
+			http.Error(w, "invalid notification", http.StatusBadRequest)
+			return
+		}
+
+		updated := []string{}
+		failed := false
+		for _, push := range pushes {
+			names, err := apply(apps, dcs, resolver, push)
+			updated = append(updated, names...)
+			if err != nil {
+				l.Log.Error("failed to start canaries for pushed image", zap.Error(err),
+					zap.String("repository", push.Repository), zap.String("tag", push.Tag))
+				failed = true
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if failed {
+			// registries redeliver failed notifications
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		json.NewEncoder(w).Encode(map[string][]string{"updated": updated})
+	}
+}
+
+// apply sets canary-image of the deploymentconfigs following the pushed
+// repository and tag, and returns their names
+func apply(apps appsv1.AppsV1Interface, dcs cache.Indexer, resolver Resolver, push Push) ([]string, error) {
+	objs, err := dcs.ByIndex(client.CanaryRepositoryIndex, push.Repository)
+	if err != nil {
+		return nil, err
+	}
+
+	updated := []string{}
+	for _, obj := range objs {
+		dc := obj.(*v1.DeploymentConfig)
+		if _, tag := client.SplitRepository(dc.Annotations["canary-repository"]); tag != "" && tag != push.Tag {
+			continue
+		}
+
+		if push.Digest == "" {
+			// quay only names the tags
+			push.Digest, err = resolver.Digest(push.Repository, push.Tag)
+			if err != nil {
+				return updated, fmt.Errorf("failed to resolve %s:%s: %v", push.Repository, push.Tag, err)
+			}
+		}
+		image := fmt.Sprintf("%s@%s", push.Repository, push.Digest)
+		if dc.Annotations["canary-image"] == image {
+			continue
+		}
+
+		_, err = client.UpdateDeploymentConfig(apps.DeploymentConfigs(client.Namespace), dc, func(dc *v1.DeploymentConfig) error {
+			dc.Annotations["canary-image"] = image
+			return nil
+		})
+		if err != nil {
+			return updated, fmt.Errorf("failed to update canary-image of %s: %v", dc.GetName(), err)
+		}
+		l.Log.Info(fmt.Sprintf("%s:%s pushed, starting canary for %s", push.Repository, push.Tag, dc.GetName()),
+			zap.String("deploymentconfig", dc.GetName()), zap.String("canary", image))
+		updated = append(updated, dc.GetName())
+	}
+	return updated, nil
+}
@@ -0,0 +1,178 @@
+package webhook
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	v1 "github.com/openshift/api/apps/v1"
+	"github.com/redhatinsights/miniop/client"
+	"github.com/redhatinsights/miniop/client/fake"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const quayNotification = `{
+	"repository": "myorg/myapp",
+	"docker_url": "quay.io/myorg/myapp",
+	"updated_tags": ["latest"]
+}`
+
+const registryNotification = `{"events": [
+	{"action": "push", "target": {"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip", "digest": "sha256:layer", "repository": "myapp"}, "request": {"host": "registry.example.com"}},
+	{"action": "push", "target": {"mediaType": "application/vnd.docker.distribution.manifest.v2+json", "digest": "sha256:abc", "repository": "myapp", "tag": "prod"}, "request": {"host": "registry.example.com"}},
+	{"action": "pull", "target": {"mediaType": "application/vnd.docker.distribution.manifest.v2+json", "digest": "sha256:def", "repository": "myapp", "tag": "prod"}, "request": {"host": "registry.example.com"}}
+]}`
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []Push
+	}{
+		{"quay", quayNotification, []Push{{Repository: "quay.io/myorg/myapp", Tag: "latest"}}},
+		{"registry", registryNotification, []Push{{Repository: "registry.example.com/myapp", Tag: "prod", Digest: "sha256:abc"}}},
+	}
+	for _, test := range tests {
+		got, err := Parse([]byte(test.body))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.want, got)
+		}
+	}
+
+	if _, err := Parse([]byte(`{"foo": "bar"}`)); err == nil {
+		t.Error("unknown notification was accepted")
+	}
+}
+
+type staticResolver string
+
+func (s staticResolver) Digest(repository, tag string) (string, error) {
+	return string(s), nil
+}
+
+func deploymentConfig(name, repository string) *v1.DeploymentConfig {
+	return &v1.DeploymentConfig{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   "test",
+			Annotations: map[string]string{"canary-repository": repository},
+		},
+	}
+}
+
+func notify(t *testing.T, apps *fake.Apps, path, body string) int {
+	t.Helper()
+	dcs := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{client.CanaryRepositoryIndex: client.CanaryRepositoryIndexFunc})
+	list, _ := apps.DeploymentConfigs("test").List(metav1.ListOptions{})
+	for idx := range list.Items {
+		dcs.Add(&list.Items[idx])
+	}
+
+	req := httptest.NewRequest("POST", path, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	NewHandler(apps, dcs, staticResolver("sha256:123"), "secret")(rec, req)
+	return rec.Code
+}
+
+func TestQuayPushStartsCanary(t *testing.T) {
+	apps := fake.NewApps(
+		deploymentConfig("any-tag", "quay.io/myorg/myapp"),
+		deploymentConfig("latest", "quay.io/myorg/myapp:latest"),
+		deploymentConfig("prod", "quay.io/myorg/myapp:prod"),
+		deploymentConfig("other", "quay.io/myorg/other"),
+	)
+
+	if code := notify(t, apps, "/webhook/registry?token=secret", quayNotification); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+
+	want := map[string]string{
+		"any-tag": "quay.io/myorg/myapp@sha256:123",
+		"latest":  "quay.io/myorg/myapp@sha256:123",
+		"prod":    "",
+		"other":   "",
+	}
+	for name, image := range want {
+		if got := apps.Stored(name).Annotations["canary-image"]; got != image {
+			t.Errorf("%s: expected canary-image %q, got %q", name, image, got)
+		}
+	}
+}
+
+func TestRegistryPushUsesDigest(t *testing.T) {
+	apps := fake.NewApps(deploymentConfig("prod", "registry.example.com/myapp:prod"))
+
+	if code := notify(t, apps, "/webhook/registry?token=secret", registryNotification); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if got := apps.Stored("prod").Annotations["canary-image"]; got != "registry.example.com/myapp@sha256:abc" {
+		t.Errorf("canary-image was not set to the pushed digest: %q", got)
+	}
+}
+
+func TestInvalidToken(t *testing.T) {
+	apps := fake.NewApps(deploymentConfig("any-tag", "quay.io/myorg/myapp"))
+
+	if code := notify(t, apps, "/webhook/registry?token=wrong", quayNotification); code != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", code)
+	}
+	if apps.Updates() != 0 {
+		t.Error("unauthenticated notification updated a deploymentconfig")
+	}
+}
+
+func TestRedactToken(t *testing.T) {
+	var logged, token string
+	handler := RedactToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logged, token = r.RequestURI, r.URL.Query().Get("token")
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/webhook/registry?token=secret", nil))
+	if strings.Contains(logged, "secret") {
+		t.Errorf("token was not redacted from %s", logged)
+	}
+	if token != "secret" {
+		t.Errorf("the handler lost the token, got %q", token)
+	}
+}
+
+func TestRegistryDigest(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			if r.URL.Query().Get("scope") != "repository:myorg/myapp:pull" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, `{"token": "abc"}`)
+		case "/v2/myorg/myapp/manifests/latest":
+			if r.Header.Get("Authorization") != "Bearer abc" {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry",scope="repository:myorg/myapp:pull"`, srv.URL))
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Docker-Content-Digest", "sha256:123")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	registry := &Registry{Client: srv.Client()}
+	host := strings.TrimPrefix(srv.URL, "https://")
+	digest, err := registry.Digest(host+"/myorg/myapp", "latest")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if digest != "sha256:123" {
+		t.Errorf("expected sha256:123, got %s", digest)
+	}
+}